@@ -6,9 +6,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"realworld-backend/common"
+	"realworld-backend/users"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -306,6 +310,30 @@ func TestUpdateArticle(t *testing.T) {
 	asserts.NotEmpty(articleModel.Slug)
 }
 
+func TestUpdateArticleVersionConflict(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	userModel := createTestUser("versioned")
+	articleUserModel := GetArticleUserModel(userModel)
+	articleModel := createTestArticle("Versioned Title", "Description", "Body", articleUserModel)
+	asserts.Equal(uint(1), articleModel.Version, "A new article should be at version 1")
+
+	first, _ := FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+	second, _ := FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+
+	asserts.NoError(first.Update(ArticleModel{Body: "First edit"}))
+	asserts.Equal(uint(2), first.Version)
+
+	err := second.Update(ArticleModel{Body: "Second edit"})
+	asserts.ErrorIs(err, ErrVersionConflict, "An update of a stale version should fail")
+
+	current, _ := FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+	asserts.Equal("First edit", current.Body, "The first edit should not be overwritten")
+	asserts.Equal(uint(2), current.Version)
+}
+
 func TestAutoMigrate(t *testing.T) {
 	asserts := assert.New(t)
 	setupTestDB()
@@ -526,6 +554,7 @@ func TestArticleFavorite(t *testing.T) {
 		ArticleFavorite(c)
 	})
 
+	favorites := testutil.ToFloat64(common.ArticleFavoritesTotal)
 	req, _ := http.NewRequest("POST", fmt.Sprintf("/articles/%s/favorite", articleModel.Slug), nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
@@ -537,6 +566,13 @@ func TestArticleFavorite(t *testing.T) {
 	article := response["article"].(map[string]interface{})
 	asserts.True(article["favorited"].(bool))
 	asserts.Equal(float64(1), article["favoritesCount"].(float64))
+	asserts.Equal(favorites+1, testutil.ToFloat64(common.ArticleFavoritesTotal))
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/articles/%s/favorite", articleModel.Slug), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(favorites+1, testutil.ToFloat64(common.ArticleFavoritesTotal), "favoriting again counts nothing")
 }
 
 func TestArticleUnfavorite(t *testing.T) {
@@ -605,6 +641,11 @@ func TestArticleCommentCreate(t *testing.T) {
 	json.Unmarshal(w.Body.Bytes(), &response)
 	comment := response["comment"].(map[string]interface{})
 	asserts.Equal("This is a test comment", comment["body"])
+
+	var stored ArticleModel
+	test_db.First(&stored, articleModel.ID)
+	asserts.Equal(articleModel.Version, stored.Version, "a comment does not write its article back")
+	asserts.True(articleModel.UpdatedAt.Equal(stored.UpdatedAt))
 }
 
 func TestArticleCommentDelete(t *testing.T) {
@@ -613,30 +654,40 @@ func TestArticleCommentDelete(t *testing.T) {
 	defer teardownTestDB()
 
 	userModel := createTestUser("routecommentdelete1")
+	other := createTestUser("routecommentdelete2")
+	moderator := createTestUser("routecommentdelete3")
+	moderator.Role = users.RoleModerator
 	articleUserModel := GetArticleUserModel(userModel)
 	articleModel := createTestArticle("Comment Delete Article", "Description", "Body", articleUserModel)
+	otherArticle := createTestArticle("Other Comment Delete Article", "Description", "Body", articleUserModel)
 
-	commentModel := CommentModel{
-		Article:   articleModel,
-		ArticleID: articleModel.ID,
-		Author:    articleUserModel,
-		AuthorID:  articleUserModel.ID,
-		Body:      "Comment to delete",
-	}
+	commentModel := CommentModel{ArticleID: articleModel.ID, AuthorID: articleUserModel.ID, Body: "Comment to delete"}
 	test_db.Create(&commentModel)
+	moderated := CommentModel{ArticleID: articleModel.ID, AuthorID: articleUserModel.ID, Body: "Comment to moderate"}
+	test_db.Create(&moderated)
 
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
+	router.Use(common.ErrorHandler())
+	var me users.UserModel
 	router.DELETE("/articles/:slug/comments/:id", func(c *gin.Context) {
-		c.Set("my_user_model", userModel)
+		c.Set("my_user_model", me)
 		ArticleCommentDelete(c)
 	})
 
-	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/articles/%s/comments/%d", articleModel.Slug, commentModel.ID), nil)
-	w := httptest.NewRecorder()
-	router.ServeHTTP(w, req)
+	request := func(user users.UserModel, slug string, id uint) *httptest.ResponseRecorder {
+		me = user
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/articles/%s/comments/%d", slug, id), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
 
-	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(http.StatusForbidden, request(other, articleModel.Slug, commentModel.ID).Code, "only the author can delete")
+	asserts.Equal(http.StatusNotFound, request(userModel, otherArticle.Slug, commentModel.ID).Code, "not a comment of that article")
+	asserts.Equal(http.StatusOK, request(userModel, articleModel.Slug, commentModel.ID).Code)
+	asserts.Equal(http.StatusNotFound, request(userModel, articleModel.Slug, commentModel.ID).Code, "already deleted")
+	asserts.Equal(http.StatusOK, request(moderator, articleModel.Slug, moderated.ID).Code, "a moderator can delete any comment")
 }
 
 func TestArticleCommentList(t *testing.T) {
@@ -685,6 +736,368 @@ func TestArticleCommentList(t *testing.T) {
 	asserts.Equal(2, len(comments))
 }
 
+func TestArticleCommentThreads(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	userModel := createTestUser("routecommentthread1")
+	articleUserModel := GetArticleUserModel(userModel)
+	articleModel := createTestArticle("Thread Article", "Description", "Body", articleUserModel)
+	otherArticle := createTestArticle("Other Thread Article", "Description", "Body", articleUserModel)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(common.ErrorHandler())
+	group := router.Group("/articles", func(c *gin.Context) {
+		c.Set("my_user_model", userModel)
+	})
+	group.POST("/:slug/comments", ArticleCommentCreate)
+	group.DELETE("/:slug/comments/:id", ArticleCommentDelete)
+	group.GET("/:slug/comments", ArticleCommentList)
+
+	reply := func(slug string, parentID interface{}, body string) (int, CommentResponse) {
+		jsonBody, _ := json.Marshal(map[string]interface{}{
+			"comment": map[string]interface{}{"body": body, "parentId": parentID},
+		})
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/articles/%s/comments", slug), bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response struct{ Comment CommentResponse }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Comment
+	}
+	list := func(query string) []CommentResponse {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/articles/%s/comments%s", articleModel.Slug, query), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		asserts.Equal(http.StatusOK, w.Code)
+		var response struct{ Comments []CommentResponse }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Comments
+	}
+
+	code, root := reply(articleModel.Slug, nil, "root")
+	asserts.Equal(http.StatusCreated, code)
+	asserts.Nil(root.ParentID)
+	_, first := reply(articleModel.Slug, root.ID, "first reply")
+	asserts.Equal(root.ID, *first.ParentID)
+	_, second := reply(articleModel.Slug, root.ID, "second reply")
+	_, nested := reply(articleModel.Slug, first.ID, "nested reply")
+
+	code, _ = reply(otherArticle.Slug, root.ID, "wrong article")
+	asserts.Equal(http.StatusUnprocessableEntity, code, "the parent must belong to the same article")
+	code, _ = reply(articleModel.Slug, 99999, "no such parent")
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+
+	parent := nested
+	for depth := 3; depth <= MaxCommentDepth; depth++ {
+		code, parent = reply(articleModel.Slug, parent.ID, "deeper")
+		asserts.Equal(http.StatusCreated, code)
+	}
+	code, _ = reply(articleModel.Slug, parent.ID, "too deep")
+	asserts.Equal(http.StatusUnprocessableEntity, code, "replies nest at most MaxCommentDepth levels")
+
+	flat := list("")
+	asserts.Len(flat, 2+MaxCommentDepth, "one comment per level and the second reply")
+	asserts.Equal(2, flat[0].ReplyCount)
+	asserts.Empty(flat[0].Replies)
+
+	tree := list("?tree=true")
+	asserts.Len(tree, 1)
+	asserts.Equal("root", tree[0].Body)
+	asserts.Len(tree[0].Replies, 2)
+	asserts.Equal(first.ID, tree[0].Replies[0].ID)
+	asserts.Equal(second.ID, tree[0].Replies[1].ID)
+	asserts.Equal(nested.ID, tree[0].Replies[0].Replies[0].ID)
+
+	deleteComment := func(id uint) int {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/articles/%s/comments/%d", articleModel.Slug, id), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	// the root has replies and stays as a placeholder
+	asserts.Equal(http.StatusOK, deleteComment(root.ID))
+	tree = list("?tree=true")
+	asserts.Len(tree, 1)
+	asserts.Equal(DeletedCommentBody, tree[0].Body)
+	asserts.Nil(tree[0].Author)
+	asserts.Equal("first reply", tree[0].Replies[0].Body)
+	code, _ = reply(articleModel.Slug, root.ID, "reply to deleted")
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+
+	// once its last reply is gone the placeholder goes too
+	asserts.Equal(http.StatusOK, deleteComment(second.ID))
+	asserts.Equal(http.StatusOK, deleteComment(first.ID))
+	asserts.Equal(DeletedCommentBody, list("?tree=true")[0].Replies[0].Body)
+	for id := parent.ID; id >= nested.ID; id-- {
+		asserts.Equal(http.StatusOK, deleteComment(id))
+	}
+	asserts.Empty(list("?tree=true"))
+	asserts.Equal(http.StatusNotFound, deleteComment(root.ID))
+}
+
+func TestArticleCommentEdit(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	author := createTestUser("commenteditor1")
+	other := createTestUser("commenteditor2")
+	moderator := createTestUser("commentmoderator1")
+	moderator.Role = users.RoleModerator
+	articleUserModel := GetArticleUserModel(author)
+	articleModel := createTestArticle("Edit Comment Article", "Description", "Body", articleUserModel)
+	otherArticle := createTestArticle("Other Edit Comment Article", "Description", "Body", articleUserModel)
+	commentModel := CommentModel{ArticleID: articleModel.ID, AuthorID: articleUserModel.ID, Body: "Helo"}
+	test_db.Create(&commentModel)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(common.ErrorHandler())
+	var me users.UserModel
+	group := router.Group("/articles", func(c *gin.Context) {
+		c.Set("my_user_model", me)
+	})
+	ArticlesRegister(group)
+	ArticlesAnonymousRegister(group)
+
+	request := func(user users.UserModel, method, path, body string) *httptest.ResponseRecorder {
+		me = user
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	path := fmt.Sprintf("/articles/%s/comments/%d", articleModel.Slug, commentModel.ID)
+
+	w := request(author, "GET", fmt.Sprintf("/articles/%s/comments", articleModel.Slug), "")
+	asserts.Contains(w.Body.String(), `"edited":false,"editedAt":null`)
+
+	w = request(other, "PUT", path, `{"comment":{"body":"Hijacked"}}`)
+	asserts.Equal(http.StatusForbidden, w.Code, "only the author can edit")
+	w = request(author, "PUT", fmt.Sprintf("/articles/%s/comments/%d", otherArticle.Slug, commentModel.ID), `{"comment":{"body":"Hello"}}`)
+	asserts.Equal(http.StatusNotFound, w.Code, "the comment must belong to the article")
+	w = request(author, "PUT", path, `{"comment":{"body":"`+strings.Repeat("a", 2049)+`"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	w = request(author, "PUT", path, `{"comment":{"body":"Hello"}}`)
+	asserts.Equal(http.StatusOK, w.Code, w.Body.String())
+	var response struct{ Comment CommentResponse }
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(commentModel.ID, response.Comment.ID, "the comment keeps its id")
+	asserts.Equal("Hello", response.Comment.Body)
+	asserts.True(response.Comment.Edited)
+	asserts.NotNil(response.Comment.EditedAt)
+	asserts.Equal("commenteditor1", response.Comment.Author.Username)
+	request(author, "PUT", path, `{"comment":{"body":"Hello"}}`)
+	request(author, "PUT", path, `{"comment":{"body":"Hello!"}}`)
+
+	w = request(author, "GET", path+"/history", "")
+	asserts.Equal(http.StatusForbidden, w.Code, "the history is for moderators")
+	w = request(moderator, "GET", path+"/history", "")
+	asserts.Equal(http.StatusOK, w.Code)
+	var history struct{ Revisions []CommentRevisionResponse }
+	json.Unmarshal(w.Body.Bytes(), &history)
+	asserts.Len(history.Revisions, 2, "an unchanged body is not a revision")
+	asserts.Equal("Helo", history.Revisions[0].Body)
+	asserts.Equal("Hello", history.Revisions[1].Body)
+	asserts.Equal(*response.Comment.EditedAt, history.Revisions[1].WrittenAt)
+
+	request(author, "DELETE", path, "")
+	w = request(author, "PUT", path, `{"comment":{"body":"Back"}}`)
+	asserts.Equal(http.StatusNotFound, w.Code)
+	w = request(moderator, "GET", path+"/history", "")
+	asserts.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestArticleCommentPolicy(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	author := createTestUser("policyauthor")
+	friend := createTestUser("policyfriend")
+	stranger := createTestUser("policystranger")
+	test_db.Create(&users.FollowModel{FollowingID: friend.ID, FollowedByID: author.ID})
+	articleModel := createTestArticle("Comment Policy Article", "Description", "Body", GetArticleUserModel(author))
+	friendComment := CommentModel{ArticleID: articleModel.ID, AuthorID: GetArticleUserModel(friend).ID, Body: "Early"}
+	test_db.Create(&friendComment)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(common.ErrorHandler())
+	var me users.UserModel
+	group := router.Group("/articles", func(c *gin.Context) {
+		c.Set("my_user_model", me)
+	})
+	ArticlesRegister(group)
+	ArticlesAnonymousRegister(group)
+	request := func(user users.UserModel, method, path, body string) (int, map[string]interface{}) {
+		me = user
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", common.ProblemJSONContentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	articlePath := "/articles/" + articleModel.Slug
+	commentsPath := articlePath + "/comments"
+	setPolicy := func(policy string) int {
+		code, response := request(author, "PUT", articlePath, `{"article":{"commentPolicy":"`+policy+`"}}`)
+		if code == http.StatusOK {
+			// the update makes the slug from the title
+			articlePath = "/articles/" + response["article"].(map[string]interface{})["slug"].(string)
+			commentsPath = articlePath + "/comments"
+		}
+		return code
+	}
+	comment := func(user users.UserModel) (int, interface{}) {
+		code, response := request(user, "POST", commentsPath, `{"comment":{"body":"Hi"}}`)
+		return code, response["code"]
+	}
+
+	_, response := request(stranger, "GET", articlePath, "")
+	article := response["article"].(map[string]interface{})
+	asserts.Equal(CommentsOpen, article["commentPolicy"])
+	asserts.Equal(true, article["canComment"])
+	code, _ := comment(stranger)
+	asserts.Equal(http.StatusCreated, code)
+
+	code, _ = request(stranger, "PUT", articlePath, `{"article":{"commentPolicy":"disabled"}}`)
+	asserts.Equal(http.StatusForbidden, code, "only the author sets the policy")
+	_, response = request(stranger, "GET", articlePath, "")
+	asserts.Equal(CommentsOpen, response["article"].(map[string]interface{})["commentPolicy"])
+
+	asserts.Equal(http.StatusOK, setPolicy(CommentsFollowers))
+	_, response = request(stranger, "GET", articlePath, "")
+	asserts.Equal(false, response["article"].(map[string]interface{})["canComment"])
+	code, errorCode := comment(stranger)
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(string(common.ErrorCodeCommentsRestricted), errorCode)
+	code, _ = comment(friend)
+	asserts.Equal(http.StatusCreated, code, "the author follows friend")
+	code, _ = comment(author)
+	asserts.Equal(http.StatusCreated, code, "the author can always comment")
+
+	asserts.Equal(http.StatusOK, setPolicy(CommentsLocked))
+	code, errorCode = comment(author)
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(string(common.ErrorCodeCommentsLocked), errorCode)
+	code, errorCode = request(friend, "PUT", fmt.Sprintf("%s/%d", commentsPath, friendComment.ID), `{"comment":{"body":"Edited"}}`)
+	asserts.Equal(http.StatusForbidden, code, "a locked thread cannot be edited")
+	_, response = request(stranger, "GET", commentsPath, "")
+	asserts.Equal(float64(4), response["commentsCount"], "a locked thread stays visible")
+
+	asserts.Equal(http.StatusOK, setPolicy(CommentsDisabled))
+	code, errorCode = comment(friend)
+	asserts.Equal(http.StatusForbidden, code)
+	asserts.Equal(string(common.ErrorCodeCommentsDisabled), errorCode)
+	_, response = request(stranger, "GET", commentsPath, "")
+	asserts.Empty(response["comments"])
+	asserts.Equal(float64(0), response["commentsCount"])
+
+	asserts.Equal(http.StatusUnprocessableEntity, setPolicy("members"))
+	asserts.Equal(http.StatusOK, setPolicy(CommentsOpen))
+	_, response = request(stranger, "GET", commentsPath, "")
+	asserts.Equal(float64(4), response["commentsCount"], "comments come back when reopened")
+}
+
+// Counts the statements gorm logs, the test database logs all of them.
+type queryCounter struct{ queries int }
+
+func (q *queryCounter) Print(values ...interface{}) {
+	if len(values) > 0 && values[0] == "sql" {
+		q.queries++
+	}
+}
+
+func TestArticleCommentListPages(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	me := createTestUser("commentpager0")
+	articleUserModel := GetArticleUserModel(me)
+	articleModel := createTestArticle("Paged Comments Article", "Description", "Body", articleUserModel)
+	var ids []uint
+	for i := 1; i <= 5; i++ {
+		author := GetArticleUserModel(createTestUser(fmt.Sprintf("commentpager%d", i)))
+		comment := CommentModel{ArticleID: articleModel.ID, AuthorID: author.ID, Body: fmt.Sprintf("Comment %d", i)}
+		test_db.Create(&comment)
+		ids = append(ids, comment.ID)
+		test_db.Create(&users.FollowModel{FollowingID: author.UserModelID, FollowedByID: me.ID})
+	}
+	reply := CommentModel{ArticleID: articleModel.ID, AuthorID: articleUserModel.ID, Body: "Reply", ParentID: &ids[0], Depth: 1}
+	test_db.Create(&reply)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(common.ErrorHandler())
+	router.GET("/articles/:slug/comments", func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		ArticleCommentList(c)
+	})
+	type page struct {
+		Comments      []CommentResponse
+		CommentsCount int
+		NextCursor    *string
+	}
+	list := func(query string) (int, page) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/articles/%s/comments?%s", articleModel.Slug, query), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response page
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	_, first := list("limit=2")
+	asserts.Equal(6, first.CommentsCount)
+	asserts.Len(first.Comments, 2)
+	asserts.Equal(ids[0], first.Comments[0].ID)
+	asserts.Equal(1, first.Comments[0].ReplyCount)
+	asserts.True(first.Comments[0].Author.Following)
+	asserts.NotNil(first.NextCursor)
+	_, second := list("limit=2&cursor=" + *first.NextCursor)
+	asserts.Equal([]uint{ids[2], ids[3]}, []uint{second.Comments[0].ID, second.Comments[1].ID})
+	_, last := list("limit=2&cursor=" + *second.NextCursor)
+	asserts.Len(last.Comments, 2)
+	asserts.Equal(reply.ID, last.Comments[1].ID)
+	asserts.Nil(last.NextCursor, "the last page has no next cursor")
+
+	_, newest := list("limit=3&sort=newest")
+	asserts.Equal([]uint{reply.ID, ids[4], ids[3]}, []uint{newest.Comments[0].ID, newest.Comments[1].ID, newest.Comments[2].ID})
+	_, older := list("limit=3&sort=newest&cursor=" + *newest.NextCursor)
+	asserts.Equal(ids[2], older.Comments[0].ID)
+
+	_, tree := list("tree=true&limit=1")
+	asserts.Len(tree.Comments, 1, "tree pages count top level comments")
+	asserts.Equal(reply.ID, tree.Comments[0].Replies[0].ID)
+
+	for _, query := range []string{"limit=0", "limit=x", "sort=best", "cursor=nope"} {
+		code, _ := list(query)
+		asserts.Equal(http.StatusUnprocessableEntity, code, query)
+	}
+
+	// the number of queries does not grow with the page
+	counter := &queryCounter{}
+	test_db.SetLogger(counter)
+	list("limit=1")
+	small := counter.queries
+	asserts.NotZero(small)
+	counter.queries = 0
+	_, full := list("limit=100")
+	asserts.Len(full.Comments, 6)
+	asserts.Equal(small, counter.queries)
+}
+
 func TestTagList(t *testing.T) {
 	asserts := assert.New(t)
 	setupTestDB()
@@ -712,6 +1125,42 @@ func TestTagList(t *testing.T) {
 	asserts.GreaterOrEqual(len(tags), 2)
 }
 
+func TestArticleRetrieveRenderHTML(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	userModel := createTestUser("routerender1")
+	articleUserModel := GetArticleUserModel(userModel)
+	articleModel := createTestArticle("Render Article", "Description",
+		"# Hello\n\nSome *Markdown* and <script>alert(1)</script> [a link](javascript:alert(1))", articleUserModel)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/articles/:slug", func(c *gin.Context) {
+		c.Set("my_user_model", userModel)
+		ArticleRetrieve(c)
+	})
+	get := func(url string) map[string]interface{} {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		asserts.Equal(http.StatusOK, w.Code)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response["article"].(map[string]interface{})
+	}
+
+	_, ok := get("/articles/" + articleModel.Slug)["bodyHtml"]
+	asserts.False(ok, "bodyHtml should only be sent with ?render=html")
+
+	html := get("/articles/" + articleModel.Slug + "?render=html")["bodyHtml"].(string)
+	asserts.Contains(html, "<h1>Hello</h1>")
+	asserts.Contains(html, "<em>Markdown</em>")
+	asserts.NotContains(html, "<script")
+	asserts.NotContains(html, "javascript:")
+}
+
 // ==============================================
 // Validator Binding Tests
 // ==============================================
@@ -886,3 +1335,106 @@ func TestNewArticleModelValidatorFillWith(t *testing.T) {
 	asserts.Equal("Body", validator.Article.Body)
 	asserts.Equal(2, len(validator.Article.Tags))
 }
+
+func TestArticleCreateRollsBackTagsOnFailure(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	userModel := createTestUser("routerollback1")
+	articleUserModel := GetArticleUserModel(userModel)
+	existing := createTestArticle("Duplicate Title", "Description", "Body", articleUserModel)
+	test_db.Model(&existing).Update("slug", "duplicate-title")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/articles", func(c *gin.Context) {
+		c.Set("my_user_model", userModel)
+		ArticleCreate(c)
+	})
+
+	body := map[string]interface{}{
+		"article": map[string]interface{}{
+			"title":   "Duplicate Title",
+			"body":    "Body",
+			"tagList": []string{"orphan"},
+		},
+	}
+	jsonBody, _ := json.Marshal(body)
+
+	req, _ := http.NewRequest("POST", "/articles", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	asserts.Equal(http.StatusConflict, w.Code)
+
+	// The tag created before the failed save should have been rolled back
+	var count int
+	test_db.Model(&TagModel{}).Where(&TagModel{Tag: "orphan"}).Count(&count)
+	asserts.Equal(0, count, "Tag should not outlive the failed article save")
+}
+
+func TestArticleModelValidatorBodyMaxLength(t *testing.T) {
+	asserts := assert.New(t)
+	defer func(max int) { common.ArticleBodyMaxLength = max }(common.ArticleBodyMaxLength)
+	common.ArticleBodyMaxLength = 10
+
+	gin.SetMode(gin.TestMode)
+	bind := func(body string) error {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		jsonBody, _ := json.Marshal(map[string]interface{}{
+			"article": map[string]interface{}{"title": "Long Body", "body": body},
+		})
+		c.Request, _ = http.NewRequest("POST", "/", bytes.NewBuffer(jsonBody))
+		c.Request.Header.Set("Content-Type", "application/json")
+		validator := NewArticleModelValidator()
+		return validator.Bind(c)
+	}
+
+	asserts.NoError(bind(strings.Repeat("é", 10)), "the limit should count characters, not bytes")
+	err := bind(strings.Repeat("a", 11))
+	asserts.Error(err)
+	asserts.Equal(map[string]interface{}{"body": "must be at most 10 characters long"}, common.NewBindError(err).Errors)
+}
+
+func TestArticleReadingStats(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	gin.SetMode(gin.TestMode)
+	bind := func(article map[string]interface{}) ArticleModel {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		jsonBody, _ := json.Marshal(map[string]interface{}{"article": article})
+		c.Request, _ = http.NewRequest("POST", "/", bytes.NewBuffer(jsonBody))
+		c.Request.Header.Set("Content-Type", "application/json")
+		validator := NewArticleModelValidator()
+		asserts.NoError(validator.Bind(c))
+		return validator.articleModel
+	}
+
+	body := "# Heading\n\n" + strings.Repeat("word ", 399) + "**last**"
+	articleModel := bind(map[string]interface{}{"title": "Reading Stats", "body": body})
+	asserts.Equal(401, articleModel.WordCount, "markup should not be counted")
+	asserts.Equal(3, articleModel.ReadingTime)
+	asserts.True(strings.HasPrefix(articleModel.Excerpt, "Heading word word"))
+	asserts.True(strings.HasSuffix(articleModel.Excerpt, "word…"))
+	asserts.LessOrEqual(len([]rune(articleModel.Excerpt)), ExcerptLength)
+
+	articleModel = bind(map[string]interface{}{"title": "Reading Stats", "description": "Mine", "body": "Short *body*"})
+	asserts.Equal(2, articleModel.WordCount)
+	asserts.Equal(1, articleModel.ReadingTime)
+	asserts.Equal("Mine", articleModel.Excerpt, "the description should be the excerpt when there is one")
+
+	// rows saved before the columns existed are filled in by the migration
+	userModel := createTestUser("readingstats1")
+	old := createTestArticle("Old Article", "", "An old _body_ here", GetArticleUserModel(userModel))
+	asserts.NoError(BackfillReadingStats(test_db))
+	found, err := FindOneArticle(&ArticleModel{Slug: old.Slug})
+	asserts.NoError(err)
+	asserts.Equal(4, found.WordCount)
+	asserts.Equal(1, found.ReadingTime)
+	asserts.Equal("An old body here", found.Excerpt)
+	asserts.Equal(uint(1), found.Version)
+}
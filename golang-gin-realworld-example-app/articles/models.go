@@ -1,11 +1,15 @@
 package articles
 
 import (
-	_ "fmt"
+	"errors"
+	"fmt"
 	"github.com/jinzhu/gorm"
 	"realworld-backend/common"
+	"realworld-backend/events"
 	"realworld-backend/users"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type ArticleModel struct {
@@ -13,11 +17,103 @@ type ArticleModel struct {
 	Slug        string `gorm:"unique_index"`
 	Title       string
 	Description string `gorm:"size:2048"`
-	Body        string `gorm:"size:2048"`
+	Body        string `gorm:"type:text"`
 	Author      ArticleUserModel
 	AuthorID    uint
 	Tags        []TagModel     `gorm:"many2many:article_tags;"`
 	Comments    []CommentModel `gorm:"ForeignKey:ArticleID"`
+	Version     uint           `gorm:"not null;default:1"`
+	WordCount   int            `gorm:"not null;default:0"`
+	ReadingTime int            `gorm:"not null;default:0"` // minutes
+	Excerpt     string         `gorm:"size:2048"`
+	// who may comment, one of the CommentPolicy values
+	CommentPolicy string `gorm:"size:16;not null;default:'open'"`
+}
+
+// What the author allows in the comments of an article.
+const (
+	CommentsOpen      = "open"      // anyone can comment
+	CommentsFollowers = "followers" // only the author and the users the author follows
+	CommentsLocked    = "locked"    // comments stay visible, nobody can add or edit one
+	CommentsDisabled  = "disabled"  // comments are hidden and nobody can add one
+)
+
+var (
+	ErrCommentsDisabled   = errors.New("are disabled on this article")
+	ErrCommentsLocked     = errors.New("are locked on this article")
+	ErrCommentsRestricted = errors.New("are limited to the users the author follows")
+)
+
+// What If-Match takes on update: the version alone, quoted, e.g. "3". Not the ETag of the
+// responses, which also changes with favorites and the caller.
+func (article ArticleModel) VersionTag() string {
+	return fmt.Sprintf(`"%d"`, article.Version)
+}
+
+// The policy of the article, rows created before it existed are open.
+func (article ArticleModel) commentPolicy() string {
+	if article.CommentPolicy == "" {
+		return CommentsOpen
+	}
+	return article.CommentPolicy
+}
+
+// Whether user may add a comment, nil or one of ErrCommentsDisabled, ErrCommentsLocked
+// and ErrCommentsRestricted.
+func (article ArticleModel) canCommentTx(db *gorm.DB, user users.UserModel) error {
+	switch article.commentPolicy() {
+	case CommentsDisabled:
+		return ErrCommentsDisabled
+	case CommentsLocked:
+		return ErrCommentsLocked
+	case CommentsFollowers:
+		author := article.Author.UserModel
+		if author.ID == 0 {
+			var articleUserModel ArticleUserModel
+			db.Preload("UserModel").First(&articleUserModel, article.AuthorID)
+			author = articleUserModel.UserModel
+		}
+		if user.ID != author.ID && !author.IsFollowingTx(db, user) {
+			return ErrCommentsRestricted
+		}
+	}
+	return nil
+}
+
+// What the reading time is based on.
+const WordsPerMinute = 200
+
+// The longest generated excerpt, in characters.
+const ExcerptLength = 280
+
+// Count the words of the body and derive the reading time and the excerpt from them: the
+// description when there is one, otherwise the start of the body as plain text.
+// Bind calls it on every create and update, so lists only read the stored values.
+func (model *ArticleModel) setReadingStats() error {
+	text, err := common.MarkdownText(model.Body)
+	if err != nil {
+		return err
+	}
+	model.WordCount = len(strings.Fields(text))
+	model.ReadingTime = (model.WordCount + WordsPerMinute - 1) / WordsPerMinute
+	model.Excerpt = model.Description
+	if model.Excerpt == "" {
+		model.Excerpt = excerpt(text, ExcerptLength)
+	}
+	return nil
+}
+
+// Cut text to at most max characters, at a word boundary when there is one, marking the cut with "…".
+func excerpt(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	cut := string(runes[:max-1])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:") + "…"
 }
 
 type ArticleUserModel struct {
@@ -49,23 +145,136 @@ type CommentModel struct {
 	Author    ArticleUserModel
 	AuthorID  uint
 	Body      string `gorm:"size:2048"`
+	ParentID  *uint  `gorm:"index"` // the comment this one replies to, nil at the top level
+	Depth     int    `gorm:"not null;default:0"`
+	// a deleted comment that still has replies stays as a placeholder, without body or author
+	Deleted    bool       `gorm:"not null;default:false"`
+	EditedAt   *time.Time // last edit by the author, nil if never edited
+	ReplyCount int        `gorm:"-"`
+}
+
+// Publish the new comment, with the author of the article, and of the parent comment for a reply.
+func (comment CommentModel) publishTx(tx *gorm.DB) error {
+	event := events.CommentCreated{
+		CommentID: comment.ID,
+		ArticleID: comment.ArticleID,
+		AuthorID:  comment.Author.UserModelID,
+	}
+	var err error
+	event.ArticleAuthorID, err = comment.Article.authorUserIDTx(tx)
+	if err != nil {
+		return err
+	}
+	if comment.ParentID != nil {
+		var parent CommentModel
+		if err := tx.Preload("Author").First(&parent, *comment.ParentID).Error; err != nil {
+			return err
+		}
+		event.ParentID = parent.ID
+		event.ParentAuthorID = parent.Author.UserModelID
+	}
+	return events.PublishTx(tx, event)
+}
+
+// A body a comment had before an edit, created at the moment it was replaced.
+// WrittenAt is when that body was posted or the edit before.
+type CommentRevisionModel struct {
+	gorm.Model
+	CommentID uint      `gorm:"index;not null"`
+	Body      string    `gorm:"size:2048"`
+	WrittenAt time.Time `gorm:"not null"`
+}
+
+// Replace the body of the comment, keeping the old one as a revision. An unchanged body is not an edit.
+func (comment *CommentModel) editTx(tx *gorm.DB, body string) error {
+	if body == comment.Body {
+		return nil
+	}
+	writtenAt := comment.CreatedAt
+	if comment.EditedAt != nil {
+		writtenAt = *comment.EditedAt
+	}
+	revision := CommentRevisionModel{CommentID: comment.ID, Body: comment.Body, WrittenAt: writtenAt}
+	if err := tx.Create(&revision).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	err := tx.Model(comment).Updates(map[string]interface{}{"body": body, "edited_at": now}).Error
+	if err != nil {
+		return err
+	}
+	comment.Body = body
+	comment.EditedAt = &now
+	return nil
+}
+
+// The previous bodies of a comment, oldest first.
+func (comment CommentModel) revisionsTx(db *gorm.DB) ([]CommentRevisionModel, error) {
+	var revisions []CommentRevisionModel
+	err := db.Where(&CommentRevisionModel{CommentID: comment.ID}).Order("id").Find(&revisions).Error
+	return revisions, err
+}
+
+// How deep replies nest: a top level comment is at depth 0, so a reply to a comment at
+// MaxCommentDepth is refused.
+const MaxCommentDepth = 5
+
+// Shown instead of the body of a deleted comment whose replies are kept.
+const DeletedCommentBody = "[deleted]"
+
+// Returned by reply checks, the handler reports them on "parentId".
+var (
+	ErrParentNotFound = errors.New("is not a comment of this article")
+	ErrParentDeleted  = errors.New("was deleted, it cannot be replied to")
+	ErrThreadTooDeep  = fmt.Errorf("replies can only be nested %d levels deep", MaxCommentDepth)
+)
+
+// Make the comment a reply to parentID, which must be a live comment of the same article
+// no deeper than MaxCommentDepth.
+func (comment *CommentModel) setParentTx(tx *gorm.DB, parentID uint) error {
+	var parent CommentModel
+	err := tx.Where("id = ? AND article_id = ?", parentID, comment.ArticleID).First(&parent).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrParentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if parent.Deleted {
+		return ErrParentDeleted
+	}
+	if parent.Depth >= MaxCommentDepth {
+		return ErrThreadTooDeep
+	}
+	comment.ParentID = &parent.ID
+	comment.Depth = parent.Depth + 1
+	return nil
 }
 
 func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
+	articleUserModel, _ := getArticleUserModelTx(common.GetDB(), userModel)
+	return articleUserModel
+}
+
+// The author row is created lazily, so callers inside a unit of work should use this variant
+// and pass the transaction to keep the FirstOrCreate in it.
+func getArticleUserModelTx(tx *gorm.DB, userModel users.UserModel) (ArticleUserModel, error) {
 	var articleUserModel ArticleUserModel
 	if userModel.ID == 0 {
-		return articleUserModel
+		return articleUserModel, nil
 	}
-	db := common.GetDB()
-	db.Where(&ArticleUserModel{
+	err := tx.Where(&ArticleUserModel{
 		UserModelID: userModel.ID,
-	}).FirstOrCreate(&articleUserModel)
+	}).FirstOrCreate(&articleUserModel).Error
 	articleUserModel.UserModel = userModel
-	return articleUserModel
+	return articleUserModel, err
 }
 
 func (article ArticleModel) favoritesCount() uint {
-	db := common.GetDB()
+	return article.favoritesCountTx(common.GetDB())
+}
+
+func (article ArticleModel) favoritesCountTx(db *gorm.DB) uint {
 	var count uint
 	db.Model(&FavoriteModel{}).Where(FavoriteModel{
 		FavoriteID: article.ID,
@@ -74,7 +283,10 @@ func (article ArticleModel) favoritesCount() uint {
 }
 
 func (article ArticleModel) isFavoriteBy(user ArticleUserModel) bool {
-	db := common.GetDB()
+	return article.isFavoriteByTx(common.GetDB(), user)
+}
+
+func (article ArticleModel) isFavoriteByTx(db *gorm.DB, user ArticleUserModel) bool {
 	var favorite FavoriteModel
 	db.Where(FavoriteModel{
 		FavoriteID:   article.ID,
@@ -84,35 +296,98 @@ func (article ArticleModel) isFavoriteBy(user ArticleUserModel) bool {
 }
 
 func (article ArticleModel) favoriteBy(user ArticleUserModel) error {
-	db := common.GetDB()
-	var favorite FavoriteModel
-	err := db.FirstOrCreate(&favorite, &FavoriteModel{
+	return article.favoriteByTx(common.GetDB(), user)
+}
+
+func (article ArticleModel) favoriteByTx(tx *gorm.DB, user ArticleUserModel) error {
+	favorite := FavoriteModel{
 		FavoriteID:   article.ID,
 		FavoriteByID: user.ID,
-	}).Error
-	return err
+	}
+	err := tx.Where(favorite).First(&FavoriteModel{}).Error
+	if !gorm.IsRecordNotFoundError(err) {
+		// already a favorite, not counted again, or the error
+		return err
+	}
+	if err := tx.Create(&favorite).Error; err != nil {
+		return err
+	}
+	common.AfterCommit(tx, common.ArticleFavoritesTotal.Inc)
+	authorID, err := article.authorUserIDTx(tx)
+	if err != nil {
+		return err
+	}
+	return events.PublishTx(tx, events.ArticleFavorited{ArticleID: article.ID, AuthorID: authorID, UserID: user.UserModelID})
+}
+
+// The id of the user who wrote the article, rather than of its ArticleUserModel.
+func (article ArticleModel) authorUserIDTx(db *gorm.DB) (uint, error) {
+	if article.Author.UserModelID != 0 {
+		return article.Author.UserModelID, nil
+	}
+	var author ArticleUserModel
+	err := db.First(&author, article.AuthorID).Error
+	return author.UserModelID, err
+}
+
+// Publish that the article was created, updated or deleted: events.TypeArticleCreated and the like.
+func (article ArticleModel) publishTx(tx *gorm.DB, eventType string) error {
+	authorID, err := article.authorUserIDTx(tx)
+	if err != nil {
+		return err
+	}
+	switch eventType {
+	case events.TypeArticleCreated:
+		return events.PublishTx(tx, events.ArticleCreated{ArticleID: article.ID, AuthorID: authorID})
+	case events.TypeArticleUpdated:
+		return events.PublishTx(tx, events.ArticleUpdated{ArticleID: article.ID, AuthorID: authorID})
+	}
+	return events.PublishTx(tx, events.ArticleDeleted{ArticleID: article.ID, AuthorID: authorID})
 }
 
 func (article ArticleModel) unFavoriteBy(user ArticleUserModel) error {
-	db := common.GetDB()
-	err := db.Where(FavoriteModel{
+	return article.unFavoriteByTx(common.GetDB(), user)
+}
+
+func (article ArticleModel) unFavoriteByTx(tx *gorm.DB, user ArticleUserModel) error {
+	result := tx.Where(FavoriteModel{
 		FavoriteID:   article.ID,
 		FavoriteByID: user.ID,
-	}).Delete(FavoriteModel{}).Error
-	return err
+	}).Delete(FavoriteModel{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		// not a favorite, or the error
+		return result.Error
+	}
+	authorID, err := article.authorUserIDTx(tx)
+	if err != nil {
+		return err
+	}
+	return events.PublishTx(tx, events.ArticleUnfavorited{ArticleID: article.ID, AuthorID: authorID, UserID: user.UserModelID})
 }
 
 func SaveOne(data interface{}) error {
-	db := common.GetDB()
-	err := db.Save(data).Error
+	return saveOneTx(common.GetDB(), data)
+}
+
+// Associations already stored, like the Article of a comment or the Author of an article, are
+// not written back: they were read before the transaction and would overwrite newer changes.
+func saveOneTx(tx *gorm.DB, data interface{}) error {
+	err := tx.Set("gorm:association_autoupdate", false).Save(data).Error
 	return err
 }
 
 func FindOneArticle(condition interface{}) (ArticleModel, error) {
-	db := common.GetDB()
+	return findOneArticleTx(common.GetDB(), condition)
+}
+
+// Reads take the handle too, so a handler can pass common.GetRequestDB(c) and get its queries traced.
+func findOneArticleTx(db *gorm.DB, condition interface{}) (ArticleModel, error) {
 	var model ArticleModel
 	tx := db.Begin()
-	tx.Where(condition).First(&model)
+	if err := tx.Where(condition).First(&model).Error; err != nil {
+		tx.Rollback()
+		return model, err
+	}
 	tx.Model(&model).Related(&model.Author, "Author")
 	tx.Model(&model.Author).Related(&model.Author.UserModel)
 	tx.Model(&model).Related(&model.Tags, "Tags")
@@ -120,27 +395,180 @@ func FindOneArticle(condition interface{}) (ArticleModel, error) {
 	return model, err
 }
 
+// How long reads stay in common.GetCache(). Writes through the handlers drop the entries they
+// change right away, the TTL bounds how stale another instance can be.
+const (
+	ArticleCacheTTL = time.Minute
+	TagsCacheTTL    = 5 * time.Minute
+)
+
+const tagsCacheKey = "tags:all"
+
+func articleCacheKey(slug string) string {
+	return "article:" + slug
+}
+
+// The article detail by slug, through the cache. Only the article, its author and its tags are
+// kept: favorites and comments change too often and are read per request.
+//
+//	articleModel, err := findArticleBySlugTx(common.GetRequestDB(c), slug)
+func findArticleBySlugTx(db *gorm.DB, slug string) (ArticleModel, error) {
+	cache := common.GetCache()
+	if cached, ok := cache.Get(articleCacheKey(slug)); ok {
+		return cached.(ArticleModel), nil
+	}
+	model, err := findOneArticleTx(db, &ArticleModel{Slug: slug})
+	if err == nil {
+		cache.Set(articleCacheKey(slug), model, ArticleCacheTTL)
+	}
+	return model, err
+}
+
+// Drop the cached articles of these slugs, and the tag list as a write may have added tags.
+// Call it once the transaction committed, or a concurrent read could cache the old rows again.
+func invalidateArticleCache(slugs ...string) {
+	cache := common.GetCache()
+	for _, slug := range slugs {
+		cache.Delete(articleCacheKey(slug))
+	}
+	cache.Delete(tagsCacheKey)
+}
+
 func (self *ArticleModel) getComments() error {
-	db := common.GetDB()
-	tx := db.Begin()
-	tx.Model(self).Related(&self.Comments, "Comments")
-	for i, _ := range self.Comments {
-		tx.Model(&self.Comments[i]).Related(&self.Comments[i].Author, "Author")
-		tx.Model(&self.Comments[i].Author).Related(&self.Comments[i].Author.UserModel)
+	return self.getCommentsTx(common.GetDB())
+}
+
+func (self *ArticleModel) getCommentsTx(db *gorm.DB) error {
+	err := db.Preload("Author.UserModel").Where("article_id = ?", self.ID).Order("id").Find(&self.Comments).Error
+	if err != nil {
+		return err
 	}
-	err := tx.Commit().Error
-	return err
+	return countRepliesTx(db, self.Comments)
+}
+
+// Comment lists are read a page at a time.
+const (
+	DefaultCommentsLimit = 20
+	MaxCommentsLimit     = 100
+)
+
+// Which comments of an article to read: Limit of them after the comment Cursor (0 for the first page),
+// oldest first unless Newest. With Tree, pages go over the top level comments, each with all its replies.
+type CommentsPage struct {
+	Limit  int
+	Cursor uint
+	Newest bool
+	Tree   bool
+}
+
+// A page of comments with their authors and reply counts, and the cursor of the next page, 0 after the last.
+// The number of queries does not depend on the number of comments.
+func (article ArticleModel) commentsPageTx(db *gorm.DB, page CommentsPage) ([]CommentModel, uint, error) {
+	query := db.Preload("Author.UserModel").Where("article_id = ?", article.ID)
+	if page.Tree {
+		query = query.Where("parent_id IS NULL")
+	}
+	if page.Newest {
+		query = query.Order("id desc")
+		if page.Cursor != 0 {
+			query = query.Where("id < ?", page.Cursor)
+		}
+	} else {
+		query = query.Order("id")
+		if page.Cursor != 0 {
+			query = query.Where("id > ?", page.Cursor)
+		}
+	}
+	var comments []CommentModel
+	// one more than asked tells whether there is a next page
+	if err := query.Limit(page.Limit + 1).Find(&comments).Error; err != nil {
+		return nil, 0, err
+	}
+	var next uint
+	if len(comments) > page.Limit {
+		comments = comments[:page.Limit]
+		next = comments[page.Limit-1].ID
+	}
+	if page.Tree {
+		// one level of replies at a time, so at most MaxCommentDepth more reads
+		parents := comments
+		for len(parents) > 0 {
+			ids := make([]uint, len(parents))
+			for i, parent := range parents {
+				ids[i] = parent.ID
+			}
+			var replies []CommentModel
+			err := db.Preload("Author.UserModel").Where("parent_id IN (?)", ids).Order("id").Find(&replies).Error
+			if err != nil {
+				return nil, 0, err
+			}
+			comments = append(comments, replies...)
+			parents = replies
+		}
+	}
+	return comments, next, countRepliesTx(db, comments)
+}
+
+// All the comments of the article, placeholders of deleted ones included.
+func (article ArticleModel) commentsCountTx(db *gorm.DB) (int, error) {
+	var count int
+	err := db.Model(&CommentModel{}).Where("article_id = ?", article.ID).Count(&count).Error
+	return count, err
+}
+
+// Fill in the ReplyCount of the comments.
+func countRepliesTx(db *gorm.DB, comments []CommentModel) error {
+	if len(comments) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(comments))
+	for i, comment := range comments {
+		ids[i] = comment.ID
+	}
+	rows, err := db.Model(&CommentModel{}).Select("parent_id, count(*)").
+		Where("parent_id IN (?)", ids).Group("parent_id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	replies := map[uint]int{}
+	for rows.Next() {
+		var parentID uint
+		var count int
+		if err := rows.Scan(&parentID, &count); err != nil {
+			return err
+		}
+		replies[parentID] = count
+	}
+	for i := range comments {
+		comments[i].ReplyCount = replies[comments[i].ID]
+	}
+	return rows.Err()
 }
 
 func getAllTags() ([]TagModel, error) {
-	db := common.GetDB()
+	return getAllTagsTx(common.GetDB())
+}
+
+// Every tag is read on each GET /api/tags, so the list is cached for TagsCacheTTL.
+func getAllTagsTx(db *gorm.DB) ([]TagModel, error) {
+	cache := common.GetCache()
+	if cached, ok := cache.Get(tagsCacheKey); ok {
+		return cached.([]TagModel), nil
+	}
 	var models []TagModel
 	err := db.Find(&models).Error
+	if err == nil {
+		cache.Set(tagsCacheKey, models, TagsCacheTTL)
+	}
 	return models, err
 }
 
 func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleModel, int, error) {
-	db := common.GetDB()
+	return findManyArticleTx(common.GetDB(), tag, author, limit, offset, favorited)
+}
+
+func findManyArticleTx(db *gorm.DB, tag, author, limit, offset, favorited string) ([]ArticleModel, int, error) {
 	var models []ArticleModel
 	var count int
 
@@ -165,7 +593,7 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 	} else if author != "" {
 		var userModel users.UserModel
 		tx.Where(users.UserModel{Username: author}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
+		articleUserModel, _ := getArticleUserModelTx(tx, userModel)
 
 		if articleUserModel.ID != 0 {
 			count = tx.Model(&articleUserModel).Association("ArticleModels").Count()
@@ -174,7 +602,7 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 	} else if favorited != "" {
 		var userModel users.UserModel
 		tx.Where(users.UserModel{Username: favorited}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
+		articleUserModel, _ := getArticleUserModelTx(tx, userModel)
 		if articleUserModel.ID != 0 {
 			var favoriteModels []FavoriteModel
 			tx.Where(FavoriteModel{
@@ -203,7 +631,10 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 }
 
 func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleModel, int, error) {
-	db := common.GetDB()
+	return self.getArticleFeedTx(common.GetDB(), limit, offset)
+}
+
+func (self *ArticleUserModel) getArticleFeedTx(db *gorm.DB, limit, offset string) ([]ArticleModel, int, error) {
 	var models []ArticleModel
 	var count int
 
@@ -217,10 +648,10 @@ func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleMod
 	}
 
 	tx := db.Begin()
-	followings := self.UserModel.GetFollowings()
+	followings := self.UserModel.GetFollowingsTx(db)
 	var articleUserModels []uint
 	for _, following := range followings {
-		articleUserModel := GetArticleUserModel(following)
+		articleUserModel, _ := getArticleUserModelTx(tx, following)
 		articleUserModels = append(articleUserModels, articleUserModel.ID)
 	}
 
@@ -236,11 +667,16 @@ func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleMod
 }
 
 func (model *ArticleModel) setTags(tags []string) error {
-	db := common.GetDB()
+	return model.setTagsTx(common.GetDB(), tags)
+}
+
+// Tags are created on demand, run this in the same transaction that saves the article
+// so a failed save does not leave orphan TagModel rows.
+func (model *ArticleModel) setTagsTx(tx *gorm.DB, tags []string) error {
 	var tagList []TagModel
 	for _, tag := range tags {
 		var tagModel TagModel
-		err := db.FirstOrCreate(&tagModel, TagModel{Tag: tag}).Error
+		err := tx.FirstOrCreate(&tagModel, TagModel{Tag: tag}).Error
 		if err != nil {
 			return err
 		}
@@ -251,23 +687,140 @@ func (model *ArticleModel) setTags(tags []string) error {
 }
 
 func (model *ArticleModel) Update(data interface{}) error {
-	db := common.GetDB()
-	err := db.Model(model).Update(data).Error
+	slug := model.Slug
+	err := model.updateTx(common.GetDB(), data)
+	if err == nil {
+		invalidateArticleCache(slug, model.Slug)
+	}
+	return err
+}
+
+// Returned by Update when the article was changed since it was read.
+var ErrVersionConflict = errors.New("article was modified concurrently")
+
+// The update only applies to the version that was read: when someone else updated the article
+// in between, nothing is written and ErrVersionConflict is returned. The version is bumped otherwise.
+func (model *ArticleModel) updateTx(tx *gorm.DB, data interface{}) error {
+	result := tx.Model(model).Where("version = ?", model.Version).Update(data)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	err := tx.Model(&ArticleModel{}).Where("id = ?", model.ID).UpdateColumn("version", gorm.Expr("version + 1")).Error
+	if err == nil {
+		model.Version++
+	}
 	return err
 }
 
 func DeleteArticleModel(condition interface{}) error {
-	db := common.GetDB()
-	err := db.Where(condition).Delete(ArticleModel{}).Error
+	return common.Transaction(func(tx *gorm.DB) error {
+		return deleteArticleModelTx(tx, condition)
+	})
+}
+
+// The comments and favorites of the matched articles are removed with them,
+// otherwise they would point to an article that no longer exists.
+func deleteArticleModelTx(tx *gorm.DB, condition interface{}) error {
+	var models []ArticleModel
+	if err := tx.Where(condition).Find(&models).Error; err != nil {
+		return err
+	}
+	for _, model := range models {
+		if err := model.publishTx(tx, events.TypeArticleDeleted); err != nil {
+			return err
+		}
+		if err := tx.Where("article_id = ?", model.ID).Delete(CommentModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("favorite_id = ?", model.ID).Delete(FavoriteModel{}).Error; err != nil {
+			return err
+		}
+	}
+	err := tx.Where(condition).Delete(ArticleModel{}).Error
 	return err
 }
 
+// Delete a comment. One that still has replies becomes a "[deleted]" placeholder instead so the
+// thread stays readable, and placeholders left without replies by the deletion go with it.
+func deleteCommentTx(tx *gorm.DB, id uint) error {
+	var comment CommentModel
+	if err := tx.First(&comment, id).Error; err != nil {
+		return err
+	}
+	for {
+		var replies int
+		if err := tx.Model(&CommentModel{}).Where("parent_id = ?", comment.ID).Count(&replies).Error; err != nil {
+			return err
+		}
+		if replies > 0 {
+			if comment.Deleted {
+				return nil
+			}
+			return tx.Model(&comment).UpdateColumns(map[string]interface{}{"body": "", "deleted": true}).Error
+		}
+		if err := tx.Delete(&comment).Error; err != nil {
+			return err
+		}
+		if comment.ParentID == nil {
+			return nil
+		}
+		var parent CommentModel
+		err := tx.First(&parent, *comment.ParentID).Error
+		if gorm.IsRecordNotFoundError(err) || err == nil && !parent.Deleted {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		comment = parent
+	}
+}
+
 func DeleteCommentModel(condition interface{}) error {
-	db := common.GetDB()
-	err := db.Where(condition).Delete(CommentModel{}).Error
+	return deleteCommentModelTx(common.GetDB(), condition)
+}
+
+func deleteCommentModelTx(tx *gorm.DB, condition interface{}) error {
+	err := tx.Where(condition).Delete(CommentModel{}).Error
 	return err
 }
 
+// Make the body a text column in databases created when it was a varchar(2048), which AutoMigrate
+// never alters. SQLite does not enforce the length, and cannot alter a column anyway.
+func MigrateBodyToText(db *gorm.DB) error {
+	if db.Dialect().GetName() == "sqlite3" {
+		return nil
+	}
+	return db.Model(&ArticleModel{}).ModifyColumn("body", "text").Error
+}
+
+// Compute the reading stats of articles saved before they existed. The migrate command runs it,
+// columns are updated directly so neither UpdatedAt nor the version move.
+func BackfillReadingStats(db *gorm.DB) error {
+	var models []ArticleModel
+	err := db.Select("id, description, body").Where("excerpt IS NULL OR excerpt = ''").Find(&models).Error
+	if err != nil {
+		return err
+	}
+	for _, model := range models {
+		if err := model.setReadingStats(); err != nil {
+			return err
+		}
+		err := db.Model(&ArticleModel{}).Where("id = ?", model.ID).UpdateColumns(map[string]interface{}{
+			"word_count":   model.WordCount,
+			"reading_time": model.ReadingTime,
+			"excerpt":      model.Excerpt,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // AutoMigrate runs the auto migration for article models
 func AutoMigrate() {
 	db := common.GetDB()
@@ -276,5 +829,6 @@ func AutoMigrate() {
 	db.AutoMigrate(&ArticleUserModel{})
 	db.AutoMigrate(&TagModel{})
 	db.AutoMigrate(&CommentModel{})
+	db.AutoMigrate(&CommentRevisionModel{})
 	db.AutoMigrate(&FavoriteModel{})
 }
@@ -1,12 +1,16 @@
 package articles
 
 import (
+	"encoding/base64"
 	"errors"
 	"realworld-backend/common"
+	"realworld-backend/events"
 	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func ArticlesRegister(router *gin.RouterGroup) {
@@ -16,7 +20,9 @@ func ArticlesRegister(router *gin.RouterGroup) {
 	router.POST("/:slug/favorite", ArticleFavorite)
 	router.DELETE("/:slug/favorite", ArticleUnfavorite)
 	router.POST("/:slug/comments", ArticleCommentCreate)
+	router.PUT("/:slug/comments/:id", ArticleCommentUpdate)
 	router.DELETE("/:slug/comments/:id", ArticleCommentDelete)
+	router.GET("/:slug/comments/:id/history", ArticleCommentHistory)
 }
 
 func ArticlesAnonymousRegister(router *gin.RouterGroup) {
@@ -32,16 +38,34 @@ func TagsAnonymousRegister(router *gin.RouterGroup) {
 func ArticleCreate(c *gin.Context) {
 	articleModelValidator := NewArticleModelValidator()
 	if err := articleModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		common.AbortWithError(c, common.NewBindError(err))
 		return
 	}
-	//fmt.Println(articleModelValidator.articleModel.Author.UserModel)
-
-	if err := SaveOne(&articleModelValidator.articleModel); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	articleModel := &articleModelValidator.articleModel
+	err := common.Transaction(func(tx *gorm.DB) error {
+		author, err := getArticleUserModelTx(tx, myUserModel)
+		if err != nil {
+			return err
+		}
+		articleModel.Author = author
+		if err := articleModel.setTagsTx(tx, articleModelValidator.Article.Tags); err != nil {
+			return err
+		}
+		if err := saveOneTx(tx, articleModel); err != nil {
+			return err
+		}
+		return articleModel.publishTx(tx, events.TypeArticleCreated)
+	})
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
-	serializer := ArticleSerializer{c, articleModelValidator.articleModel}
+	invalidateArticleCache()
+	common.ArticlesCreatedTotal.Inc()
+	serializer := ArticleSerializer{c, *articleModel}
+	// into the feed of the followers
+	common.GetHub().Publish(common.TopicFeed(myUserModel.ID), "article", gin.H{"article": serializer.FeedResponse()})
 	c.JSON(http.StatusCreated, gin.H{"article": serializer.Response()})
 }
 
@@ -52,13 +76,14 @@ func ArticleList(c *gin.Context) {
 	favorited := c.Query("favorited")
 	limit := c.Query("limit")
 	offset := c.Query("offset")
-	articleModels, modelCount, err := FindManyArticle(tag, author, limit, offset, favorited)
+	articleModels, modelCount, err := findManyArticleTx(common.GetRequestDB(c), tag, author, limit, offset, favorited)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
 	serializer := ArticlesSerializer{c, articleModels}
-	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount})
+	// no Last-Modified: a deleted article would not move the newest UpdatedAt
+	common.CacheableJSON(c, http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount}, time.Time{})
 }
 
 func ArticleFeed(c *gin.Context) {
@@ -66,13 +91,13 @@ func ArticleFeed(c *gin.Context) {
 	offset := c.Query("offset")
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 	if myUserModel.ID == 0 {
-		c.AbortWithError(http.StatusUnauthorized, errors.New("{error : \"Require auth!\"}"))
+		common.AbortWithError(c, common.NewUnauthorizedError("auth", errors.New("Require auth!")))
 		return
 	}
-	articleUserModel := GetArticleUserModel(myUserModel)
-	articleModels, modelCount, err := articleUserModel.GetArticleFeed(limit, offset)
+	articleUserModel, _ := getArticleUserModelTx(common.GetRequestDB(c), myUserModel)
+	articleModels, modelCount, err := articleUserModel.getArticleFeedTx(common.GetRequestDB(c), limit, offset)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
 	serializer := ArticlesSerializer{c, articleModels}
@@ -85,131 +110,413 @@ func ArticleRetrieve(c *gin.Context) {
 		ArticleFeed(c)
 		return
 	}
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := findArticleBySlugTx(common.GetRequestDB(c), slug)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		common.AbortWithError(c, common.NewNotFoundError("articles", errors.New("Invalid slug")))
 		return
 	}
 	serializer := ArticleSerializer{c, articleModel}
-	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+	common.CacheableJSON(c, http.StatusOK, gin.H{"article": serializer.Response()}, articleModel.UpdatedAt)
 }
 
 func ArticleUpdate(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := findOneArticleTx(common.GetRequestDB(c), &ArticleModel{Slug: slug})
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		common.AbortWithError(c, common.NewNotFoundError("articles", errors.New("Invalid slug")))
+		return
+	}
+	// only the author edits the article and decides who may comment on it
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	myArticleUserModel, err := getArticleUserModelTx(common.GetRequestDB(c), myUserModel)
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	if articleModel.AuthorID != myArticleUserModel.ID {
+		common.AbortWithError(c, common.NewForbiddenError("article", errors.New("Not the author")))
+		return
+	}
+	// If-Match holds the version the client edited, see VersionTag
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" && !common.ETagMatches(ifMatch, articleModel.VersionTag(), true) {
+		abortArticleModified(c, articleModel)
 		return
 	}
 	articleModelValidator := NewArticleModelValidatorFillWith(articleModel)
 	if err := articleModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		common.AbortWithError(c, common.NewBindError(err))
+		return
+	}
+	if version := articleModelValidator.Article.Version; version != nil && *version != articleModel.Version {
+		abortArticleModified(c, articleModel)
 		return
 	}
 
 	articleModelValidator.articleModel.ID = articleModel.ID
-	if err := articleModel.Update(articleModelValidator.articleModel); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	err = common.Transaction(func(tx *gorm.DB) error {
+		if err := articleModelValidator.articleModel.setTagsTx(tx, articleModelValidator.Article.Tags); err != nil {
+			return err
+		}
+		if err := articleModel.updateTx(tx, articleModelValidator.articleModel); err != nil {
+			return err
+		}
+		return articleModel.publishTx(tx, events.TypeArticleUpdated)
+	})
+	if errors.Is(err, ErrVersionConflict) {
+		// someone else got there between our read and our write
+		invalidateArticleCache(slug)
+		if current, err := findOneArticleTx(common.GetRequestDB(c), &ArticleModel{Model: gorm.Model{ID: articleModel.ID}}); err == nil {
+			articleModel = current
+		}
+		abortArticleModified(c, articleModel)
 		return
 	}
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	invalidateArticleCache(slug, articleModel.Slug)
 	serializer := ArticleSerializer{c, articleModel}
-	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+	common.CacheableJSON(c, http.StatusOK, gin.H{"article": serializer.Response()}, articleModel.UpdatedAt)
+}
+
+// 412 with the current version, so the client can retry after merging.
+func abortArticleModified(c *gin.Context, articleModel ArticleModel) {
+	common.AbortWithError(c, common.NewPreconditionFailedError("article",
+		errors.New("has been modified since you read it"), articleModel.Version))
 }
 
 func ArticleDelete(c *gin.Context) {
 	slug := c.Param("slug")
 	err := DeleteArticleModel(&ArticleModel{Slug: slug})
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
+	invalidateArticleCache(slug)
 	c.JSON(http.StatusOK, gin.H{"article": "Delete success"})
 }
 
 func ArticleFavorite(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := findArticleBySlugTx(common.GetRequestDB(c), slug)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		common.AbortWithError(c, common.NewNotFoundError("articles", errors.New("Invalid slug")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-	err = articleModel.favoriteBy(GetArticleUserModel(myUserModel))
+	err = common.Transaction(func(tx *gorm.DB) error {
+		articleUserModel, err := getArticleUserModelTx(tx, myUserModel)
+		if err != nil {
+			return err
+		}
+		return articleModel.favoriteByTx(tx, articleUserModel)
+	})
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
 func ArticleUnfavorite(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := findArticleBySlugTx(common.GetRequestDB(c), slug)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		common.AbortWithError(c, common.NewNotFoundError("articles", errors.New("Invalid slug")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-	err = articleModel.unFavoriteBy(GetArticleUserModel(myUserModel))
+	err = common.Transaction(func(tx *gorm.DB) error {
+		articleUserModel, err := getArticleUserModelTx(tx, myUserModel)
+		if err != nil {
+			return err
+		}
+		return articleModel.unFavoriteByTx(tx, articleUserModel)
+	})
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
 func ArticleCommentCreate(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	// not the cached copy: saving the comment saves its article too
+	articleModel, err := findOneArticleTx(common.GetRequestDB(c), &ArticleModel{Slug: slug})
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		common.AbortWithError(c, common.NewNotFoundError("comment", errors.New("Invalid slug")))
 		return
 	}
 	commentModelValidator := NewCommentModelValidator()
 	if err := commentModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		common.AbortWithError(c, common.NewBindError(err))
 		return
 	}
-	commentModelValidator.commentModel.Article = articleModel
-
-	if err := SaveOne(&commentModelValidator.commentModel); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err := articleModel.canCommentTx(common.GetRequestDB(c), myUserModel); err != nil {
+		abortCommentsClosed(c, err)
+		return
+	}
+	commentModel := &commentModelValidator.commentModel
+	commentModel.Article = articleModel
+	commentModel.ArticleID = articleModel.ID
+	err = common.Transaction(func(tx *gorm.DB) error {
+		if parentID := commentModelValidator.Comment.ParentID; parentID != nil {
+			if err := commentModel.setParentTx(tx, *parentID); err != nil {
+				return err
+			}
+		}
+		author, err := getArticleUserModelTx(tx, myUserModel)
+		if err != nil {
+			return err
+		}
+		commentModel.Author = author
+		if err := saveOneTx(tx, commentModel); err != nil {
+			return err
+		}
+		return commentModel.publishTx(tx)
+	})
+	if errors.Is(err, ErrParentNotFound) || errors.Is(err, ErrParentDeleted) || errors.Is(err, ErrThreadTooDeep) {
+		common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "parentId", err))
+		return
+	}
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
 	serializer := CommentSerializer{c, commentModelValidator.commentModel}
-	c.JSON(http.StatusCreated, gin.H{"comment": serializer.Response()})
+	response := serializer.Response()
+	common.GetHub().Publish(common.TopicArticleComments(articleModel.ID), "comment", gin.H{"article": articleModel.Slug, "comment": response})
+	c.JSON(http.StatusCreated, gin.H{"comment": response})
 }
 
-func ArticleCommentDelete(c *gin.Context) {
-	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	id := uint(id64)
+// 403 with the code of the policy that refused the comment, see canCommentTx.
+func abortCommentsClosed(c *gin.Context, err error) {
+	code := common.ErrorCodeCommentsRestricted
+	switch err {
+	case ErrCommentsDisabled:
+		code = common.ErrorCodeCommentsDisabled
+	case ErrCommentsLocked:
+		code = common.ErrorCodeCommentsLocked
+	}
+	common.AbortWithError(c, common.NewAppError(http.StatusForbidden, code, "comments", err))
+}
+
+// The comment :id of the article :slug, answering 404 itself when there is none.
+// Placeholders of deleted comments are found too.
+func findArticleComment(c *gin.Context) (CommentModel, bool) {
+	var commentModel CommentModel
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err == nil {
+		err = common.GetRequestDB(c).Table("comment_models").Select("comment_models.*").
+			Joins("JOIN article_models ON article_models.id = comment_models.article_id AND article_models.deleted_at IS NULL").
+			Where("comment_models.id = ? AND article_models.slug = ?", id, c.Param("slug")).
+			First(&commentModel).Error
+	}
+	if err != nil {
+		common.AbortWithError(c, common.NewNotFoundError("comment", errors.New("Invalid id")))
+		return commentModel, false
+	}
+	return commentModel, true
+}
+
+// Only the author can edit a comment. The previous body is kept, see ArticleCommentHistory.
+func ArticleCommentUpdate(c *gin.Context) {
+	commentModel, ok := findArticleComment(c)
+	if !ok {
+		return
+	}
+	if commentModel.Deleted {
+		common.AbortWithError(c, common.NewNotFoundError("comment", errors.New("Invalid id")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	db := common.GetRequestDB(c)
+	myArticleUserModel, err := getArticleUserModelTx(db, myUserModel)
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	if commentModel.AuthorID != myArticleUserModel.ID {
+		common.AbortWithError(c, common.NewForbiddenError("comment", errors.New("Not the author")))
+		return
+	}
+	// followers keep their comments editable, a locked or disabled thread is frozen
+	articleModel, err := findArticleBySlugTx(db, c.Param("slug"))
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	if policy := articleModel.commentPolicy(); policy == CommentsLocked || policy == CommentsDisabled {
+		abortCommentsClosed(c, articleModel.canCommentTx(db, myUserModel))
+		return
+	}
+	commentModelValidator := NewCommentModelValidator()
+	if err := commentModelValidator.Bind(c); err != nil {
+		common.AbortWithError(c, common.NewBindError(err))
+		return
+	}
+	err = common.Transaction(func(tx *gorm.DB) error {
+		return commentModel.editTx(tx, commentModelValidator.Comment.Body)
+	})
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	commentModel.Author = myArticleUserModel
+	serializer := CommentSerializer{c, commentModel}
+	c.JSON(http.StatusOK, gin.H{"comment": serializer.Response()})
+}
+
+// The bodies a comment had before its edits, for moderators.
+func ArticleCommentHistory(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !myUserModel.IsModerator() {
+		common.AbortWithError(c, common.NewForbiddenError("comment", errors.New("Only moderators can see the history")))
 		return
 	}
-	err = DeleteCommentModel([]uint{id})
+	commentModel, ok := findArticleComment(c)
+	if !ok {
+		return
+	}
+	revisions, err := commentModel.revisionsTx(common.GetRequestDB(c))
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := CommentRevisionsSerializer{c, revisions}
+	c.JSON(http.StatusOK, gin.H{"revisions": serializer.Response()})
+}
+
+// Only the author, or a moderator, can delete a comment.
+func ArticleCommentDelete(c *gin.Context) {
+	commentModel, ok := findArticleComment(c)
+	if !ok {
+		return
+	}
+	if commentModel.Deleted {
+		common.AbortWithError(c, common.NewNotFoundError("comment", errors.New("Invalid id")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !myUserModel.IsModerator() {
+		myArticleUserModel, err := getArticleUserModelTx(common.GetRequestDB(c), myUserModel)
+		if err != nil {
+			common.AbortWithError(c, common.NewDatabaseError(err))
+			return
+		}
+		if commentModel.AuthorID != myArticleUserModel.ID {
+			common.AbortWithError(c, common.NewForbiddenError("comment", errors.New("Not the author")))
+			return
+		}
+	}
+	err := common.Transaction(func(tx *gorm.DB) error {
+		return deleteCommentTx(tx, commentModel.ID)
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		common.AbortWithError(c, common.NewNotFoundError("comment", errors.New("Invalid id")))
+		return
+	}
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"comment": "Delete success"})
 }
 
+// Comments page by page: ?limit= (up to MaxCommentsLimit), ?sort=oldest or newest and ?cursor= with the
+// nextCursor of the previous page. With ?tree=true pages go over top level comments, replies nested in them.
 func ArticleCommentList(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := findArticleBySlugTx(common.GetRequestDB(c), slug)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Invalid slug")))
+		common.AbortWithError(c, common.NewNotFoundError("comments", errors.New("Invalid slug")))
+		return
+	}
+	page := CommentsPage{Limit: DefaultCommentsLimit, Tree: c.Query("tree") == "true"}
+	if limit := c.Query("limit"); limit != "" {
+		page.Limit, err = strconv.Atoi(limit)
+		if err != nil || page.Limit < 1 {
+			common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "limit",
+				errors.New("must be a positive number")))
+			return
+		}
+		if page.Limit > MaxCommentsLimit {
+			page.Limit = MaxCommentsLimit
+		}
+	}
+	switch c.DefaultQuery("sort", "oldest") {
+	case "oldest":
+	case "newest":
+		page.Newest = true
+	default:
+		common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "sort",
+			errors.New("must be oldest or newest")))
+		return
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		page.Cursor, err = decodeCommentsCursor(cursor)
+		if err != nil {
+			common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "cursor",
+				errors.New("is not a cursor of this list")))
+			return
+		}
+	}
+
+	db := common.GetRequestDB(c)
+	if articleModel.commentPolicy() == CommentsDisabled {
+		c.JSON(http.StatusOK, gin.H{"comments": []CommentResponse{}, "commentsCount": 0, "nextCursor": nil})
 		return
 	}
-	err = articleModel.getComments()
+	commentModels, next, err := articleModel.commentsPageTx(db, page)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
-	serializer := CommentsSerializer{c, articleModel.Comments}
-	c.JSON(http.StatusOK, gin.H{"comments": serializer.Response()})
+	count, err := articleModel.commentsCountTx(db)
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	var nextCursor *string
+	if next != 0 {
+		cursor := encodeCommentsCursor(next)
+		nextCursor = &cursor
+	}
+	serializer := CommentsSerializer{c, commentModels}
+	response := gin.H{"commentsCount": count, "nextCursor": nextCursor}
+	if page.Tree {
+		response["comments"] = serializer.Tree()
+	} else {
+		response["comments"] = serializer.Response()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Cursors are opaque to clients, so what they hold can change without breaking them.
+func encodeCommentsCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(id), 10)))
+}
+
+func decodeCommentsCursor(cursor string) (uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(string(raw), 10, 32)
+	return uint(id), err
 }
+
 func TagList(c *gin.Context) {
-	tagModels, err := getAllTags()
+	tagModels, err := getAllTagsTx(common.GetRequestDB(c))
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
 	serializer := TagsSerializer{c, tagModels}
-	c.JSON(http.StatusOK, gin.H{"tags": serializer.Response()})
+	common.CacheableJSON(c, http.StatusOK, gin.H{"tags": serializer.Response()}, time.Time{})
 }
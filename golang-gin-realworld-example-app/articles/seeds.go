@@ -0,0 +1,96 @@
+package articles
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gosimple/slug"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// How far back the creation dates of seeded articles and comments go.
+const SeedMaxAge = 90 * 24 * time.Hour
+
+// Create count articles by random authors, each with up to 4 tags, through setTags and SaveOne.
+// Creation dates are spread over the last SeedMaxAge so lists and the feed have a real order.
+//
+//	articleModels, err := SeedArticles(common.NewFaker(42), userModels, 50)
+func SeedArticles(faker *common.Faker, authors []users.UserModel, count int) ([]ArticleModel, error) {
+	now := time.Now()
+	titles := map[string]bool{}
+	articleModels := make([]ArticleModel, 0, count)
+	for i := 0; i < count; i++ {
+		title := faker.Title()
+		// there are only so many made up titles, and slugs are unique
+		for part := 2; titles[title]; part++ {
+			title = faker.Title() + ", part " + strconv.Itoa(part)
+		}
+		titles[title] = true
+
+		createdAt := faker.Past(now, SeedMaxAge)
+		articleModel := ArticleModel{
+			Slug:        slug.Make(title),
+			Title:       title,
+			Description: faker.Sentence(),
+			Body:        faker.Paragraphs(faker.Between(1, 3)),
+			Author:      GetArticleUserModel(authors[faker.Intn(len(authors))]),
+		}
+		articleModel.CreatedAt = createdAt
+		articleModel.UpdatedAt = createdAt
+
+		var tags []string
+		for _, t := range faker.Sample(len(common.FakerTags), faker.Between(0, 4)) {
+			tags = append(tags, common.FakerTags[t])
+		}
+		if err := articleModel.setReadingStats(); err != nil {
+			return articleModels, err
+		}
+		if err := articleModel.setTags(tags); err != nil {
+			return articleModels, err
+		}
+		if err := SaveOne(&articleModel); err != nil {
+			return articleModels, err
+		}
+		articleModels = append(articleModels, articleModel)
+	}
+	return articleModels, nil
+}
+
+// Add up to max comments to every article, by random commenters, after the article was written.
+func SeedComments(faker *common.Faker, articleModels []ArticleModel, commenters []users.UserModel, max int) (int, error) {
+	now := time.Now()
+	count := 0
+	for _, articleModel := range articleModels {
+		for n := faker.Between(0, max); n > 0; n-- {
+			// only the id: saving the article with it would bump its UpdatedAt
+			commentModel := CommentModel{
+				ArticleID: articleModel.ID,
+				Author:    GetArticleUserModel(commenters[faker.Intn(len(commenters))]),
+				Body:      faker.Paragraph(),
+			}
+			commentModel.CreatedAt = faker.Past(now, now.Sub(articleModel.CreatedAt))
+			commentModel.UpdatedAt = commentModel.CreatedAt
+			if err := SaveOne(&commentModel); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Make every user favorite up to max articles through favoriteBy.
+func SeedFavorites(faker *common.Faker, articleModels []ArticleModel, userModels []users.UserModel, max int) (int, error) {
+	count := 0
+	for _, userModel := range userModels {
+		articleUserModel := GetArticleUserModel(userModel)
+		for _, i := range faker.Sample(len(articleModels), faker.Between(0, max)) {
+			if err := articleModels[i].favoriteBy(articleUserModel); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
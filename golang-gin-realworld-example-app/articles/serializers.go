@@ -1,7 +1,9 @@
 package articles
 
 import (
+	"fmt"
 	"github.com/gosimple/slug"
+	"realworld-backend/common"
 	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
 )
@@ -35,7 +37,7 @@ type ArticleUserSerializer struct {
 }
 
 func (s *ArticleUserSerializer) Response() users.ProfileResponse {
-	response := users.ProfileSerializer{s.C, s.ArticleUserModel.UserModel}
+	response := users.ProfileSerializer{C: s.C, UserModel: s.ArticleUserModel.UserModel}
 	return response.Response()
 }
 
@@ -50,12 +52,19 @@ type ArticleResponse struct {
 	Slug           string                `json:"slug"`
 	Description    string                `json:"description"`
 	Body           string                `json:"body"`
+	BodyHTML       string                `json:"bodyHtml,omitempty"`
 	CreatedAt      string                `json:"createdAt"`
 	UpdatedAt      string                `json:"updatedAt"`
 	Author         users.ProfileResponse `json:"author"`
 	Tags           []string              `json:"tagList"`
 	Favorite       bool                  `json:"favorited"`
 	FavoritesCount uint                  `json:"favoritesCount"`
+	Version        uint                  `json:"version"`
+	WordCount      int                   `json:"wordCount"`
+	ReadingTime    int                   `json:"readingTime"`
+	Excerpt        string                `json:"excerpt"`
+	CommentPolicy  string                `json:"commentPolicy"`
+	CanComment     bool                  `json:"canComment"`
 }
 
 type ArticlesSerializer struct {
@@ -65,6 +74,8 @@ type ArticlesSerializer struct {
 
 func (s *ArticleSerializer) Response() ArticleResponse {
 	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
+	db := common.GetRequestDB(s.C)
+	myArticleUserModel, _ := getArticleUserModelTx(db, myUserModel)
 	authorSerializer := ArticleUserSerializer{s.C, s.Author}
 	response := ArticleResponse{
 		ID:          s.ID,
@@ -76,8 +87,17 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 		//UpdatedAt:      s.UpdatedAt.UTC().Format(time.RFC3339Nano),
 		UpdatedAt:      s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		Author:         authorSerializer.Response(),
-		Favorite:       s.isFavoriteBy(GetArticleUserModel(myUserModel)),
-		FavoritesCount: s.favoritesCount(),
+		Favorite:       s.isFavoriteByTx(db, myArticleUserModel),
+		FavoritesCount: s.favoritesCountTx(db),
+		Version:        s.Version,
+		WordCount:      s.WordCount,
+		ReadingTime:    s.ReadingTime,
+		Excerpt:        s.Excerpt,
+		CommentPolicy:  s.commentPolicy(),
+		CanComment:     myUserModel.ID != 0 && s.canCommentTx(db, myUserModel) == nil,
+	}
+	if s.C.Query("render") == "html" {
+		response.BodyHTML = s.bodyHTML()
 	}
 	response.Tags = make([]string, 0)
 	for _, tag := range s.Tags {
@@ -87,6 +107,55 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 	return response
 }
 
+// The body rendered from Markdown, kept in the cache per version since every update bumps it.
+func (s *ArticleSerializer) bodyHTML() string {
+	key := fmt.Sprintf("markdown:%d:%d", s.ID, s.Version)
+	if cached, ok := common.GetCache().Get(key); ok && s.ID != 0 {
+		return cached.(string)
+	}
+	html, err := common.RenderMarkdown(s.Body)
+	if err != nil {
+		common.LoggerFrom(s.C).Error("articles: cannot render body", "slug", s.Slug, "error", err)
+		return ""
+	}
+	if s.ID != 0 {
+		common.GetCache().Set(key, html, ArticleCacheTTL)
+	}
+	return html
+}
+
+// What the followers of the author get on the live stream: the same for all of them, so nothing
+// that depends on who is looking, like favorited or following.
+type FeedArticleResponse struct {
+	Slug        string             `json:"slug"`
+	Title       string             `json:"title"`
+	Description string             `json:"description"`
+	Tags        []string           `json:"tagList"`
+	CreatedAt   string             `json:"createdAt"`
+	Author      FeedAuthorResponse `json:"author"`
+}
+
+type FeedAuthorResponse struct {
+	Username string  `json:"username"`
+	Image    *string `json:"image"`
+}
+
+func (s *ArticleSerializer) FeedResponse() FeedArticleResponse {
+	response := FeedArticleResponse{
+		Slug:        s.Slug,
+		Title:       s.Title,
+		Description: s.Description,
+		Tags:        make([]string, 0),
+		CreatedAt:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Author:      FeedAuthorResponse{Username: s.Author.UserModel.Username, Image: s.Author.UserModel.Image},
+	}
+	for _, tag := range s.Tags {
+		serializer := TagSerializer{s.C, tag}
+		response.Tags = append(response.Tags, serializer.Response())
+	}
+	return response
+}
+
 func (s *ArticlesSerializer) Response() []ArticleResponse {
 	response := []ArticleResponse{}
 	for _, article := range s.Articles {
@@ -107,30 +176,112 @@ type CommentsSerializer struct {
 }
 
 type CommentResponse struct {
-	ID        uint                  `json:"id"`
-	Body      string                `json:"body"`
-	CreatedAt string                `json:"createdAt"`
-	UpdatedAt string                `json:"updatedAt"`
-	Author    users.ProfileResponse `json:"author"`
+	ID         uint                   `json:"id"`
+	Body       string                 `json:"body"`
+	CreatedAt  string                 `json:"createdAt"`
+	UpdatedAt  string                 `json:"updatedAt"`
+	Author     *users.ProfileResponse `json:"author"`
+	ParentID   *uint                  `json:"parentId"`
+	ReplyCount int                    `json:"replyCount"`
+	Edited     bool                   `json:"edited"`
+	EditedAt   *string                `json:"editedAt"`
+	Replies    []CommentResponse      `json:"replies,omitempty"`
 }
 
 func (s *CommentSerializer) Response() CommentResponse {
-	authorSerializer := ArticleUserSerializer{s.C, s.Author}
+	var author *users.ProfileResponse
+	if !s.Deleted {
+		authorSerializer := ArticleUserSerializer{s.C, s.Author}
+		profile := authorSerializer.Response()
+		author = &profile
+	}
+	return s.response(author)
+}
+
+func (s *CommentSerializer) response(author *users.ProfileResponse) CommentResponse {
 	response := CommentResponse{
-		ID:        s.ID,
-		Body:      s.Body,
-		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
-		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
-		Author:    authorSerializer.Response(),
+		ID:         s.ID,
+		Body:       s.Body,
+		CreatedAt:  s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		UpdatedAt:  s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Author:     author,
+		ParentID:   s.ParentID,
+		ReplyCount: s.ReplyCount,
+	}
+	if s.EditedAt != nil {
+		editedAt := s.EditedAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.Edited = true
+		response.EditedAt = &editedAt
+	}
+	if s.Deleted {
+		// kept for its replies, who wrote it is gone with what was written
+		response.Body = DeletedCommentBody
+		response.Author = nil
 	}
 	return response
 }
 
 func (s *CommentsSerializer) Response() []CommentResponse {
-	response := []CommentResponse{}
+	// the authors all at once, rather than a following lookup per comment
+	authors := []users.UserModel{}
 	for _, comment := range s.Comments {
+		authors = append(authors, comment.Author.UserModel)
+	}
+	profilesSerializer := users.ProfilesSerializer{C: s.C, Users: authors}
+	profiles := profilesSerializer.Response()
+	response := []CommentResponse{}
+	for i, comment := range s.Comments {
 		serializer := CommentSerializer{s.C, comment}
-		response = append(response, serializer.Response())
+		response = append(response, serializer.response(&profiles[i]))
+	}
+	return response
+}
+
+// The top level comments with their replies nested under them, each level in the order of Comments.
+func (s *CommentsSerializer) Tree() []CommentResponse {
+	flat := s.Response()
+	children := map[uint][]int{}
+	for i, comment := range flat {
+		if comment.ParentID != nil {
+			children[*comment.ParentID] = append(children[*comment.ParentID], i)
+		}
+	}
+	var nest func(i int) CommentResponse
+	nest = func(i int) CommentResponse {
+		comment := flat[i]
+		for _, child := range children[comment.ID] {
+			comment.Replies = append(comment.Replies, nest(child))
+		}
+		return comment
+	}
+	response := []CommentResponse{}
+	for i, comment := range flat {
+		if comment.ParentID == nil {
+			response = append(response, nest(i))
+		}
+	}
+	return response
+}
+
+type CommentRevisionsSerializer struct {
+	C         *gin.Context
+	Revisions []CommentRevisionModel
+}
+
+type CommentRevisionResponse struct {
+	Body       string `json:"body"`
+	WrittenAt  string `json:"writtenAt"`
+	ReplacedAt string `json:"replacedAt"`
+}
+
+func (s *CommentRevisionsSerializer) Response() []CommentRevisionResponse {
+	response := []CommentRevisionResponse{}
+	for _, revision := range s.Revisions {
+		response = append(response, CommentRevisionResponse{
+			Body:       revision.Body,
+			WrittenAt:  revision.WrittenAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			ReplacedAt: revision.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		})
 	}
 	return response
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http/httptest"
 	"realworld-backend/common"
+	"realworld-backend/events"
 	"realworld-backend/users"
 	"testing"
 
@@ -18,6 +19,7 @@ var test_db *gorm.DB
 func setupTestDB() {
 	test_db = common.TestDBInit()
 	users.AutoMigrate()
+	events.AutoMigrate()
 	AutoMigrate()
 }
 
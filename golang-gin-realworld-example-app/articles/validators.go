@@ -3,7 +3,6 @@ package articles
 import (
 	"github.com/gosimple/slug"
 	"realworld-backend/common"
-	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
 )
 
@@ -11,8 +10,11 @@ type ArticleModelValidator struct {
 	Article struct {
 		Title       string   `form:"title" json:"title" binding:"required,min=4"`
 		Description string   `form:"description" json:"description" binding:"max=2048"`
-		Body        string   `form:"body" json:"body" binding:"max=2048"`
-		Tags        []string `form:"tagList" json:"tagList"`
+		Body        string   `form:"body" json:"body" binding:"articlebody"`
+		Tags        []string `form:"tagList" json:"tagList" binding:"dive,tag"`
+		// optional on update, the version the client edited, like an If-Match header
+		Version       *uint  `form:"version" json:"version"`
+		CommentPolicy string `form:"commentPolicy" json:"commentPolicy" binding:"omitempty,oneof=open followers locked disabled"`
 	} `json:"article"`
 	articleModel ArticleModel `json:"-"`
 }
@@ -26,15 +28,16 @@ func NewArticleModelValidatorFillWith(articleModel ArticleModel) ArticleModelVal
 	articleModelValidator.Article.Title = articleModel.Title
 	articleModelValidator.Article.Description = articleModel.Description
 	articleModelValidator.Article.Body = articleModel.Body
+	articleModelValidator.Article.CommentPolicy = articleModel.commentPolicy()
 	for _, tagModel := range articleModel.Tags {
 		articleModelValidator.Article.Tags = append(articleModelValidator.Article.Tags, tagModel.Tag)
 	}
 	return articleModelValidator
 }
 
+// Bind only fills the article from the request, the author row and the tags are written
+// by the handler inside the same transaction as the article itself.
 func (s *ArticleModelValidator) Bind(c *gin.Context) error {
-	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-
 	err := common.Bind(c, s)
 	if err != nil {
 		return err
@@ -43,14 +46,14 @@ func (s *ArticleModelValidator) Bind(c *gin.Context) error {
 	s.articleModel.Title = s.Article.Title
 	s.articleModel.Description = s.Article.Description
 	s.articleModel.Body = s.Article.Body
-	s.articleModel.Author = GetArticleUserModel(myUserModel)
-	s.articleModel.setTags(s.Article.Tags)
-	return nil
+	s.articleModel.CommentPolicy = s.Article.CommentPolicy
+	return s.articleModel.setReadingStats()
 }
 
 type CommentModelValidator struct {
 	Comment struct {
-		Body string `form:"body" json:"body" binding:"max=2048"`
+		Body     string `form:"body" json:"body" binding:"max=2048"`
+		ParentID *uint  `form:"parentId" json:"parentId"`
 	} `json:"comment"`
 	commentModel CommentModel `json:"-"`
 }
@@ -60,13 +63,10 @@ func NewCommentModelValidator() CommentModelValidator {
 }
 
 func (s *CommentModelValidator) Bind(c *gin.Context) error {
-	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-
 	err := common.Bind(c, s)
 	if err != nil {
 		return err
 	}
 	s.commentModel.Body = s.Comment.Body
-	s.commentModel.Author = GetArticleUserModel(myUserModel)
 	return nil
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+const usage = `Usage: realworld-server <command> [flags]
+
+Commands:
+  serve                        run the API server (the default)
+  worker                       run the background jobs, without the API
+  migrate                      create or update the database schema
+  seed                         fill the database with generated demo data
+  user create                  create a user
+  user promote                 change the role of a user
+  user reset-password          set a new password for a user
+  token issue                  print a JWT for a user
+
+Run "realworld-server <command> -h" for the flags of a command.
+`
+
+// The command line. Commands run against the database returned by OpenDB,
+// their output goes to Stdout and passwords not given as flags are read from Stdin.
+//
+//	cli := &CLI{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr, OpenDB: common.Init}
+//	err := cli.Run(os.Args[1:])
+type CLI struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	OpenDB func() *gorm.DB
+}
+
+type command func(cli *CLI, args []string) error
+
+var commands = map[string]command{
+	"serve":               runServe,
+	"worker":              runWorker,
+	"migrate":             runMigrate,
+	"seed":                runSeed,
+	"user create":         runUserCreate,
+	"user promote":        runUserPromote,
+	"user reset-password": runUserResetPassword,
+	"token issue":         runTokenIssue,
+}
+
+// Returned when the arguments name no command, main prints the usage for it.
+var errUnknownCommand = errors.New("unknown command")
+
+func (cli *CLI) Run(args []string) error {
+	if len(args) == 0 {
+		return runServe(cli, nil)
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(cli.Stdout, usage)
+		return nil
+	}
+	// "user create" and "token issue" are two words, everything else is one
+	if len(args) >= 2 {
+		if cmd, ok := commands[args[0]+" "+args[1]]; ok {
+			return cmd(cli, args[2:])
+		}
+	}
+	if cmd, ok := commands[args[0]]; ok {
+		return cmd(cli, args[1:])
+	}
+	fmt.Fprint(cli.Stderr, usage)
+	return fmt.Errorf("%w: %s", errUnknownCommand, strings.Join(args, " "))
+}
+
+func (cli *CLI) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(cli.Stderr)
+	return flags
+}
+
+// The password of --password, or the first line of stdin so it stays out of the shell history.
+func (cli *CLI) password(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	line, err := bufio.NewReader(cli.Stdin).ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return "", errors.New("no password given, pass --password or write it on stdin")
+	}
+	return line, nil
+}
+
+func runServe(cli *CLI, args []string) error {
+	flags := cli.flagSet("serve")
+	migrate := flags.Bool("migrate", false, "migrate the database before serving")
+	worker := flags.Bool("worker", true, "run the background jobs too, false when they run in a worker process")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	db := cli.OpenDB()
+	if *migrate {
+		if err := Migrate(db); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	// the server closes the database once it has drained
+	return serve(db, *worker)
+}
+
+// Run the background jobs until SIGINT or SIGTERM, next to servers started with --worker=false.
+// The jobs running then get SHUTDOWN_TIMEOUT to finish.
+func runWorker(cli *CLI, args []string) error {
+	if err := cli.flagSet("worker").Parse(args); err != nil {
+		return err
+	}
+	common.InitLogger(cli.Stdout, os.Getenv("LOG_LEVEL"))
+	db := cli.OpenDB()
+	defer db.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopWorker := startWorker(db)
+	common.Logger.Info("worker: running")
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), common.ServerConfigFromEnv().ShutdownTimeout)
+	defer cancel()
+	err := stopWorker(shutdownCtx)
+	common.Logger.Info("worker: stopped")
+	return err
+}
+
+func runMigrate(cli *CLI, args []string) error {
+	if err := cli.flagSet("migrate").Parse(args); err != nil {
+		return err
+	}
+	db := cli.OpenDB()
+	defer db.Close()
+	if err := Migrate(db); err != nil {
+		return err
+	}
+	if err := common.MigrationCheck(db, migratedModels...).Check(context.Background()); err != nil {
+		return err
+	}
+	fmt.Fprintln(cli.Stdout, "database migrated")
+	return nil
+}
+
+// Seed a configurable amount of demo data. The same --seed always generates the same data set,
+// so it can only be loaded once per database.
+func runSeed(cli *CLI, args []string) error {
+	flags := cli.flagSet("seed")
+	seed := flags.Int64("seed", 1, "random seed, the same seed generates the same data")
+	userCount := flags.Int("users", 20, "number of users")
+	articleCount := flags.Int("articles", 100, "number of articles")
+	maxFollows := flags.Int("follows", 5, "maximum users each user follows")
+	maxComments := flags.Int("comments", 5, "maximum comments per article")
+	maxFavorites := flags.Int("favorites", 10, "maximum articles each user favorites")
+	password := flags.String("password", "password", "password of every seeded user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *userCount < 1 {
+		return errors.New("--users must be at least 1")
+	}
+	db := cli.OpenDB()
+	defer db.Close()
+	if err := Migrate(db); err != nil {
+		return err
+	}
+
+	faker := common.NewFaker(*seed)
+	userModels, err := users.SeedUsers(faker, *userCount, *password)
+	if err != nil {
+		if common.NewDatabaseError(err).Code == common.ErrorCodeConflict {
+			return fmt.Errorf("seed %d is already loaded, pick another --seed", *seed)
+		}
+		return err
+	}
+	// the demo user takes part in the follow graph, so its feed is not empty
+	demo, err := users.FindUserByLogin("demo")
+	if gorm.IsRecordNotFoundError(err) {
+		demo, err = users.CreateUser("demo", "demo@example.com", *password, users.RoleUser)
+		if err != nil {
+			return describeUserError(err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	follows, err := users.SeedFollows(faker, append(userModels, demo), *maxFollows)
+	if err != nil {
+		return err
+	}
+	articleModels, err := articles.SeedArticles(faker, userModels, *articleCount)
+	if err != nil {
+		return err
+	}
+	comments, err := articles.SeedComments(faker, articleModels, userModels, *maxComments)
+	if err != nil {
+		return err
+	}
+	favorites, err := articles.SeedFavorites(faker, articleModels, userModels, *maxFavorites)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.Stdout, "seeded %d users, %d follows, %d articles, %d comments and %d favorites (seed %d)\n",
+		len(userModels), follows, len(articleModels), comments, favorites, *seed)
+	fmt.Fprintf(cli.Stdout, "log in as demo@example.com or %s@example.com with password %q\n", userModels[0].Username, *password)
+	return nil
+}
+
+func runUserCreate(cli *CLI, args []string) error {
+	flags := cli.flagSet("user create")
+	username := flags.String("username", "", "username (required)")
+	email := flags.String("email", "", "email (required)")
+	password := flags.String("password", "", "password, read from stdin when omitted")
+	role := flags.String("role", users.RoleUser, "user, moderator or admin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	pass, err := cli.password(*password)
+	if err != nil {
+		return err
+	}
+	db := cli.OpenDB()
+	defer db.Close()
+
+	userModel, err := users.CreateUser(*username, *email, pass, *role)
+	if err != nil {
+		return describeUserError(err)
+	}
+	fmt.Fprintf(cli.Stdout, "created user %s (id %d, role %s)\n", userModel.Username, userModel.ID, userModel.Role)
+	return nil
+}
+
+func runUserPromote(cli *CLI, args []string) error {
+	flags := cli.flagSet("user promote")
+	login := flags.String("user", "", "username or email (required)")
+	role := flags.String("role", users.RoleAdmin, "user, moderator or admin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	db := cli.OpenDB()
+	defer db.Close()
+
+	userModel, err := findUser(*login)
+	if err != nil {
+		return err
+	}
+	if err := userModel.SetRole(*role); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.Stdout, "user %s is now %s\n", userModel.Username, userModel.Role)
+	return nil
+}
+
+func runUserResetPassword(cli *CLI, args []string) error {
+	flags := cli.flagSet("user reset-password")
+	login := flags.String("user", "", "username or email (required)")
+	password := flags.String("password", "", "new password, read from stdin when omitted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	pass, err := cli.password(*password)
+	if err != nil {
+		return err
+	}
+	db := cli.OpenDB()
+	defer db.Close()
+
+	userModel, err := findUser(*login)
+	if err != nil {
+		return err
+	}
+	if err := userModel.ResetPassword(pass); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.Stdout, "password of %s reset\n", userModel.Username)
+	return nil
+}
+
+func runTokenIssue(cli *CLI, args []string) error {
+	flags := cli.flagSet("token issue")
+	login := flags.String("user", "", "username or email (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	db := cli.OpenDB()
+	defer db.Close()
+
+	userModel, err := findUser(*login)
+	if err != nil {
+		return err
+	}
+	// just the token, so it can be captured: TOKEN=$(realworld-server token issue --user jake)
+	fmt.Fprintln(cli.Stdout, common.GenToken(userModel.ID))
+	return nil
+}
+
+func findUser(login string) (users.UserModel, error) {
+	if login == "" {
+		return users.UserModel{}, errors.New("--user is required")
+	}
+	userModel, err := users.FindUserByLogin(login)
+	if gorm.IsRecordNotFoundError(err) {
+		return userModel, fmt.Errorf("no user with username or email %q", login)
+	}
+	return userModel, err
+}
+
+// Validation and constraint errors read as "field: message", like the API reports them.
+func describeUserError(err error) error {
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		return fieldErrors(common.NewValidatorError(validationErrors))
+	}
+	appErr := common.NewDatabaseError(err)
+	if appErr.Code == common.ErrorCodeConflict {
+		return fieldErrors(appErr.CommonError())
+	}
+	return err
+}
+
+func fieldErrors(commonError common.CommonError) error {
+	var lines []string
+	for field, message := range commonError.Errors {
+		lines = append(lines, fmt.Sprintf("%s: %v", field, message))
+	}
+	sort.Strings(lines)
+	return errors.New(strings.Join(lines, "\n"))
+}
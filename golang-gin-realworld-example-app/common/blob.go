@@ -0,0 +1,180 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Returned by BlobStore.Get for a key that was never stored or was deleted.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Where uploaded files live. Keys are slash separated paths such as "avatars/2024/05/3f9a….png",
+// made of lowercase letters, digits, '.', '_', '-' and '/' only, see ValidBlobKey.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type BlobInfo struct {
+	ContentType string
+	Size        int64
+}
+
+var blobKeyRegexp = regexp.MustCompile(`^[a-z0-9_-]+(/[a-z0-9_-]+)*\.[a-z0-9]+$`)
+
+// Whether key is one a BlobStore accepts, so a key taken from a URL cannot escape the store.
+func ValidBlobKey(key string) bool {
+	return len(key) <= 255 && blobKeyRegexp.MatchString(key)
+}
+
+// Keep blobs as files under Dir, the content type is given by the extension of the key.
+type LocalBlobStore struct {
+	Dir string
+}
+
+func NewLocalBlobStore(dir string) *LocalBlobStore {
+	return &LocalBlobStore{Dir: dir}
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !ValidBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// The file is written next to its final name and renamed, readers never see half of it.
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, BlobInfo{}, err
+	}
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return file, BlobInfo{ContentType: contentType, Size: stat.Size()}, nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Where uploads are stored and how they are served, read from the environment.
+//
+//	UPLOAD_STORE=local|s3  UPLOAD_DIR=./data/uploads  UPLOAD_PUBLIC_URL=https://cdn.example.com
+//	UPLOAD_MAX_SIZE=5242880
+//	S3_ENDPOINT=https://s3.eu-west-1.amazonaws.com  S3_REGION=eu-west-1  S3_BUCKET=realworld
+//	S3_ACCESS_KEY_ID=...  S3_SECRET_ACCESS_KEY=...
+//
+// Without UPLOAD_PUBLIC_URL files are served by the API itself under /api/uploads.
+type UploadConfig struct {
+	Store     string
+	Dir       string
+	PublicURL string
+	MaxSize   int64
+	S3        S3Config
+}
+
+// Uploads larger than this are refused when UPLOAD_MAX_SIZE is not set.
+const DefaultUploadMaxSize = 5 << 20
+
+func UploadConfigFromEnv() (UploadConfig, error) {
+	config := UploadConfig{
+		Store:     strings.ToLower(os.Getenv("UPLOAD_STORE")),
+		Dir:       os.Getenv("UPLOAD_DIR"),
+		PublicURL: strings.TrimSuffix(os.Getenv("UPLOAD_PUBLIC_URL"), "/"),
+		MaxSize:   DefaultUploadMaxSize,
+		S3: S3Config{
+			Endpoint:        strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		},
+	}
+	if config.Store == "" {
+		config.Store = "local"
+	}
+	if config.Dir == "" {
+		config.Dir = "./data/uploads"
+	}
+	if config.S3.Region == "" {
+		config.S3.Region = "us-east-1"
+	}
+	if value := os.Getenv("UPLOAD_MAX_SIZE"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return config, fmt.Errorf("UPLOAD_MAX_SIZE %q: must be a positive number of bytes", value)
+		}
+		config.MaxSize = n
+	}
+	return config, nil
+}
+
+// The store the config names.
+func (config UploadConfig) BlobStore() (BlobStore, error) {
+	switch config.Store {
+	case "local":
+		return NewLocalBlobStore(config.Dir), nil
+	case "s3":
+		if config.S3.Endpoint == "" || config.S3.Bucket == "" {
+			return nil, errors.New("UPLOAD_STORE=s3 needs S3_ENDPOINT and S3_BUCKET")
+		}
+		return NewS3BlobStore(config.S3), nil
+	default:
+		return nil, fmt.Errorf("unknown UPLOAD_STORE %q, use local or s3", config.Store)
+	}
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"container/list"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache keeps values of hot reads for a while. Values are shared between requests, so callers
+// must treat what Get returns as read-only.
+type Cache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{}, ttl time.Duration)
+	Delete(keys ...string)
+	DeletePrefix(prefix string)
+}
+
+// The cache of the application, see GetCache.
+var AppCache Cache = NewLRUCache(DefaultCacheSize)
+
+// Entries kept when CACHE_SIZE is not set.
+const DefaultCacheSize = 10000
+
+// Use this function to get the cache, it never returns nil.
+//
+//	if value, ok := common.GetCache().Get("tags"); ok { ... }
+func GetCache() Cache {
+	return AppCache
+}
+
+// Replace the cache with one holding up to CACHE_SIZE entries, 0 disables it.
+func InitCache() Cache {
+	size := DefaultCacheSize
+	if value := os.Getenv("CACHE_SIZE"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			size = n
+		} else {
+			Logger.Warn("config: invalid CACHE_SIZE, using the default", "value", value, "default", size)
+		}
+	}
+	if size == 0 {
+		DisableCache()
+	} else {
+		AppCache = NewLRUCache(size)
+	}
+	return AppCache
+}
+
+// Turn the cache off, every read goes to the database. TestDBInit calls it so test cases
+// never see entries of a database that was deleted.
+func DisableCache() {
+	AppCache = NoopCache{}
+}
+
+// A cache that keeps nothing.
+type NoopCache struct{}
+
+func (NoopCache) Get(key string) (interface{}, bool)                   { return nil, false }
+func (NoopCache) Set(key string, value interface{}, ttl time.Duration) {}
+func (NoopCache) Delete(keys ...string)                                {}
+func (NoopCache) DeletePrefix(prefix string)                           {}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// An in-process cache of at most capacity entries, the least recently used is evicted first.
+// Expired entries are dropped when they are read.
+type LRUCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+	now      func() time.Time
+}
+
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		now:      time.Now,
+	}
+}
+
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		cacheRequestsTotal.WithLabelValues(cacheName(key), "miss").Inc()
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		cacheRequestsTotal.WithLabelValues(cacheName(key), "miss").Inc()
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	cacheRequestsTotal.WithLabelValues(cacheName(key), "hit").Inc()
+	return entry.value, true
+}
+
+func (c *LRUCache) Set(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRUCache) Delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+		}
+	}
+}
+
+// Drop every key starting with prefix, e.g. "article:" after a change that touches many articles.
+func (c *LRUCache) DeletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRUCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry).key)
+}
+
+// Keys are "<name>:<id>", the name labels the hit and miss counts.
+func cacheName(key string) string {
+	name, _, _ := strings.Cut(key, ":")
+	return name
+}
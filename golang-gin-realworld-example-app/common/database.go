@@ -1,7 +1,6 @@
 package common
 
 import (
-	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"os"
@@ -17,7 +16,7 @@ var DB *gorm.DB
 func Init() *gorm.DB {
 	db, err := gorm.Open("sqlite3", "./../gorm.db")
 	if err != nil {
-		fmt.Println("db err: (Init) ", err)
+		Logger.Error("db err: (Init)", "error", err)
 	}
 	db.DB().SetMaxIdleConns(10)
 	//db.LogMode(true)
@@ -29,11 +28,12 @@ func Init() *gorm.DB {
 func TestDBInit() *gorm.DB {
 	test_db, err := gorm.Open("sqlite3", "./../gorm_test.db")
 	if err != nil {
-		fmt.Println("db err: (TestDBInit) ", err)
+		Logger.Error("db err: (TestDBInit)", "error", err)
 	}
 	test_db.DB().SetMaxIdleConns(3)
 	test_db.LogMode(true)
 	DB = test_db
+	DisableCache()
 	return DB
 }
 
@@ -48,3 +48,57 @@ func TestDBFree(test_db *gorm.DB) error {
 func GetDB() *gorm.DB {
 	return DB
 }
+
+// Transaction is the unit of work for multi-step writes: fn receives the transaction handle
+// and every write it makes is committed together or not at all.
+// An error returned by fn (or a panic) rolls the transaction back, otherwise the error of
+// Commit itself is returned so a failed commit is never swallowed.
+//
+//	err := common.Transaction(func(tx *gorm.DB) error {
+//		return tx.Save(&model).Error
+//	})
+func Transaction(fn func(tx *gorm.DB) error) (err error) {
+	return TransactionOn(GetDB(), fn)
+}
+
+// Same as Transaction on a given handle, e.g. one carrying the request context.
+func TransactionOn(db *gorm.DB, fn func(tx *gorm.DB) error) (err error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	var afterCommit []func()
+	tx = tx.Set(afterCommitKey, &afterCommit)
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return err
+	}
+	for _, f := range afterCommit {
+		f()
+	}
+	return nil
+}
+
+const afterCommitKey = "common:after_commit"
+
+// Run f once the transaction of tx has committed, and never if it rolls back: the place to
+// publish what the transaction did. Outside of Transaction f runs right away.
+//
+//	common.AfterCommit(tx, func() { common.GetHub().Publish(topic, "comment", payload) })
+func AfterCommit(tx *gorm.DB, f func()) {
+	if hooks, ok := tx.Get(afterCommitKey); ok {
+		list := hooks.(*[]func())
+		*list = append(*list, f)
+		return
+	}
+	f()
+}
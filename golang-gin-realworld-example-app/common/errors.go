@@ -0,0 +1,230 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+)
+
+// Stable, machine-readable error codes. Clients should branch on these instead of on messages,
+// which are meant for humans and may change.
+type ErrorCode string
+
+const (
+	ErrorCodeValidation         ErrorCode = "validation_failed"
+	ErrorCodeMalformedRequest   ErrorCode = "malformed_request"
+	ErrorCodeUnauthorized       ErrorCode = "unauthorized"
+	ErrorCodeInvalidCredentials ErrorCode = "invalid_credentials"
+	ErrorCodeForbidden          ErrorCode = "forbidden"
+	ErrorCodeNotFound           ErrorCode = "not_found"
+	ErrorCodeConflict           ErrorCode = "conflict"
+	ErrorCodeRateLimited        ErrorCode = "rate_limited"
+	ErrorCodePreconditionFailed ErrorCode = "precondition_failed"
+	ErrorCodePayloadTooLarge    ErrorCode = "payload_too_large"
+	ErrorCodeUnsupportedMedia   ErrorCode = "unsupported_media_type"
+	ErrorCodeCommentsDisabled   ErrorCode = "comments_disabled"
+	ErrorCodeCommentsLocked     ErrorCode = "comments_locked"
+	ErrorCodeCommentsRestricted ErrorCode = "comments_restricted"
+	ErrorCodeDatabase           ErrorCode = "database_error"
+	ErrorCodeInternal           ErrorCode = "internal_error"
+)
+
+// The media type of RFC 7807 responses, clients opt in by sending it in the Accept header.
+const ProblemJSONContentType = "application/problem+json"
+
+// Prefix of the "type" member of problem responses, the error code is appended to it.
+const ProblemTypePrefix = "urn:realworld:problem:"
+
+// AppError is the typed error every handler should abort with.
+// Errors keeps the key/message pairs of the classic {"errors":{...}} body so the default
+// response shape does not change for existing clients.
+//
+//	common.AbortWithError(c, common.NewNotFoundError("profile", errors.New("Invalid username")))
+type AppError struct {
+	Status int
+	Code   ErrorCode
+	Errors map[string]interface{}
+	Err    error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return string(e.Code)
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// The classic response body: {"errors":{"key":"message"}}
+func (e *AppError) CommonError() CommonError {
+	return CommonError{Errors: e.Errors}
+}
+
+// RFC 7807 problem details, with our error code and the per-field errors as extension members.
+type ProblemDetails struct {
+	Type     string                 `json:"type"`
+	Title    string                 `json:"title"`
+	Status   int                    `json:"status"`
+	Detail   string                 `json:"detail,omitempty"`
+	Instance string                 `json:"instance,omitempty"`
+	Code     ErrorCode              `json:"code"`
+	Errors   map[string]interface{} `json:"errors,omitempty"`
+}
+
+func (e *AppError) ProblemDetails(instance string) ProblemDetails {
+	detail := e.Error()
+	if e.Code == ErrorCodeValidation {
+		// the raw validator message names Go structs, the per-field errors say it better
+		detail = "One or more fields are invalid"
+	}
+	return ProblemDetails{
+		Type:     ProblemTypePrefix + string(e.Code),
+		Title:    http.StatusText(e.Status),
+		Status:   e.Status,
+		Detail:   detail,
+		Instance: instance,
+		Code:     e.Code,
+		Errors:   e.Errors,
+	}
+}
+
+// Build an AppError whose classic body is {"errors":{key: err}}
+func NewAppError(status int, code ErrorCode, key string, err error) *AppError {
+	return &AppError{
+		Status: status,
+		Code:   code,
+		Errors: NewError(key, err).Errors,
+		Err:    err,
+	}
+}
+
+func NewNotFoundError(key string, err error) *AppError {
+	return NewAppError(http.StatusNotFound, ErrorCodeNotFound, key, err)
+}
+
+func NewUnauthorizedError(key string, err error) *AppError {
+	return NewAppError(http.StatusUnauthorized, ErrorCodeUnauthorized, key, err)
+}
+
+func NewForbiddenError(key string, err error) *AppError {
+	return NewAppError(http.StatusForbidden, ErrorCodeForbidden, key, err)
+}
+
+// The resource changed since the client read it. currentVersion is reported next to the message
+// so the client can reload and reapply its edit.
+func NewPreconditionFailedError(key string, err error, currentVersion uint) *AppError {
+	appErr := NewAppError(http.StatusPreconditionFailed, ErrorCodePreconditionFailed, key, err)
+	appErr.Errors["currentVersion"] = currentVersion
+	return appErr
+}
+
+// Wrap the error returned by Bind: validation failures become 422 with one entry per field,
+// a body that could not be decoded at all becomes 400.
+func NewBindError(err error) *AppError {
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		return &AppError{
+			Status: http.StatusUnprocessableEntity,
+			Code:   ErrorCodeValidation,
+			Errors: NewValidatorError(validationErrors).Errors,
+			Err:    err,
+		}
+	}
+	return NewAppError(http.StatusBadRequest, ErrorCodeMalformedRequest, "body", err)
+}
+
+// sqlite: "UNIQUE constraint failed: user_models.email"
+var sqliteUniqueViolation = regexp.MustCompile(`UNIQUE constraint failed: \w+\.(\w+)`)
+
+// Map an error returned by gorm to the status the API reports for it:
+// RecordNotFound is 404, a unique constraint violation is 409 keyed by the offending column,
+// anything else stays the 422 {"errors":{"database": ...}} it always was.
+func NewDatabaseError(err error) *AppError {
+	if gorm.IsRecordNotFoundError(err) {
+		return NewNotFoundError("database", err)
+	}
+	if key, ok := uniqueViolationKey(err); ok {
+		return &AppError{
+			Status: http.StatusConflict,
+			Code:   ErrorCodeConflict,
+			Errors: map[string]interface{}{key: "has already been taken"},
+			Err:    err,
+		}
+	}
+	return NewAppError(http.StatusUnprocessableEntity, ErrorCodeDatabase, "database", err)
+}
+
+func uniqueViolationKey(err error) (string, bool) {
+	msg := err.Error()
+	if match := sqliteUniqueViolation.FindStringSubmatch(msg); match != nil {
+		return match[1], true
+	}
+	// postgres and mysql do not name the column in the message itself
+	if strings.Contains(msg, "duplicate key value violates unique constraint") || strings.Contains(msg, "Duplicate entry") {
+		return "database", true
+	}
+	return "", false
+}
+
+// Anything that is not already an AppError is reported as an opaque 500.
+func ToAppError(err error) *AppError {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return NewAppError(http.StatusInternalServerError, ErrorCodeInternal, "server", errors.New("Internal server error"))
+}
+
+func wantsProblemJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), ProblemJSONContentType)
+}
+
+// Write err as the response, in the classic shape or as problem+json if the client asked for it.
+// Validation messages are translated to the language of the Accept-Language header.
+func RenderError(c *gin.Context, err error) {
+	appErr := ToAppError(err)
+	var validationErrors validator.ValidationErrors
+	if appErr.Code == ErrorCodeValidation && errors.As(appErr.Err, &validationErrors) {
+		localized := *appErr
+		localized.Errors = TranslateValidatorError(validationErrors, RequestTranslator(c)).Errors
+		appErr = &localized
+	}
+	if wantsProblemJSON(c) {
+		c.Header("Content-Type", ProblemJSONContentType)
+		c.JSON(appErr.Status, appErr.ProblemDetails(c.Request.URL.Path))
+		return
+	}
+	c.JSON(appErr.Status, appErr.CommonError())
+}
+
+// Record err on the context, render it and stop the handler chain.
+// Use it instead of c.AbortWithError, which only sends a status with an empty body.
+//
+//	if err != nil { common.AbortWithError(c, common.NewDatabaseError(err)); return }
+func AbortWithError(c *gin.Context, err error) {
+	c.Error(err)
+	RenderError(c, err)
+	c.Abort()
+}
+
+// ErrorHandler renders the last error attached with c.Error when the handler chain finished
+// without writing a response, so every failure leaves with a body in the same format.
+//
+//	r.Use(common.ErrorHandler())
+func ErrorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		RenderError(c, c.Errors.Last().Err)
+	}
+}
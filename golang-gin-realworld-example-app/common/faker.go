@@ -0,0 +1,136 @@
+package common
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Faker makes up plausible names and text for seed data. Everything it returns derives from
+// its seed, so the same seed always produces the same data set.
+//
+//	faker := common.NewFaker(42)
+//	title := faker.Title()
+type Faker struct {
+	rng *rand.Rand
+}
+
+func NewFaker(seed int64) *Faker {
+	return &Faker{rng: rand.New(rand.NewSource(seed))}
+}
+
+var fakerFirstNames = []string{
+	"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy",
+	"mallory", "niaj", "olivia", "peggy", "rupert", "sybil", "trent", "victor", "walter", "yusuf",
+	"amara", "bao", "chen", "dario", "elif", "farah", "goran", "hana", "ines", "jonas",
+}
+
+var fakerLastNames = []string{
+	"smith", "garcia", "mueller", "rossi", "tanaka", "kowalski", "okafor", "novak", "silva", "larsen",
+	"dubois", "haddad", "ivanova", "kim", "nguyen", "oconnor", "petrov", "quispe", "reyes", "schmidt",
+}
+
+var fakerTopics = []string{
+	"goroutines", "channels", "interfaces", "generics", "testing", "profiling", "databases", "caching",
+	"migrations", "observability", "containers", "deployments", "security", "accessibility", "design systems",
+	"state management", "error handling", "code review", "pair programming", "technical debt",
+}
+
+var fakerTitleTemplates = []string{
+	"A gentle introduction to %s",
+	"What I learned about %s the hard way",
+	"%s in practice",
+	"Rethinking %s",
+	"Ten mistakes with %s",
+	"Why %s matters more than you think",
+	"%s for the busy developer",
+	"Notes on %s",
+	"The case against %s",
+	"Scaling %s",
+}
+
+var fakerWords = strings.Fields(`the a of to and in is that for it with as on be at by this
+	we you our code team system service request user data time build test release design change
+	simple small fast slow clear better worse often rarely always never usually really quite
+	write read ship measure learn refactor deploy review debug explain choose avoid prefer keep
+	problem solution tradeoff pattern boundary contract latency throughput failure recovery
+	because although while when after before until unless however instead`)
+
+// Seed tags: common enough that several articles share each, so filtering by tag is worth testing.
+var FakerTags = []string{
+	"golang", "javascript", "react", "databases", "devops", "testing", "career", "design",
+	"security", "performance", "c++", "node.js", "machine learning", "open source", "tutorial",
+}
+
+func (f *Faker) Intn(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return f.rng.Intn(n)
+}
+
+// A random int in [min, max].
+func (f *Faker) Between(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + f.rng.Intn(max-min+1)
+}
+
+func (f *Faker) Pick(values []string) string {
+	return values[f.rng.Intn(len(values))]
+}
+
+// k distinct indexes of [0, n), in random order.
+func (f *Faker) Sample(n, k int) []int {
+	if k > n {
+		k = n
+	}
+	return f.rng.Perm(n)[:k]
+}
+
+// A username valid for the API, unique for every i: "grace_tanaka_12"
+func (f *Faker) Username(i int) string {
+	return f.Pick(fakerFirstNames) + "_" + f.Pick(fakerLastNames) + "_" + strconv.Itoa(i)
+}
+
+func (f *Faker) Title() string {
+	topic := f.Pick(fakerTopics)
+	title := strings.Replace(f.Pick(fakerTitleTemplates), "%s", topic, 1)
+	return strings.ToUpper(title[:1]) + title[1:]
+}
+
+func (f *Faker) Sentence() string {
+	words := make([]string, f.Between(6, 14))
+	for i := range words {
+		words[i] = f.Pick(fakerWords)
+	}
+	sentence := strings.Join(words, " ")
+	return strings.ToUpper(sentence[:1]) + sentence[1:] + "."
+}
+
+func (f *Faker) Paragraph() string {
+	sentences := make([]string, f.Between(2, 5))
+	for i := range sentences {
+		sentences[i] = f.Sentence()
+	}
+	return strings.Join(sentences, " ")
+}
+
+// n paragraphs separated by blank lines.
+func (f *Faker) Paragraphs(n int) string {
+	paragraphs := make([]string, n)
+	for i := range paragraphs {
+		paragraphs[i] = f.Paragraph()
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// A moment within the last maxAge, for spreading creation dates.
+func (f *Faker) Past(now time.Time, maxAge time.Duration) time.Time {
+	if maxAge <= 0 {
+		return now
+	}
+	return now.Add(-time.Duration(f.rng.Int63n(int64(maxAge))))
+}
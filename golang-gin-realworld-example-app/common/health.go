@@ -0,0 +1,86 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// How long /readyz waits for all of its checks before reporting the instance as not ready.
+const ReadinessTimeout = 2 * time.Second
+
+// A named dependency /readyz verifies, it returns nil when the dependency is usable.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// The liveness probe: the process is up and serving, nothing else is checked
+// so a slow database never gets the instance restarted.
+//
+//	r.GET("/healthz", common.HealthHandler())
+func HealthHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// The readiness probe: 200 when every check passes, 503 with the failing ones otherwise.
+//
+//	r.GET("/readyz", common.ReadinessHandler(common.DatabaseCheck(db), common.MigrationCheck(db, models...)))
+func ReadinessHandler(checks ...ReadinessCheck) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), ReadinessTimeout)
+		defer cancel()
+
+		status := http.StatusOK
+		results := gin.H{}
+		for _, check := range checks {
+			if err := check.Check(ctx); err != nil {
+				status = http.StatusServiceUnavailable
+				results[check.Name] = err.Error()
+				continue
+			}
+			results[check.Name] = "ok"
+		}
+		state := "ok"
+		if status != http.StatusOK {
+			state = "unavailable"
+		}
+		c.JSON(status, gin.H{"status": state, "checks": results})
+	}
+}
+
+// Ping the database.
+func DatabaseCheck(db *gorm.DB) ReadinessCheck {
+	return ReadinessCheck{Name: "database", Check: func(ctx context.Context) error {
+		return db.DB().PingContext(ctx)
+	}}
+}
+
+// Verify every table and column of models exists, i.e. the instance is not running against a
+// database that has not been migrated yet.
+func MigrationCheck(db *gorm.DB, models ...interface{}) ReadinessCheck {
+	return ReadinessCheck{Name: "migrations", Check: func(ctx context.Context) error {
+		for _, model := range models {
+			scope := db.NewScope(model)
+			table := scope.TableName()
+			if !scope.Dialect().HasTable(table) {
+				return fmt.Errorf("table %s is missing", table)
+			}
+			for _, field := range scope.GetModelStruct().StructFields {
+				if !field.IsNormal || field.IsIgnored {
+					continue
+				}
+				if !scope.Dialect().HasColumn(table, field.DBName) {
+					return fmt.Errorf("column %s.%s is missing", table, field.DBName)
+				}
+			}
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache-Control of responses that are the same for everyone: caches may keep them but must
+// revalidate, which costs a 304 at most.
+const PublicCacheControl = "public, max-age=0, must-revalidate"
+
+// Cache-Control of responses computed for the caller (favorited, following): only the client
+// itself may keep them, and must revalidate too.
+const PrivateCacheControl = "private, no-cache"
+
+// A strong ETag of a response body.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// CacheableJSON renders obj like c.JSON, with an ETag computed from the body and, when
+// lastModified is known, a Last-Modified header. A GET whose If-None-Match or If-Modified-Since
+// shows the client already has this version gets an empty 304 instead.
+// Responses vary with Authorization because favorited and following depend on the caller.
+//
+//	common.CacheableJSON(c, http.StatusOK, gin.H{"article": serializer.Response()}, articleModel.UpdatedAt)
+func CacheableJSON(c *gin.Context, status int, obj interface{}, lastModified time.Time) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	etag := ETag(body)
+
+	c.Header("ETag", etag)
+	c.Header("Vary", "Authorization")
+	if c.GetUint("my_user_id") != 0 {
+		c.Header("Cache-Control", PrivateCacheControl)
+	} else {
+		c.Header("Cache-Control", PublicCacheControl)
+	}
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if status == http.StatusOK && notModified(c.Request, etag, lastModified) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Data(status, "application/json; charset=utf-8", body)
+}
+
+// The conditional GET rules of RFC 9110: If-None-Match wins when present, and compares weakly.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return ETagMatches(inm, etag, false)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ims)
+		// the header only has a precision of seconds
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// Whether an If-Match or If-None-Match header value lists etag. The strong comparison of
+// If-Match never matches a weak (W/) tag, the weak one of If-None-Match ignores the prefix.
+func ETagMatches(header, etag string, strong bool) bool {
+	header = strings.TrimSpace(header)
+	if strong && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What the hub publishes on, one topic per thing a client can follow.
+func TopicArticleComments(articleID uint) string { return fmt.Sprintf("comments:%d", articleID) }
+func TopicNotifications(userID uint) string      { return fmt.Sprintf("notifications:%d", userID) }
+func TopicFeed(authorID uint) string             { return fmt.Sprintf("feed:%d", authorID) }
+
+// An event as sent to stream clients: Data is the JSON of the payload.
+type HubEvent struct {
+	ID    string
+	Topic string
+	Type  string
+	Data  []byte
+	seq   uint64
+}
+
+// How many events the hub keeps for clients resuming after a disconnection.
+const DefaultHubHistory = 1000
+
+// How far a subscriber may fall behind before it is dropped.
+const subscriberBuffer = 64
+
+// Hub is an in-process publish/subscribe of events, behind /api/stream. Publish after the
+// transaction commits (see AfterCommit), subscribers only get the topics they asked for.
+//
+// Event ids are "<start of the hub>-<sequence>" and the last events are kept, so a client that
+// reconnects with the id of the last event it got receives what it missed. A subscriber that
+// falls behind is dropped rather than slowing down publishers, and resumes when it reconnects.
+// The hub only reaches clients connected to this process.
+type Hub struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	history     []HubEvent
+	historySize int
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+// A subscriber of a Hub. Events is closed when the subscriber is dropped or the hub is closed.
+type Subscription struct {
+	Events <-chan HubEvent
+	events chan HubEvent
+	topics map[string]bool
+}
+
+var AppHub = NewHub(DefaultHubHistory)
+
+func GetHub() *Hub {
+	return AppHub
+}
+
+func NewHub(historySize int) *Hub {
+	return &Hub{
+		epoch:       strconv.FormatInt(time.Now().UnixMilli(), 36),
+		historySize: historySize,
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Send payload, as JSON, to the subscribers of topic.
+func (h *Hub) Publish(topic, eventType string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		Logger.Error("hub: cannot encode event", "topic", topic, "type", eventType, "error", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.seq++
+	event := HubEvent{ID: h.epoch + "-" + strconv.FormatUint(h.seq, 10), Topic: topic, Type: eventType, Data: data, seq: h.seq}
+	if h.historySize > 0 {
+		if len(h.history) == h.historySize {
+			copy(h.history, h.history[1:])
+			h.history = h.history[:len(h.history)-1]
+		}
+		h.history = append(h.history, event)
+	}
+	for sub := range h.subscribers {
+		if !sub.topics[topic] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			h.remove(sub)
+			hubSubscribersDropped.Inc()
+		}
+	}
+}
+
+// Subscribe to topics. lastEventID is the id of the last event the client got, if any: the kept
+// events after it are returned, to be sent before the new ones. resumed is false when the client
+// may have missed events anyway: the id comes from a previous process or is older than the history.
+func (h *Hub) Subscribe(topics []string, lastEventID string) (sub *Subscription, missed []HubEvent, resumed bool) {
+	events := make(chan HubEvent, subscriberBuffer)
+	sub = &Subscription{Events: events, events: events, topics: map[string]bool{}}
+	for _, topic := range topics {
+		sub.topics[topic] = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(events)
+		return sub, nil, false
+	}
+	h.subscribers[sub] = struct{}{}
+	hubSubscribers.Inc()
+	if lastEventID == "" {
+		return sub, nil, true
+	}
+	epoch, seqString, _ := strings.Cut(lastEventID, "-")
+	seq, err := strconv.ParseUint(seqString, 10, 64)
+	if err != nil || epoch != h.epoch || seq > h.seq {
+		return sub, nil, false
+	}
+	// the event right after seq must still be kept
+	if seq < h.seq && (len(h.history) == 0 || h.history[0].seq > seq+1) {
+		return sub, nil, false
+	}
+	for _, event := range h.history {
+		if event.seq > seq && sub.topics[event.Topic] {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed, true
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	if _, ok := h.subscribers[sub]; !ok {
+		return
+	}
+	delete(h.subscribers, sub)
+	close(sub.events)
+	hubSubscribers.Dec()
+}
+
+// Close every subscription, which ends the streams, and ignore what is published from then on.
+// The server calls it when it starts shutting down, streams would otherwise keep it from draining.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		h.remove(sub)
+	}
+}
@@ -0,0 +1,198 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The header a request id is read from and echoed back in.
+const RequestIDHeader = "X-Request-ID"
+
+// What is written instead of a secret.
+const RedactedValue = "[REDACTED]"
+
+// Keys of the gin context, next to "my_user_id" and "my_user_model" set by the users module.
+const (
+	requestIDKey     = "request_id"
+	loggerKey        = "logger"
+	requestLoggerKey = "request_logger"
+)
+
+// The application logger, JSON lines on stderr until InitLogger is called.
+var Logger = NewLogger(os.Stderr, os.Getenv("LOG_LEVEL"))
+
+// Build a JSON logger writing to w. level is one of debug, info, warn or error, anything else means info.
+// Attributes that can carry a secret (authorization, password, token...) are always redacted.
+func NewLogger(w io.Writer, level string) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       ParseLogLevel(level),
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+// Replace Logger and the slog default with a logger writing to w.
+//
+//	common.InitLogger(os.Stdout, os.Getenv("LOG_LEVEL"))
+func InitLogger(w io.Writer, level string) *slog.Logger {
+	Logger = NewLogger(w, level)
+	slog.SetDefault(Logger)
+	return Logger
+}
+
+func ParseLogLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	switch key {
+	case "authorization", "cookie", "set-cookie", "token", "access_token":
+		return true
+	}
+	return strings.Contains(key, "password")
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, RedactedValue)
+	}
+	return a
+}
+
+// The query string with secret parameters such as access_token redacted, safe to log.
+func redactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return RedactedValue
+	}
+	for key := range values {
+		if isSensitiveKey(key) {
+			values[key] = []string{RedactedValue}
+		}
+	}
+	return values.Encode()
+}
+
+// A caller supplied request id is only trusted if it is short and made of safe characters.
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return RandString(32)
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestID accepts the X-Request-ID header of the caller or generates one, echoes it in the
+// response and puts a logger carrying it on the gin context, see LoggerFrom.
+//
+//	r.Use(common.RequestID())
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !requestIDRegexp.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		c.Set(requestIDKey, requestID)
+		c.Header(RequestIDHeader, requestID)
+
+		logger := Logger.With("request_id", requestID)
+		c.Set(requestLoggerKey, logger)
+		c.Set(loggerKey, logger)
+		c.Next()
+	}
+}
+
+// The request id assigned by the RequestID middleware, "" outside of it.
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// The logger of the current request, it carries the request id and, once authenticated, the user id.
+//
+//	common.LoggerFrom(c).Info("article created", "slug", articleModel.Slug)
+func LoggerFrom(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get(loggerKey); ok {
+		if logger, ok := logger.(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return Logger
+}
+
+// Attach the user id to the request logger, the users module calls it whenever it sets "my_user_id".
+// It is always derived from the request logger, so authenticating twice does not repeat the attribute.
+func SetLoggerUserID(c *gin.Context, userID uint) {
+	logger := Logger
+	if requestLogger, ok := c.Get(requestLoggerKey); ok {
+		if requestLogger, ok := requestLogger.(*slog.Logger); ok {
+			logger = requestLogger
+		}
+	}
+	if userID != 0 {
+		logger = logger.With("user_id", userID)
+	}
+	c.Set(loggerKey, logger)
+}
+
+// RequestLogger writes one structured line per request once it is served, in place of the
+// text logger of gin.Default(). Request headers are only added at debug level, redacted.
+//
+//	r.Use(common.RequestID(), common.RequestLogger())
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("bytes", c.Writer.Size()),
+		}
+		if query := redactQuery(c.Request.URL.RawQuery); query != "" {
+			attrs = append(attrs, slog.String("query", query))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.Any("errors", c.Errors.Errors()))
+		}
+
+		logger := LoggerFrom(c)
+		if logger.Enabled(c.Request.Context(), slog.LevelDebug) {
+			var headers []any
+			for name, values := range c.Request.Header {
+				headers = append(headers, slog.String(name, strings.Join(values, ", ")))
+			}
+			attrs = append(attrs, slog.Group("headers", headers...))
+		}
+
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
+		}
+		logger.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"bytes"
+	"html"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// The longest article body accepted, in characters. ARTICLE_BODY_MAX_LENGTH overrides it.
+var ArticleBodyMaxLength = 100000
+
+func init() {
+	if value := os.Getenv("ARTICLE_BODY_MAX_LENGTH"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			ArticleBodyMaxLength = n
+		}
+	}
+}
+
+// GitHub flavored Markdown: tables, strikethrough, autolinks and task lists.
+// Raw HTML in the source is left out by goldmark, it is not rendered unless asked to.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// What may remain of the rendered HTML: the elements and attributes of user generated content,
+// no scripts, styles, event handlers or javascript: URLs, and links get rel="nofollow".
+// The language class of fenced code blocks is kept for client side highlighting.
+// It runs after goldmark, so a bug of the renderer cannot let markup through either.
+var MarkdownPolicy = markdownPolicy()
+
+func markdownPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	return policy
+}
+
+// Render Markdown written by a user into HTML that is safe to put in a page as is.
+//
+//	bodyHtml, err := common.RenderMarkdown(articleModel.Body)
+func RenderMarkdown(source string) (string, error) {
+	var rendered bytes.Buffer
+	if err := markdown.Convert([]byte(source), &rendered); err != nil {
+		return "", err
+	}
+	return MarkdownPolicy.Sanitize(rendered.String()), nil
+}
+
+var stripAllPolicy = bluemonday.StrictPolicy()
+
+// The words a reader sees once Markdown is rendered, without markup and on a single line.
+//
+//	common.MarkdownText("# Hello\n\n*world*")  // "Hello world"
+func MarkdownText(source string) (string, error) {
+	var rendered bytes.Buffer
+	if err := markdown.Convert([]byte(source), &rendered); err != nil {
+		return "", err
+	}
+	text := html.UnescapeString(stripAllPolicy.Sanitize(rendered.String()))
+	return strings.Join(strings.Fields(text), " "), nil
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Every metric lives in this registry instead of the global one, so tests can build routers
+// and databases as often as they like.
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route template.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "realworld",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests, by route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "realworld",
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of gorm operations, by operation and table.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "table"})
+
+	cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "cache_requests_total",
+		Help:      "Reads of the application cache, by cache and result (hit or miss).",
+	}, []string{"cache", "result"})
+
+	hubSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "realworld",
+		Name:      "stream_subscribers",
+		Help:      "Clients connected to the event stream.",
+	})
+
+	hubSubscribersDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "stream_subscribers_dropped_total",
+		Help:      "Stream clients disconnected for falling behind.",
+	})
+)
+
+// Business counters, incremented by the users and articles modules.
+var (
+	UserRegistrationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "user_registrations_total",
+		Help:      "Users registered.",
+	})
+
+	UserLoginsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "user_logins_total",
+		Help:      "Login attempts, by result (success or failure).",
+	}, []string{"result"})
+
+	ArticlesCreatedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "articles_created_total",
+		Help:      "Articles created.",
+	})
+
+	ArticleFavoritesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "article_favorites_total",
+		Help:      "Articles favorited.",
+	})
+
+	WebhookDeliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "webhook_delivery_attempts_total",
+		Help:      "Webhook delivery attempts, by result (success, retry, or failure when giving up).",
+	}, []string{"result"})
+
+	JobsProcessedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "jobs_processed_total",
+		Help:      "Background job runs, by type and result (success, retry or dead).",
+	}, []string{"type", "result"})
+
+	EventDeliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "realworld",
+		Name:      "event_deliveries_total",
+		Help:      "Domain events handed to subscribers, by subscriber and result (success or failure).",
+	}, []string{"subscriber", "result"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		dbQueryDuration,
+		cacheRequestsTotal,
+		hubSubscribers,
+		hubSubscribersDropped,
+		UserRegistrationsTotal,
+		UserLoginsTotal,
+		ArticlesCreatedTotal,
+		ArticleFavoritesTotal,
+		WebhookDeliveriesTotal,
+		JobsProcessedTotal,
+		EventDeliveriesTotal,
+	)
+	// export both results from the start so rate() works before the first failure
+	UserLoginsTotal.WithLabelValues("success")
+	UserLoginsTotal.WithLabelValues("failure")
+}
+
+// Metrics records the count and latency of every request, labeled by the route template
+// (/api/articles/:slug) rather than the path so the number of series stays bounded.
+//
+//	r.Use(common.Metrics())
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestsTotal.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// The handler of the /metrics endpoint, in the Prometheus text format.
+//
+//	r.GET("/metrics", common.MetricsHandler())
+func MetricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{}))
+}
+
+const metricsStartKey = "metrics:start_time"
+
+// Time every gorm operation through callbacks and export the connection pool stats of db.
+// Call it once after opening the database.
+//
+//	db := common.Init()
+//	common.RegisterDBMetrics(db)
+func RegisterDBMetrics(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:create").Register("metrics:before_create", startDBTimer)
+	callbacks.Create().After("gorm:create").Register("metrics:after_create", observeDBTimer("create"))
+	callbacks.Query().Before("gorm:query").Register("metrics:before_query", startDBTimer)
+	callbacks.Query().After("gorm:query").Register("metrics:after_query", observeDBTimer("query"))
+	callbacks.Update().Before("gorm:update").Register("metrics:before_update", startDBTimer)
+	callbacks.Update().After("gorm:update").Register("metrics:after_update", observeDBTimer("update"))
+	callbacks.Delete().Before("gorm:delete").Register("metrics:before_delete", startDBTimer)
+	callbacks.Delete().After("gorm:delete").Register("metrics:after_delete", observeDBTimer("delete"))
+	callbacks.RowQuery().Before("gorm:row_query").Register("metrics:before_row_query", startDBTimer)
+	callbacks.RowQuery().After("gorm:row_query").Register("metrics:after_row_query", observeDBTimer("row_query"))
+
+	err := MetricsRegistry.Register(collectors.NewDBStatsCollector(db.DB(), "main"))
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if err != nil && !errors.As(err, &alreadyRegistered) {
+		Logger.Error("metrics: cannot register db stats collector", "error", err)
+	}
+}
+
+func startDBTimer(scope *gorm.Scope) {
+	scope.Set(metricsStartKey, time.Now())
+}
+
+func observeDBTimer(operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		start, ok := scope.Get(metricsStartKey)
+		if !ok {
+			return
+		}
+		table := "unknown"
+		if scope.Value != nil {
+			table = scope.TableName()
+		}
+		dbQueryDuration.WithLabelValues(operation, table).Observe(time.Since(start.(time.Time)).Seconds())
+	}
+}
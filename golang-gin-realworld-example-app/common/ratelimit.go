@@ -0,0 +1,274 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// A token bucket: Burst requests can be made at once, then tokens come back at Burst per Period.
+//
+//	RateLimitPolicy{Name: "auth", Burst: 10, Period: time.Minute}  // 10 per minute
+type RateLimitPolicy struct {
+	Name   string
+	Burst  int
+	Period time.Duration
+}
+
+// Tokens refilled per second.
+func (p RateLimitPolicy) rate() float64 {
+	return float64(p.Burst) / p.Period.Seconds()
+}
+
+func (p RateLimitPolicy) String() string {
+	return fmt.Sprintf("%s=%d/%s", p.Name, p.Burst, p.Period)
+}
+
+// The policies applied when RATE_LIMITS does not override them:
+// "auth" guards registration and login per client IP, "write" the article and comment writes
+// per user, "api" everything under /api.
+var DefaultRateLimitPolicies = map[string]RateLimitPolicy{
+	"auth":  {Name: "auth", Burst: 10, Period: time.Minute},
+	"write": {Name: "write", Burst: 30, Period: time.Minute},
+	"api":   {Name: "api", Burst: 600, Period: time.Minute},
+}
+
+// Parse policies written as name=burst/period, comma separated. "off" as a value disables a policy.
+//
+//	auth=5/1m,write=100/1h,api=off
+func ParseRateLimitPolicies(value string) (map[string]RateLimitPolicy, error) {
+	policies := map[string]RateLimitPolicy{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("rate limit %q: expected name=burst/period", entry)
+		}
+		if spec == "off" {
+			policies[name] = RateLimitPolicy{Name: name}
+			continue
+		}
+		burst, period, ok := strings.Cut(spec, "/")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: expected name=burst/period", entry)
+		}
+		n, err := strconv.Atoi(burst)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("rate limit %q: burst must be a positive integer", entry)
+		}
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("rate limit %q: period must be a duration such as 1m", entry)
+		}
+		policies[name] = RateLimitPolicy{Name: name, Burst: n, Period: d}
+	}
+	return policies, nil
+}
+
+// Which store keeps the buckets and which policies apply, read from the environment.
+//
+//	RATE_LIMIT_STORE=memory|sql  RATE_LIMITS=auth=5/1m,write=100/1h  TRUSTED_PROXIES=10.0.0.0/8
+//
+// The memory store is per process, use sql when several instances share the database.
+// TrustedProxies are the addresses whose X-Forwarded-For is believed, none by default: anyone
+// else could send a new one with every request and get a fresh bucket each time.
+type RateLimitConfig struct {
+	Store          string
+	Policies       map[string]RateLimitPolicy
+	TrustedProxies []string
+}
+
+func RateLimitConfigFromEnv() (RateLimitConfig, error) {
+	config := RateLimitConfig{
+		Store:    strings.ToLower(os.Getenv("RATE_LIMIT_STORE")),
+		Policies: map[string]RateLimitPolicy{},
+	}
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			config.TrustedProxies = append(config.TrustedProxies, proxy)
+		}
+	}
+	for name, policy := range DefaultRateLimitPolicies {
+		config.Policies[name] = policy
+	}
+	overrides, err := ParseRateLimitPolicies(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		return config, err
+	}
+	for name, policy := range overrides {
+		config.Policies[name] = policy
+	}
+	return config, nil
+}
+
+// The outcome of taking a token.
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // until the next token, when not allowed
+	Reset      time.Time     // when the bucket is full again
+}
+
+// Where buckets live. Take must be atomic per key, concurrent requests may share one.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error)
+}
+
+// Refill a bucket holding tokens since last, then take one from it if there is one.
+func takeToken(tokens float64, last time.Time, policy RateLimitPolicy, now time.Time) (float64, RateLimitResult) {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(policy.Burst), tokens+elapsed*policy.rate())
+	}
+	result := RateLimitResult{}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / policy.rate() * float64(time.Second))
+	}
+	result.Remaining = int(tokens)
+	result.Reset = now.Add(time.Duration((float64(policy.Burst) - tokens) / policy.rate() * float64(time.Second)))
+	return tokens, result
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// The default store, buckets are kept in this process only and dropped once full again.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	takes   int
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.takes++
+	if s.takes%1000 == 0 {
+		// a full bucket is the same as no bucket
+		for k, bucket := range s.buckets {
+			if !now.Before(bucket.full) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(policy.Burst), last: now}
+		s.buckets[key] = bucket
+	}
+	tokens, result := takeToken(bucket.tokens, bucket.last, policy, now)
+	bucket.tokens, bucket.last, bucket.full = tokens, now, result.Reset
+	return result, nil
+}
+
+// A bucket of the sql store.
+type RateLimitBucket struct {
+	Key        string    `gorm:"primary_key;size:255"`
+	Tokens     float64   `gorm:"not null"`
+	RefilledAt time.Time `gorm:"not null"`
+	FullAt     time.Time `gorm:"index;not null"`
+}
+
+// Keep buckets in the database, so every instance sees the same counts.
+// The rate_limit_buckets table is created by the migrate command.
+type SQLRateLimitStore struct {
+	db    *gorm.DB
+	mu    sync.Mutex
+	takes int
+}
+
+func NewSQLRateLimitStore(db *gorm.DB) *SQLRateLimitStore {
+	return &SQLRateLimitStore{db: db}
+}
+
+func (s *SQLRateLimitStore) Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (result RateLimitResult, err error) {
+	db := s.db.Set(dbContextKey, ctx)
+	if s.db.Dialect().GetName() != "sqlite3" {
+		// sqlite serializes writers anyway and does not know FOR UPDATE
+		db = db.Set("gorm:query_option", "FOR UPDATE")
+	}
+	err = TransactionOn(db, func(tx *gorm.DB) error {
+		bucket := RateLimitBucket{Key: key, Tokens: float64(policy.Burst), RefilledAt: now}
+		if err := tx.Where(RateLimitBucket{Key: key}).First(&bucket).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		bucket.Tokens, result = takeToken(bucket.Tokens, bucket.RefilledAt, policy, now)
+		bucket.RefilledAt, bucket.FullAt = now, result.Reset
+		return tx.Save(&bucket).Error
+	})
+	if err != nil {
+		return result, err
+	}
+
+	s.mu.Lock()
+	s.takes++
+	sweep := s.takes%1000 == 0
+	s.mu.Unlock()
+	if sweep {
+		s.db.Where("full_at < ?", now).Delete(RateLimitBucket{})
+	}
+	return result, nil
+}
+
+// RateLimit takes a token of policy for every request, from the bucket of the authenticated user
+// ("my_user_id") or of the client IP for anonymous requests, and answers 429 once it is empty.
+// The X-RateLimit-* headers tell clients where they stand. If the store fails the request is let
+// through: an outage of the limiter should not become an outage of the API.
+//
+//	v1.Group("/users", common.RateLimit(store, policies["auth"]))
+func RateLimit(store RateLimitStore, policy RateLimitPolicy) gin.HandlerFunc {
+	if policy.Burst <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		key := policy.Name + ":ip:" + c.ClientIP()
+		if userID := c.GetUint("my_user_id"); userID != 0 {
+			key = policy.Name + ":user:" + strconv.FormatUint(uint64(userID), 10)
+		}
+		result, err := store.Take(c.Request.Context(), key, policy, time.Now())
+		if err != nil {
+			LoggerFrom(c).Error("rate limit: store failed, request let through", "policy", policy.Name, "error", err)
+			c.Next()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(policy.Burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(result.Reset.Unix(), 10))
+		c.Header("X-RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Burst, int(policy.Period.Seconds())))
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+			AbortWithError(c, NewRateLimitedError(policy))
+			return
+		}
+		c.Next()
+	}
+}
+
+func NewRateLimitedError(policy RateLimitPolicy) *AppError {
+	return NewAppError(http.StatusTooManyRequests, ErrorCodeRateLimited, "rate_limit",
+		fmt.Errorf("Too many %s requests, retry later", policy.Name))
+}
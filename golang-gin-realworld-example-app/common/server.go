@@ -0,0 +1,158 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts of the HTTP server, read from the environment by ServerConfigFromEnv.
+//
+//	PORT=8080  SERVER_READ_TIMEOUT=15s  SERVER_WRITE_TIMEOUT=30s  SERVER_IDLE_TIMEOUT=60s  SHUTDOWN_TIMEOUT=20s
+//
+// ShutdownTimeout bounds the whole shutdown: draining in-flight requests and running the hooks.
+type ServerConfig struct {
+	Addr            string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+}
+
+func ServerConfigFromEnv() ServerConfig {
+	addr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	return ServerConfig{
+		Addr:            addr,
+		ReadTimeout:     durationFromEnv("SERVER_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:    durationFromEnv("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:     durationFromEnv("SERVER_IDLE_TIMEOUT", 60*time.Second),
+		ShutdownTimeout: durationFromEnv("SHUTDOWN_TIMEOUT", 20*time.Second),
+	}
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		Logger.Warn("config: invalid duration, using the default", "key", key, "value", value, "default", fallback.String())
+		return fallback
+	}
+	return d
+}
+
+// Server is an http.Server that shuts down gracefully: once its context is done it stops
+// accepting connections, waits for in-flight requests and then runs the shutdown hooks
+// (background workers, the database...) in reverse order of registration, like defers.
+//
+//	server := common.NewServer(r, common.ServerConfigFromEnv())
+//	server.OnShutdown(func(ctx context.Context) error { return db.Close() })
+//	err := server.Run(ctx)
+type Server struct {
+	*http.Server
+	ShutdownTimeout time.Duration
+
+	mu       sync.Mutex
+	hooks    []func(context.Context) error
+	draining atomic.Bool
+}
+
+func NewServer(handler http.Handler, config ServerConfig) *Server {
+	return &Server{
+		Server: &http.Server{
+			Addr:         config.Addr,
+			Handler:      handler,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			IdleTimeout:  config.IdleTimeout,
+		},
+		ShutdownTimeout: config.ShutdownTimeout,
+	}
+}
+
+// Register a function to run once the server has drained.
+func (s *Server) OnShutdown(hook func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// A readiness check failing as soon as the shutdown starts, so load balancers stop routing to us
+// while the in-flight requests drain.
+func (s *Server) DrainingCheck() ReadinessCheck {
+	return ReadinessCheck{Name: "server", Check: func(ctx context.Context) error {
+		if s.draining.Load() {
+			return errors.New("shutting down")
+		}
+		return nil
+	}}
+}
+
+// Listen on Addr and serve until ctx is done, then shut down.
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve on listener until ctx is done, then shut down within ShutdownTimeout.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	served := make(chan error, 1)
+	go func() {
+		Logger.Info("server: listening", "addr", listener.Addr().String())
+		served <- s.Server.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		// the listener failed before we were asked to stop, still release what was registered
+		s.shutdown(context.Background())
+		return err
+	case <-ctx.Done():
+	}
+
+	Logger.Info("server: shutting down", "timeout", s.ShutdownTimeout.String())
+	s.draining.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	err := s.Server.Shutdown(shutdownCtx)
+	if err != nil {
+		Logger.Error("server: requests did not drain in time", "error", err)
+	}
+	if hookErr := s.shutdown(shutdownCtx); err == nil {
+		err = hookErr
+	}
+	if serveErr := <-served; !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+		err = serveErr
+	}
+	Logger.Info("server: stopped")
+	return err
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	hooks := s.hooks
+	s.hooks = nil
+	s.mu.Unlock()
+
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](ctx); err != nil {
+			Logger.Error("server: shutdown hook failed", "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
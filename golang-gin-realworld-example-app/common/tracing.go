@@ -0,0 +1,232 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The service name reported to the tracing backend.
+const TracingServiceName = "realworld-backend"
+
+const tracerName = "realworld-backend/common"
+
+// Where spans go, read from the environment by InitTracer.
+//
+//	OTEL_TRACES_EXPORTER=otlp    OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318
+//	OTEL_TRACES_EXPORTER=stdout
+//	OTEL_TRACES_EXPORTER=file    OTEL_TRACES_FILE=./traces.json
+//
+// Tracing is off (no-op spans, no overhead beyond propagation) unless one of them is set.
+type TracingConfig struct {
+	Exporter     string
+	OTLPEndpoint string
+	File         string
+}
+
+func TracingConfigFromEnv() TracingConfig {
+	return TracingConfig{
+		Exporter:     strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")),
+		OTLPEndpoint: os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		File:         os.Getenv("OTEL_TRACES_FILE"),
+	}
+}
+
+// Install the global tracer provider and the W3C trace-context propagator.
+// The returned function flushes pending spans and must be called on shutdown.
+//
+//	shutdown, err := common.InitTracer(common.TracingConfigFromEnv())
+//	defer shutdown(context.Background())
+func InitTracer(config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+	switch config.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var options []otlptracehttp.Option
+		if config.OTLPEndpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.OTLPEndpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		path := config.File
+		if path == "" {
+			path = "traces.json"
+		}
+		var file *os.File
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		closer = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q, use otlp, stdout, file or none", config.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(TracingServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// Tracing starts a server span per request, continuing the trace of the caller when it sent a
+// traceparent header, and puts its context on c.Request so GetRequestDB can parent the query spans.
+// The trace id is added to the request logger as well.
+//
+//	r.Use(common.RequestID(), common.Tracing())
+func Tracing() gin.HandlerFunc {
+	tracer := otel.Tracer(tracerName)
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		if span.SpanContext().IsValid() {
+			traceID := span.SpanContext().TraceID().String()
+			if requestLogger, ok := c.Get(requestLoggerKey); ok {
+				if requestLogger, ok := requestLogger.(*slog.Logger); ok {
+					c.Set(requestLoggerKey, requestLogger.With("trace_id", traceID))
+				}
+			}
+			SetLoggerUserID(c, c.GetUint("my_user_id"))
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, c.Errors.String())
+		}
+	}
+}
+
+// The key under which a gorm handle carries the context of the request that uses it.
+const dbContextKey = "otel:context"
+
+// A database handle carrying ctx, the queries made through it are traced as children of ctx.
+func GetDBContext(ctx context.Context) *gorm.DB {
+	return GetDB().Set(dbContextKey, ctx)
+}
+
+// The database handle handlers and serializers should use, see GetDBContext.
+//
+//	articleModel, err := findOneArticleTx(common.GetRequestDB(c), &ArticleModel{Slug: slug})
+func GetRequestDB(c *gin.Context) *gorm.DB {
+	if c.Request == nil {
+		return GetDB()
+	}
+	return GetDBContext(c.Request.Context())
+}
+
+const dbSpanKey = "otel:span"
+
+// Trace every gorm operation through callbacks. A span is parented to the context set with
+// GetDBContext, queries made through a plain GetDB() handle start their own trace.
+//
+//	common.RegisterDBTracing(db)
+func RegisterDBTracing(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:create").Register("otel:before_create", startDBSpan("create"))
+	callbacks.Create().After("gorm:create").Register("otel:after_create", endDBSpan)
+	callbacks.Query().Before("gorm:query").Register("otel:before_query", startDBSpan("query"))
+	callbacks.Query().After("gorm:query").Register("otel:after_query", endDBSpan)
+	callbacks.Update().Before("gorm:update").Register("otel:before_update", startDBSpan("update"))
+	callbacks.Update().After("gorm:update").Register("otel:after_update", endDBSpan)
+	callbacks.Delete().Before("gorm:delete").Register("otel:before_delete", startDBSpan("delete"))
+	callbacks.Delete().After("gorm:delete").Register("otel:after_delete", endDBSpan)
+	callbacks.RowQuery().Before("gorm:row_query").Register("otel:before_row_query", startDBSpan("row_query"))
+	callbacks.RowQuery().After("gorm:row_query").Register("otel:after_row_query", endDBSpan)
+}
+
+func startDBSpan(operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		ctx := context.Background()
+		if value, ok := scope.Get(dbContextKey); ok {
+			if value, ok := value.(context.Context); ok {
+				ctx = value
+			}
+		}
+		table := "unknown"
+		if scope.Value != nil {
+			table = scope.TableName()
+		}
+		_, span := otel.Tracer(tracerName).Start(ctx, "gorm."+operation+" "+table,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemKey.String(scope.Dialect().GetName()),
+				semconv.DBOperationName(operation),
+				semconv.DBCollectionName(table),
+			),
+		)
+		scope.Set(dbSpanKey, span)
+	}
+}
+
+func endDBSpan(scope *gorm.Scope) {
+	value, ok := scope.Get(dbSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	// the statement only holds placeholders, the values are not recorded
+	span.SetAttributes(
+		semconv.DBQueryText(scope.SQL),
+		attribute.Int64("db.rows_affected", scope.DB().RowsAffected),
+	)
+	if err := scope.DB().Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/zh"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	zh_translations "github.com/go-playground/validator/v10/translations/zh"
+)
+
+// The locale used when Accept-Language names nothing we have translations for.
+const DefaultLocale = "en"
+
+var universalTranslator = ut.New(en.New(), en.New(), zh.New())
+
+// A username is letters and digits, optionally joined by single '-' or '_': "jake", "jake_smith"
+var usernameRegexp = regexp.MustCompile(`^[A-Za-z0-9]+([_-][A-Za-z0-9]+)*$`)
+
+// Implemented by validators filled with a stored user, see the username rule.
+type storedUsername interface {
+	StoredUsername() string
+}
+
+// A tag is up to 32 letters, digits, spaces or "._+#-", starting with a letter or digit,
+// so "golang", "c++", "node.js" and "machine learning" are all fine.
+var tagRegexp = regexp.MustCompile(`^[\p{L}\p{N}](?:[\p{L}\p{N} ._+#-]{0,30}[\p{L}\p{N}+#])?$`)
+
+// Messages of our own validators, per locale.
+// Like every other message they are phrased to follow the field name.
+var customTranslations = map[string]map[string]string{
+	"en": {
+		"username":    "{0} can only contain letters and digits, optionally joined by a single '-' or '_'",
+		"tag":         "{0} must be 1 to 32 letters, digits, spaces or ._+#- starting with a letter or digit",
+		"articlebody": "{0} must be at most {1} characters long",
+	},
+	"zh": {
+		"username":    "{0}只能包含字母和数字，中间可以用单个'-'或'_'连接",
+		"tag":         "{0}必须为1到32个字母、数字、空格或._+#-，并以字母或数字开头",
+		"articlebody": "{0}最多只能有{1}个字符",
+	},
+}
+
+// The binding engine of gin is set up once, before any request is bound:
+// field names come from the json tag and our custom validators are registered with their messages.
+func init() {
+	validate, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" || name == "" {
+			return field.Name
+		}
+		return name
+	})
+	validate.RegisterValidation("username", func(fl validator.FieldLevel) bool {
+		// a username taken before the rule existed can be kept, just not chosen anew
+		if stored, ok := fl.Top().Interface().(storedUsername); ok && stored.StoredUsername() == fl.Field().String() {
+			return true
+		}
+		return usernameRegexp.MatchString(fl.Field().String())
+	})
+	validate.RegisterValidation("tag", func(fl validator.FieldLevel) bool {
+		return tagRegexp.MatchString(fl.Field().String())
+	})
+	// the limit is read when validating, unlike a max=N tag it can be configured
+	validate.RegisterValidation("articlebody", func(fl validator.FieldLevel) bool {
+		return utf8.RuneCountInString(fl.Field().String()) <= ArticleBodyMaxLength
+	})
+
+	trans, _ := universalTranslator.GetTranslator("en")
+	en_translations.RegisterDefaultTranslations(validate, trans)
+	registerCustomTranslations(validate, trans, customTranslations["en"])
+	trans, _ = universalTranslator.GetTranslator("zh")
+	zh_translations.RegisterDefaultTranslations(validate, trans)
+	registerCustomTranslations(validate, trans, customTranslations["zh"])
+}
+
+func registerCustomTranslations(validate *validator.Validate, trans ut.Translator, messages map[string]string) {
+	for tag, message := range messages {
+		tag, message := tag, message
+		validate.RegisterTranslation(tag, trans, func(trans ut.Translator) error {
+			return trans.Add(tag, message, true)
+		}, func(trans ut.Translator, fe validator.FieldError) string {
+			// {1} is only used by articlebody, whose limit is not part of the tag
+			text, err := trans.T(tag, fe.Field(), strconv.Itoa(ArticleBodyMaxLength))
+			if err != nil {
+				return fe.Error()
+			}
+			return text
+		})
+	}
+}
+
+// Pick the translator matching the Accept-Language header of the request, English otherwise.
+//
+//	Accept-Language: zh-CN,zh;q=0.9,en;q=0.8  ->  zh
+func RequestTranslator(c *gin.Context) ut.Translator {
+	var locales []string
+	for _, lang := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		lang = strings.TrimSpace(strings.SplitN(lang, ";", 2)[0])
+		if lang == "" {
+			continue
+		}
+		lang = strings.ToLower(strings.Replace(lang, "-", "_", -1))
+		locales = append(locales, lang, strings.SplitN(lang, "_", 2)[0])
+	}
+	trans, found := universalTranslator.FindTranslator(locales...)
+	if !found {
+		trans, _ = universalTranslator.GetTranslator(DefaultLocale)
+	}
+	return trans
+}
+
+// Turn validation errors into {"errors":{"password":"must be at least 8 characters in length"}}.
+// Keys are the json names of the fields, and since clients show "key message" the field name
+// the translations start with is left out of the message.
+func TranslateValidatorError(errs validator.ValidationErrors, trans ut.Translator) CommonError {
+	res := CommonError{}
+	res.Errors = make(map[string]interface{})
+	for _, v := range errs {
+		message := strings.TrimSpace(strings.TrimPrefix(v.Translate(trans), v.Field()))
+		res.Errors[v.Field()] = message
+	}
+	return res
+}
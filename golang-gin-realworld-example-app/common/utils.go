@@ -2,7 +2,6 @@
 package common
 
 import (
-	"fmt"
 	"math/rand"
 	"time"
 
@@ -47,23 +46,14 @@ type CommonError struct {
 	Errors map[string]interface{} `json:"errors"`
 }
 
-// To handle the error returned by c.Bind in gin framework
+// To handle the error returned by c.Bind in gin framework, messages are in the default locale.
 // https://github.com/go-playground/validator/blob/v9/_examples/translations/main.go
+//
+//	{"errors":{"password":"must be at least 8 characters in length"}}
 func NewValidatorError(err error) CommonError {
-	res := CommonError{}
-	res.Errors = make(map[string]interface{})
 	errs := err.(validator.ValidationErrors)
-	for _, v := range errs {
-		// can translate each error one at a time.
-		//fmt.Println("gg",v.NameNamespace)
-		if v.Param() != "" {
-			res.Errors[v.Field()] = fmt.Sprintf("{%v: %v}", v.Tag(), v.Param())
-		} else {
-			res.Errors[v.Field()] = fmt.Sprintf("{key: %v}", v.Tag())
-		}
-
-	}
-	return res
+	trans, _ := universalTranslator.GetTranslator(DefaultLocale)
+	return TranslateValidatorError(errs, trans)
 }
 
 // Warp the error info in a object
@@ -0,0 +1,183 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+)
+
+// How the dispatcher retries an event a subscriber failed to handle: after Backoff, doubled
+// after each failure up to MaxBackoff, and not after MaxAttempts. Variables so tests can shorten them.
+var (
+	MaxAttempts = 10
+	Backoff     = time.Second
+	MaxBackoff  = time.Hour
+	// an event claimed by a dispatcher that died is dispatched again after it
+	LockTimeout = time.Minute
+)
+
+// Dispatcher hands the events of the outbox to the subscribers, oldest first, at least once each.
+// Events are claimed before they are dispatched, so any number of dispatchers can share the database.
+//
+//	dispatcher := events.NewDispatcher(db)
+//	go dispatcher.Run(ctx)
+type Dispatcher struct {
+	DB           *gorm.DB
+	PollInterval time.Duration
+	BatchSize    int
+}
+
+func NewDispatcher(db *gorm.DB) *Dispatcher {
+	return &Dispatcher{DB: db, PollInterval: time.Second, BatchSize: 100}
+}
+
+// Events published by this process wake its dispatchers up rather than waiting for the next poll.
+var wake = make(chan struct{}, 1)
+
+func Wake() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Dispatch due events every PollInterval, and whenever Wake is called, until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+	for {
+		if d.DispatchDue() == d.BatchSize && ctx.Err() == nil {
+			// a full batch, there may be more
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// Dispatch a batch of the events that are due and return how many were claimed.
+func (d *Dispatcher) DispatchDue() int {
+	now := time.Now()
+	var due []EventModel
+	err := d.DB.Where("failed = ? AND next_attempt_at <= ? AND (locked_until IS NULL OR locked_until < ?)", false, now, now).
+		Order("id").Limit(d.BatchSize).Find(&due).Error
+	if err != nil {
+		common.Logger.Error("events: cannot read the outbox", "error", err)
+		return 0
+	}
+	dispatched := 0
+	for _, event := range due {
+		if !d.claim(&event) {
+			continue
+		}
+		d.dispatch(event)
+		dispatched++
+	}
+	return dispatched
+}
+
+// Count the attempt and lock the event for LockTimeout, unless another dispatcher did first.
+func (d *Dispatcher) claim(event *EventModel) bool {
+	result := d.DB.Model(&EventModel{}).
+		Where("id = ? AND attempts = ?", event.ID, event.Attempts).
+		UpdateColumns(map[string]interface{}{"attempts": event.Attempts + 1, "locked_until": time.Now().Add(LockTimeout)})
+	if result.Error != nil {
+		common.Logger.Error("events: cannot claim event", "event", event.ID, "error", result.Error)
+		return false
+	}
+	event.Attempts++
+	return result.RowsAffected == 1
+}
+
+// Hand the event to the subscribers not done with it yet, then delete it, or retry it later for
+// those that failed.
+func (d *Dispatcher) dispatch(event EventModel) {
+	decoder, ok := decoders[event.Type]
+	if !ok {
+		d.fail(event, fmt.Errorf("unknown type %q", event.Type), true)
+		return
+	}
+	decoded, err := decoder(event.Payload)
+	if err != nil {
+		d.fail(event, fmt.Errorf("cannot decode payload: %w", err), true)
+		return
+	}
+	envelope := Envelope{ID: event.ID, CreatedAt: event.CreatedAt, Event: decoded}
+
+	var errs []string
+	for _, s := range subscribers {
+		if strings.Contains(event.Delivered, ","+s.name+",") {
+			continue
+		}
+		delivered := event.Delivered + s.name + ","
+		err := common.TransactionOn(d.DB, func(tx *gorm.DB) error {
+			if err := handle(s, tx, envelope); err != nil {
+				return err
+			}
+			return tx.Model(&EventModel{}).Where("id = ?", event.ID).UpdateColumn("delivered", delivered).Error
+		})
+		if err != nil {
+			common.EventDeliveriesTotal.WithLabelValues(s.name, "failure").Inc()
+			errs = append(errs, s.name+": "+err.Error())
+			continue
+		}
+		common.EventDeliveriesTotal.WithLabelValues(s.name, "success").Inc()
+		event.Delivered = delivered
+	}
+	if len(errs) > 0 {
+		d.fail(event, fmt.Errorf("%s", strings.Join(errs, "; ")), false)
+		return
+	}
+	if err := d.DB.Delete(&event).Error; err != nil {
+		common.Logger.Error("events: cannot delete event", "event", event.ID, "error", err)
+	}
+}
+
+// Run the handler of s, turning a panic into an error so the transaction rolls back.
+func handle(s subscriber, tx *gorm.DB, envelope Envelope) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handle(tx, envelope)
+}
+
+// Retry the event after the backoff of its attempts, or give up on it for good or after MaxAttempts.
+func (d *Dispatcher) fail(event EventModel, err error, permanent bool) {
+	message := err.Error()
+	if len(message) > 2048 {
+		message = message[:2048]
+	}
+	changes := map[string]interface{}{"locked_until": nil, "last_error": message}
+	if permanent || event.Attempts >= MaxAttempts {
+		common.Logger.Error("events: giving up on event", "event", event.ID, "type", event.Type, "attempts", event.Attempts, "error", err)
+		changes["failed"] = true
+	} else {
+		common.Logger.Warn("events: event failed, will retry", "event", event.ID, "type", event.Type, "attempts", event.Attempts, "error", err)
+		changes["next_attempt_at"] = time.Now().Add(retryDelay(event.Attempts))
+	}
+	if err := d.DB.Model(&EventModel{}).Where("id = ?", event.ID).UpdateColumns(changes).Error; err != nil {
+		common.Logger.Error("events: cannot save event", "event", event.ID, "error", err)
+	}
+}
+
+// The wait before the next attempt after the attempt-th one failed.
+func retryDelay(attempt int) time.Duration {
+	delay := Backoff
+	for i := 1; i < attempt && delay < MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxBackoff {
+		delay = MaxBackoff
+	}
+	return delay
+}
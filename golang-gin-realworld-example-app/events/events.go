@@ -0,0 +1,105 @@
+package events
+
+import (
+	"encoding/json"
+)
+
+// The Type of each event, as stored in the outbox.
+const (
+	TypeArticleCreated     = "article.created"
+	TypeArticleUpdated     = "article.updated"
+	TypeArticleDeleted     = "article.deleted"
+	TypeArticleFavorited   = "article.favorited"
+	TypeArticleUnfavorited = "article.unfavorited"
+	TypeCommentCreated     = "comment.created"
+	TypeUserFollowed       = "user.followed"
+	TypeUserUnfollowed     = "user.unfollowed"
+)
+
+// Something that happened, published by the model function that did it. Every user id in an
+// event is the id of a UserModel, never of an ArticleUserModel.
+type Event interface {
+	Type() string
+}
+
+// The author published the article.
+type ArticleCreated struct {
+	ArticleID uint `json:"articleId"`
+	AuthorID  uint `json:"authorId"`
+}
+
+// The author edited the article.
+type ArticleUpdated struct {
+	ArticleID uint `json:"articleId"`
+	AuthorID  uint `json:"authorId"`
+}
+
+// The article was deleted, it can still be read with Unscoped.
+type ArticleDeleted struct {
+	ArticleID uint `json:"articleId"`
+	AuthorID  uint `json:"authorId"`
+}
+
+// UserID favorited the article of AuthorID.
+type ArticleFavorited struct {
+	ArticleID uint `json:"articleId"`
+	AuthorID  uint `json:"authorId"`
+	UserID    uint `json:"userId"`
+}
+
+// UserID took back their favorite.
+type ArticleUnfavorited struct {
+	ArticleID uint `json:"articleId"`
+	AuthorID  uint `json:"authorId"`
+	UserID    uint `json:"userId"`
+}
+
+// AuthorID commented on the article of ArticleAuthorID, or replied to the comment ParentID of
+// ParentAuthorID. Both parent fields are 0 at the top level.
+type CommentCreated struct {
+	CommentID       uint `json:"commentId"`
+	ArticleID       uint `json:"articleId"`
+	ArticleAuthorID uint `json:"articleAuthorId"`
+	AuthorID        uint `json:"authorId"`
+	ParentID        uint `json:"parentId"`
+	ParentAuthorID  uint `json:"parentAuthorId"`
+}
+
+// FollowerID followed UserID.
+type UserFollowed struct {
+	UserID     uint `json:"userId"`
+	FollowerID uint `json:"followerId"`
+}
+
+// FollowerID stopped following UserID.
+type UserUnfollowed struct {
+	UserID     uint `json:"userId"`
+	FollowerID uint `json:"followerId"`
+}
+
+func (ArticleCreated) Type() string     { return TypeArticleCreated }
+func (ArticleUpdated) Type() string     { return TypeArticleUpdated }
+func (ArticleDeleted) Type() string     { return TypeArticleDeleted }
+func (ArticleFavorited) Type() string   { return TypeArticleFavorited }
+func (ArticleUnfavorited) Type() string { return TypeArticleUnfavorited }
+func (CommentCreated) Type() string     { return TypeCommentCreated }
+func (UserFollowed) Type() string       { return TypeUserFollowed }
+func (UserUnfollowed) Type() string     { return TypeUserUnfollowed }
+
+// How the payload of each Type is read back.
+var decoders = map[string]func(payload string) (Event, error){
+	TypeArticleCreated:     decode[ArticleCreated],
+	TypeArticleUpdated:     decode[ArticleUpdated],
+	TypeArticleDeleted:     decode[ArticleDeleted],
+	TypeArticleFavorited:   decode[ArticleFavorited],
+	TypeArticleUnfavorited: decode[ArticleUnfavorited],
+	TypeCommentCreated:     decode[CommentCreated],
+	TypeUserFollowed:       decode[UserFollowed],
+	TypeUserUnfollowed:     decode[UserUnfollowed],
+}
+
+func decode[T Event](payload string) (Event, error) {
+	var event T
+	err := json.Unmarshal([]byte(payload), &event)
+	return event, err
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+)
+
+// An event in the outbox, written in the transaction of the change it tells about and deleted
+// once every subscriber has handled it.
+type EventModel struct {
+	ID            uint `gorm:"primary_key"`
+	CreatedAt     time.Time
+	Type          string     `gorm:"size:64;not null"`
+	Payload       string     `gorm:"type:text;not null"`
+	Delivered     string     `gorm:"size:1024;not null"` // ",notifications,webhooks,", the subscribers done with it
+	Attempts      int        `gorm:"not null;default:0"`
+	NextAttemptAt time.Time  `gorm:"not null;index"`
+	LockedUntil   *time.Time // claimed by a dispatcher until then
+	Failed        bool       `gorm:"not null;default:false"` // given up on after MaxAttempts
+	LastError     string     `gorm:"size:2048"`
+}
+
+// An event read back from the outbox, as handed to subscribers.
+type Envelope struct {
+	ID        uint
+	CreatedAt time.Time
+	Event     Event
+}
+
+// Handles an event in a transaction of its own, which also records that the subscriber is done
+// with it: what the handler writes is committed once, anything else it does may happen again.
+type Handler func(tx *gorm.DB, envelope Envelope) error
+
+type subscriber struct {
+	name   string
+	handle Handler
+}
+
+// In the order they subscribed, see Subscribe.
+var subscribers []subscriber
+
+// Hand every event to handle, from now on. Packages reacting to events, such as notifications,
+// subscribe in their init so the packages publishing them need not import them. The name is
+// what the outbox remembers, subscribing twice with one panics.
+func Subscribe(name string, handle Handler) {
+	for _, s := range subscribers {
+		if s.name == name {
+			panic("events: " + name + " subscribed twice")
+		}
+	}
+	subscribers = append(subscribers, subscriber{name, handle})
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&EventModel{})
+}
+
+// Write event to the outbox in the transaction of tx, so it is dispatched if and only if the
+// transaction commits.
+//
+//	err := events.PublishTx(tx, events.UserFollowed{UserID: v.ID, FollowerID: u.ID})
+func PublishTx(tx *gorm.DB, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	model := EventModel{
+		Type:          event.Type(),
+		Payload:       string(payload),
+		Delivered:     ",",
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Create(&model).Error; err != nil {
+		return err
+	}
+	common.AfterCommit(tx, Wake)
+	return nil
+}
@@ -0,0 +1,164 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"realworld-backend/common"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() {
+	test_db = common.TestDBInit()
+	AutoMigrate()
+}
+
+func teardownTestDB() {
+	common.TestDBFree(test_db)
+}
+
+var (
+	testMu   sync.Mutex
+	received = map[string][]Envelope{}
+	failing  error // returned by test.flaky while set
+)
+
+func receive(name string) Handler {
+	return func(tx *gorm.DB, envelope Envelope) error {
+		testMu.Lock()
+		defer testMu.Unlock()
+		if name == "test.flaky" && failing != nil {
+			if failing.Error() == "panic" {
+				panic("boom")
+			}
+			return failing
+		}
+		received[name] = append(received[name], envelope)
+		return nil
+	}
+}
+
+func init() {
+	Subscribe("test.steady", receive("test.steady"))
+	Subscribe("test.flaky", receive("test.flaky"))
+}
+
+func reset(err error) {
+	testMu.Lock()
+	defer testMu.Unlock()
+	received = map[string][]Envelope{}
+	failing = err
+}
+
+func got(name string) []Envelope {
+	testMu.Lock()
+	defer testMu.Unlock()
+	return received[name]
+}
+
+func publish(asserts *assert.Assertions, event Event) {
+	asserts.NoError(common.Transaction(func(tx *gorm.DB) error {
+		return PublishTx(tx, event)
+	}))
+}
+
+func outbox() []EventModel {
+	var models []EventModel
+	test_db.Order("id").Find(&models)
+	return models
+}
+
+func TestDispatch(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+	dispatcher := NewDispatcher(test_db)
+	reset(nil)
+
+	publish(asserts, UserFollowed{UserID: 1, FollowerID: 2})
+	common.Transaction(func(tx *gorm.DB) error {
+		PublishTx(tx, UserFollowed{UserID: 1, FollowerID: 3})
+		return errors.New("rollback")
+	})
+	publish(asserts, CommentCreated{CommentID: 5, ArticleID: 4, ArticleAuthorID: 1, AuthorID: 2})
+	asserts.Len(outbox(), 2, "nothing is published by a transaction rolled back")
+
+	asserts.Equal(2, dispatcher.DispatchDue())
+	asserts.Len(got("test.steady"), 2)
+	asserts.Equal(got("test.steady"), got("test.flaky"))
+	asserts.Equal(UserFollowed{UserID: 1, FollowerID: 2}, got("test.steady")[0].Event)
+	asserts.Equal(CommentCreated{CommentID: 5, ArticleID: 4, ArticleAuthorID: 1, AuthorID: 2}, got("test.steady")[1].Event)
+	asserts.Empty(outbox(), "dispatched events are deleted")
+	asserts.Equal(0, dispatcher.DispatchDue())
+}
+
+func TestDispatchRetries(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+	dispatcher := NewDispatcher(test_db)
+	defer func(backoff time.Duration, maxAttempts int) { Backoff, MaxAttempts = backoff, maxAttempts }(Backoff, MaxAttempts)
+	reset(errors.New("unavailable"))
+
+	publish(asserts, ArticleFavorited{ArticleID: 1, AuthorID: 2, UserID: 3})
+	asserts.Equal(1, dispatcher.DispatchDue())
+	asserts.Len(got("test.steady"), 1)
+	asserts.Empty(got("test.flaky"))
+	event := outbox()[0]
+	asserts.Equal(",test.steady,", event.Delivered)
+	asserts.Equal(1, event.Attempts)
+	asserts.Equal("test.flaky: unavailable", event.LastError)
+	asserts.Nil(event.LockedUntil)
+	asserts.Equal(0, dispatcher.DispatchDue(), "not before the backoff")
+
+	test_db.Model(&event).UpdateColumn("next_attempt_at", time.Now())
+	reset(nil)
+	asserts.Equal(1, dispatcher.DispatchDue())
+	asserts.Empty(got("test.steady"), "a subscriber done with the event does not get it again")
+	asserts.Len(got("test.flaky"), 1)
+	asserts.Equal(event.ID, got("test.flaky")[0].ID)
+	asserts.Empty(outbox())
+
+	// given up on after MaxAttempts, a panic is a failure like any other
+	Backoff, MaxAttempts = 0, 2
+	reset(errors.New("panic"))
+	publish(asserts, ArticleFavorited{ArticleID: 1, AuthorID: 2, UserID: 3})
+	asserts.Equal(1, dispatcher.DispatchDue())
+	asserts.Equal(1, dispatcher.DispatchDue())
+	asserts.Equal(0, dispatcher.DispatchDue())
+	event = outbox()[0]
+	asserts.True(event.Failed)
+	asserts.Equal(2, event.Attempts)
+	asserts.Equal("test.flaky: panic: boom", event.LastError)
+
+	// an unknown type is given up on at once
+	test_db.Create(&EventModel{Type: "article.vanished", Payload: "{}", Delivered: ",", NextAttemptAt: time.Now()})
+	asserts.Equal(1, dispatcher.DispatchDue())
+	event = outbox()[1]
+	asserts.True(event.Failed)
+	asserts.Equal(`unknown type "article.vanished"`, event.LastError)
+}
+
+func TestDispatchClaims(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+	dispatcher := NewDispatcher(test_db)
+	reset(nil)
+
+	publish(asserts, ArticleCreated{ArticleID: 1, AuthorID: 2})
+	event := outbox()[0]
+	test_db.Model(&event).UpdateColumns(map[string]interface{}{"attempts": 1, "locked_until": time.Now().Add(time.Minute)})
+	asserts.Equal(0, dispatcher.DispatchDue(), "claimed by another dispatcher")
+
+	// until its lock expires, when that dispatcher must have died
+	test_db.Model(&event).UpdateColumn("locked_until", time.Now().Add(-time.Second))
+	asserts.Equal(1, dispatcher.DispatchDue())
+	asserts.Len(got("test.steady"), 1)
+	asserts.Empty(outbox())
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-contrib/cors"
@@ -9,45 +16,159 @@ import (
 	"github.com/jinzhu/gorm"
 	"realworld-backend/articles"
 	"realworld-backend/common"
+	"realworld-backend/events"
+	"realworld-backend/jobs"
+	"realworld-backend/notifications"
+	"realworld-backend/stream"
+	"realworld-backend/uploads"
 	"realworld-backend/users"
+	"realworld-backend/webhooks"
 )
 
-func Migrate(db *gorm.DB) {
+// Every model the schema is made of, /readyz checks their tables and columns exist.
+var migratedModels = []interface{}{
+	&users.UserModel{},
+	&users.FollowModel{},
+	&articles.ArticleModel{},
+	&articles.TagModel{},
+	&articles.FavoriteModel{},
+	&articles.ArticleUserModel{},
+	&articles.CommentModel{},
+	&articles.CommentRevisionModel{},
+	&uploads.UploadModel{},
+	&notifications.NotificationModel{},
+	&notifications.NotificationActorModel{},
+	&webhooks.WebhookModel{},
+	&webhooks.WebhookDeliveryModel{},
+	&webhooks.WebhookAttemptModel{},
+	&jobs.JobModel{},
+	&events.EventModel{},
+	&common.RateLimitBucket{},
+}
+
+// Create or update the tables, then fill the columns older rows are missing.
+func Migrate(db *gorm.DB) error {
 	users.AutoMigrate()
 	db.AutoMigrate(&articles.ArticleModel{})
 	db.AutoMigrate(&articles.TagModel{})
 	db.AutoMigrate(&articles.FavoriteModel{})
 	db.AutoMigrate(&articles.ArticleUserModel{})
 	db.AutoMigrate(&articles.CommentModel{})
+	db.AutoMigrate(&articles.CommentRevisionModel{})
+	uploads.AutoMigrate()
+	notifications.AutoMigrate()
+	webhooks.AutoMigrate()
+	jobs.AutoMigrate()
+	events.AutoMigrate()
+	db.AutoMigrate(&common.RateLimitBucket{})
+	if err := articles.MigrateBodyToText(db); err != nil {
+		return err
+	}
+	return articles.BackfillReadingStats(db)
 }
 
 func main() {
+	cli := &CLI{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr, OpenDB: common.Init}
+	if err := cli.Run(os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
 
-	db := common.Init()
-	Migrate(db)
-	defer db.Close()
+// Serve the API on db until SIGINT or SIGTERM, then drain and close it. runWorker runs the
+// background jobs in the same process, see startWorker.
+func serve(db *gorm.DB, runWorker bool) error {
+	common.InitLogger(os.Stdout, os.Getenv("LOG_LEVEL"))
+	rateLimitConfig, err := common.RateLimitConfigFromEnv()
+	if err != nil {
+		db.Close()
+		return err
+	}
+	var rateLimitStore common.RateLimitStore
+	switch rateLimitConfig.Store {
+	case "", "memory":
+		rateLimitStore = common.NewMemoryRateLimitStore()
+	case "sql":
+		rateLimitStore = common.NewSQLRateLimitStore(db)
+	default:
+		db.Close()
+		return fmt.Errorf("unknown RATE_LIMIT_STORE %q, use memory or sql", rateLimitConfig.Store)
+	}
+	r, err := newEngine(rateLimitConfig.TrustedProxies)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	shutdownTracer, err := common.InitTracer(common.TracingConfigFromEnv())
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("tracing: cannot start exporter: %w", err)
+	}
+	common.RegisterDBMetrics(db)
+	common.RegisterDBTracing(db)
+	common.InitCache()
+	uploadConfig, err := common.UploadConfigFromEnv()
+	if err != nil {
+		db.Close()
+		return err
+	}
+	blobStore, err := uploadConfig.BlobStore()
+	if err != nil {
+		db.Close()
+		return err
+	}
+	uploader := &uploads.Uploader{Store: blobStore, MaxSize: uploadConfig.MaxSize, PublicURL: uploadConfig.PublicURL}
+	rateLimit := func(policy string) gin.HandlerFunc {
+		return common.RateLimit(rateLimitStore, rateLimitConfig.Policies[policy])
+	}
+
+	server := common.NewServer(r, common.ServerConfigFromEnv())
+	// hooks run last registered first: the database closes after everything that may still use it
+	server.OnShutdown(func(context.Context) error { return db.Close() })
+	server.OnShutdown(shutdownTracer)
+	// streams never end on their own, close them as soon as the shutdown starts so they do not hold up the drain
+	server.RegisterOnShutdown(common.GetHub().Close)
 
-	r := gin.Default()
+	if runWorker {
+		server.OnShutdown(startWorker(db))
+	}
+
+	r.Use(gin.Recovery(), common.RequestID(), common.Tracing(), common.RequestLogger(), common.Metrics(), common.ErrorHandler())
+	r.GET("/metrics", common.MetricsHandler())
+	r.GET("/healthz", common.HealthHandler())
+	r.GET("/readyz", common.ReadinessHandler(
+		server.DrainingCheck(),
+		common.DatabaseCheck(db),
+		common.MigrationCheck(db, migratedModels...),
+	))
 
 	// Configure CORS
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:4100"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", common.RequestIDHeader, "traceparent", "tracestate", "If-None-Match", "If-Modified-Since", "If-Match", "Last-Event-ID"},
+		ExposeHeaders:    []string{common.RequestIDHeader, "ETag", "Last-Modified", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After"},
 		AllowCredentials: true,
 	}))
 
-	v1 := r.Group("/api")
-	users.UsersRegister(v1.Group("/users"))
-	v1.Use(users.AuthMiddleware(false))
+	v1 := apiGroup(r, rateLimit)
+	users.UsersRegister(v1.Group("/users", rateLimit("auth")))
 	articles.ArticlesAnonymousRegister(v1.Group("/articles"))
 	articles.TagsAnonymousRegister(v1.Group("/tags"))
+	uploads.UploadsAnonymousRegister(v1.Group("/uploads"), uploader)
 
 	v1.Use(users.AuthMiddleware(true))
 	users.UserRegister(v1.Group("/user"))
 	users.ProfileRegister(v1.Group("/profiles"))
 
-	articles.ArticlesRegister(v1.Group("/articles"))
+	articles.ArticlesRegister(v1.Group("/articles", rateLimit("write")))
+	uploads.UploadsRegister(v1.Group("/uploads", rateLimit("write")), uploader)
+	notifications.NotificationsRegister(v1.Group("/notifications"))
+	stream.StreamRegister(v1.Group("/stream"))
+	webhooks.WebhooksRegister(v1.Group("/webhooks", rateLimit("write")))
+	jobs.JobsRegister(v1.Group("/jobs"))
 
 	testAuth := r.Group("/api/ping")
 
@@ -57,26 +178,55 @@ func main() {
 		})
 	})
 
-	// test 1 to 1
-	tx1 := db.Begin()
-	userA := users.UserModel{
-		Username: "AAAAAAAAAAAAAAAA",
-		Email:    "aaaa@g.cn",
-		Bio:      "hehddeda",
-		Image:    nil,
+	// serve on 0.0.0.0:8080 (or $PORT) until SIGINT or SIGTERM, then drain and clean up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return server.Run(ctx)
+}
+
+// The engine of the API. The client IP, which anonymous requests are rate limited by, is only
+// read from X-Forwarded-For and X-Real-IP when the request comes from one of trustedProxies.
+func newEngine(trustedProxies []string) (*gin.Engine, error) {
+	r := gin.New()
+	return r, r.SetTrustedProxies(trustedProxies)
+}
+
+// The /api group. The caller is identified before the "api" limit is taken, so that every
+// authenticated user has a bucket of their own instead of sharing the one of their IP.
+func apiGroup(r *gin.Engine, rateLimit func(policy string) gin.HandlerFunc) *gin.RouterGroup {
+	return r.Group("/api", users.AuthMiddleware(false), rateLimit("api"))
+}
+
+// Run the background jobs on db, and dispatch the domain events of its outbox, until the returned
+// function is called, which waits for the running ones to finish. WEBHOOKS_ALLOW_PRIVATE=true lets
+// webhooks call localhost and the private network, for development.
+func startWorker(db *gorm.DB) func(context.Context) error {
+	webhooks.Client = webhooks.NewClient(os.Getenv("WEBHOOKS_ALLOW_PRIVATE") == "true")
+	worker := jobs.NewWorker(db)
+	dispatcher := events.NewDispatcher(db)
+	ctx, stop := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	running.Add(2)
+	go func() {
+		defer running.Done()
+		dispatcher.Run(ctx)
+	}()
+	go func() {
+		defer running.Done()
+		worker.Run(ctx)
+	}()
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	return func(shutdownCtx context.Context) error {
+		stop()
+		select {
+		case <-done:
+			return nil
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
 	}
-	tx1.Save(&userA)
-	tx1.Commit()
-	fmt.Println(userA)
-
-	//db.Save(&ArticleUserModel{
-	//    UserModelID:userA.ID,
-	//})
-	//var userAA ArticleUserModel
-	//db.Where(&ArticleUserModel{
-	//    UserModelID:userA.ID,
-	//}).First(&userAA)
-	//fmt.Println(userAA)
-
-	r.Run() // listen and serve on 0.0.0.0:8080
 }
@@ -4,13 +4,22 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"realworld-backend/articles"
 	"realworld-backend/common"
+	"realworld-backend/events"
+	"realworld-backend/notifications"
+	"realworld-backend/uploads"
 	"realworld-backend/users"
+	"realworld-backend/webhooks"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -20,6 +29,7 @@ import (
 func setupRouter() *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
+	r.Use(common.ErrorHandler())
 
 	v1 := r.Group("/api")
 	users.UsersRegister(v1.Group("/users"))
@@ -31,6 +41,8 @@ func setupRouter() *gin.Engine {
 	users.UserRegister(v1.Group("/user"))
 	users.ProfileRegister(v1.Group("/profiles"))
 	articles.ArticlesRegister(v1.Group("/articles"))
+	notifications.NotificationsRegister(v1.Group("/notifications"))
+	webhooks.WebhooksRegister(v1.Group("/webhooks"))
 
 	return r
 }
@@ -40,6 +52,10 @@ func setupTestDatabase() {
 	common.TestDBInit()
 	users.AutoMigrate()
 	articles.AutoMigrate()
+	uploads.AutoMigrate()
+	events.AutoMigrate()
+	notifications.AutoMigrate()
+	webhooks.AutoMigrate()
 }
 
 // teardownTestDatabase cleans up test database
@@ -387,6 +403,69 @@ func TestGetSingleArticle(t *testing.T) {
 	asserts.Equal("Single Article", article["title"])
 }
 
+func TestArticleConditionalGet(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDatabase()
+	defer teardownTestDatabase()
+
+	router := setupRouter()
+
+	registerData := map[string]interface{}{
+		"user": map[string]interface{}{
+			"username": "conditional",
+			"email":    "conditional@example.com",
+			"password": "password123",
+		},
+	}
+	regResp := makeRequest(router, "POST", "/api/users/", registerData, "")
+	var regResponse map[string]interface{}
+	json.Unmarshal(regResp.Body.Bytes(), &regResponse)
+	token := regResponse["user"].(map[string]interface{})["token"].(string)
+
+	articleData := map[string]interface{}{
+		"article": map[string]interface{}{
+			"title":       "Conditional Article",
+			"description": "Conditional description",
+			"body":        "Conditional body",
+		},
+	}
+	makeRequest(router, "POST", "/api/articles/", articleData, token)
+
+	get := func(ifNoneMatch, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/articles/conditional-article", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", fmt.Sprintf("Token %s", token))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("", "")
+	etag := w.Header().Get("ETag")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.NotEmpty(etag)
+	asserts.NotEmpty(w.Header().Get("Last-Modified"))
+	asserts.Equal("public, max-age=0, must-revalidate", w.Header().Get("Cache-Control"))
+
+	asserts.Equal(http.StatusNotModified, get(etag, "").Code, "An unchanged article should not be resent")
+
+	w = get("", token)
+	asserts.Equal("private, no-cache", w.Header().Get("Cache-Control"), "Authenticated responses should not be shared")
+
+	makeRequest(router, "POST", "/api/articles/conditional-article/favorite", nil, token)
+	asserts.Equal(http.StatusOK, get(etag, "").Code, "A favorite should change the ETag")
+
+	w = makeRequest(router, "GET", "/api/tags/", nil, "")
+	asserts.NotEmpty(w.Header().Get("ETag"))
+	w = makeRequest(router, "GET", "/api/articles/", nil, "")
+	asserts.NotEmpty(w.Header().Get("ETag"))
+	asserts.Equal("Authorization", w.Header().Get("Vary"))
+}
+
 func TestUpdateArticleByAuthor(t *testing.T) {
 	asserts := assert.New(t)
 	setupTestDatabase()
@@ -442,6 +521,78 @@ func TestUpdateArticleByAuthor(t *testing.T) {
 	asserts.Equal("Updated Title", article["title"])
 }
 
+func TestUpdateArticleConcurrently(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDatabase()
+	defer teardownTestDatabase()
+
+	router := setupRouter()
+
+	registerData := map[string]interface{}{
+		"user": map[string]interface{}{
+			"username": "editor",
+			"email":    "editor@example.com",
+			"password": "password123",
+		},
+	}
+	regResp := makeRequest(router, "POST", "/api/users/", registerData, "")
+	var regResponse map[string]interface{}
+	json.Unmarshal(regResp.Body.Bytes(), &regResponse)
+	token := regResponse["user"].(map[string]interface{})["token"].(string)
+
+	articleData := map[string]interface{}{
+		"article": map[string]interface{}{
+			"title":       "Shared Draft",
+			"description": "Shared description",
+			"body":        "Shared body",
+		},
+	}
+	createResp := makeRequest(router, "POST", "/api/articles/", articleData, token)
+	var createResponse map[string]interface{}
+	json.Unmarshal(createResp.Body.Bytes(), &createResponse)
+	asserts.Equal(float64(1), createResponse["article"].(map[string]interface{})["version"])
+
+	put := func(ifMatch string, article map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"article": article})
+		req, _ := http.NewRequest("PUT", "/api/articles/shared-draft", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", token))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	etag := makeRequest(router, "GET", "/api/articles/shared-draft", nil, token).Header().Get("ETag")
+	asserts.Equal(http.StatusPreconditionFailed, put(etag, map[string]interface{}{"body": "By ETag"}).Code,
+		"If-Match takes the version, not the ETag of the response")
+	makeRequest(router, "POST", "/api/articles/shared-draft/favorite", nil, token)
+
+	w := put(`"1"`, map[string]interface{}{"title": "Shared Draft", "body": "First editor"})
+	asserts.Equal(http.StatusOK, w.Code, "The current version should be accepted, whatever the favorites")
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(float64(2), response["article"].(map[string]interface{})["version"])
+	asserts.NotEqual(etag, w.Header().Get("ETag"))
+
+	w = put(`"1"`, map[string]interface{}{"title": "Shared Draft", "body": "Second editor"})
+	asserts.Equal(http.StatusPreconditionFailed, w.Code, "A stale version should be refused")
+	asserts.Equal(`{"errors":{"article":"has been modified since you read it","currentVersion":2}}`, w.Body.String())
+
+	w = put("", map[string]interface{}{"title": "Shared Draft", "body": "Second editor", "version": 1})
+	asserts.Equal(http.StatusPreconditionFailed, w.Code, "A stale version in the body should be refused")
+
+	w = put("", map[string]interface{}{"title": "Shared Draft", "body": "Second editor", "version": 2})
+	asserts.Equal(http.StatusOK, w.Code)
+
+	w = put("", map[string]interface{}{"title": "Shared Draft", "body": "Unconditional"})
+	asserts.Equal(http.StatusOK, w.Code, "Updates without a precondition should still work")
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(float64(4), response["article"].(map[string]interface{})["version"])
+}
+
 func TestDeleteArticleByAuthor(t *testing.T) {
 	asserts := assert.New(t)
 	setupTestDatabase()
@@ -765,8 +916,335 @@ func TestDeleteComment(t *testing.T) {
 	asserts.Equal(http.StatusOK, w.Code, "Should return 200 OK")
 }
 
+// ==============================================
+// Command Line Tests
+// ==============================================
+
+func runCLI(stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cli := &CLI{
+		Stdin:  strings.NewReader(stdin),
+		Stdout: &stdout,
+		Stderr: &stderr,
+		OpenDB: common.TestDBInit,
+	}
+	err := cli.Run(args)
+	return stdout.String(), err
+}
+
+func TestCLIUserCommands(t *testing.T) {
+	asserts := assert.New(t)
+	defer teardownTestDatabase()
+
+	out, err := runCLI("", "migrate")
+	asserts.NoError(err)
+	asserts.Equal("database migrated\n", out)
+
+	out, err = runCLI("secretpassword\n", "user", "create", "--username", "jake", "--email", "jake@jake.jake")
+	asserts.NoError(err)
+	asserts.Contains(out, "created user jake", "The password should be read from stdin")
+
+	_, err = runCLI("", "user", "create", "--username", "jake", "--email", "jake@jake.jake", "--password", "secretpassword")
+	asserts.EqualError(err, "email: has already been taken")
+
+	_, err = runCLI("", "user", "create", "--username", "a", "--email", "nope", "--password", "short")
+	asserts.Error(err)
+	asserts.Contains(err.Error(), "email: must be a valid email address")
+
+	out, err = runCLI("", "user", "promote", "--user", "jake@jake.jake", "--role", "moderator")
+	asserts.NoError(err)
+	asserts.Equal("user jake is now moderator\n", out)
+	// every command closes the database it opened
+	common.TestDBInit()
+	userModel, _ := users.FindUserByLogin("jake")
+	asserts.Equal(users.RoleModerator, userModel.Role)
+
+	_, err = runCLI("", "user", "promote", "--user", "jake", "--role", "king")
+	asserts.Error(err, "Unknown roles should be refused")
+
+	_, err = runCLI("", "user", "reset-password", "--user", "jake", "--password", "newpassword")
+	asserts.NoError(err)
+
+	out, err = runCLI("", "token", "issue", "--user", "jake")
+	asserts.NoError(err)
+	token := strings.TrimSpace(out)
+
+	common.TestDBInit()
+	router := setupRouter()
+	w := makeRequest(router, "GET", "/api/user/", nil, token)
+	asserts.Equal(http.StatusOK, w.Code, "An issued token should authenticate")
+
+	w = makeRequest(router, "POST", "/api/users/login", map[string]interface{}{
+		"user": map[string]string{"email": "jake@jake.jake", "password": "newpassword"},
+	}, "")
+	asserts.Equal(http.StatusOK, w.Code, "The reset password should be accepted")
+
+	_, err = runCLI("", "token", "issue", "--user", "nobody")
+	asserts.EqualError(err, `no user with username or email "nobody"`)
+
+	_, err = runCLI("", "frobnicate")
+	asserts.ErrorIs(err, errUnknownCommand)
+}
+
+func TestCLISeed(t *testing.T) {
+	asserts := assert.New(t)
+	defer teardownTestDatabase()
+
+	out, err := runCLI("", "seed", "--seed", "7", "--users", "5", "--articles", "12", "--comments", "2")
+	asserts.NoError(err)
+	asserts.Contains(out, "seeded 5 users")
+	asserts.Contains(out, "12 articles")
+
+	_, err = runCLI("", "seed", "--seed", "7", "--users", "5", "--articles", "12")
+	asserts.EqualError(err, "seed 7 is already loaded, pick another --seed")
+
+	common.TestDBInit()
+	router := setupRouter()
+	w := makeRequest(router, "GET", "/api/articles/?limit=100", nil, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(float64(12), response["articlesCount"])
+
+	demo, err := users.FindUserByLogin("demo@example.com")
+	asserts.NoError(err, "Seeding should create the demo user")
+	w = makeRequest(router, "GET", "/api/user/", nil, common.GenToken(demo.ID))
+	asserts.Equal(http.StatusOK, w.Code)
+}
+
 // Test main for integration tests
 func TestMain(m *testing.M) {
 	exitCode := m.Run()
 	os.Exit(exitCode)
 }
+
+func TestCachedReadsAreInvalidated(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDatabase()
+	defer teardownTestDatabase()
+	common.AppCache = common.NewLRUCache(100)
+	defer common.DisableCache()
+
+	router := setupRouter()
+	registerData := map[string]interface{}{
+		"user": map[string]interface{}{
+			"username": "cacheauthor",
+			"email":    "cache@example.com",
+			"password": "password123",
+		},
+	}
+	regResp := makeRequest(router, "POST", "/api/users/", registerData, "")
+	var regResponse map[string]interface{}
+	json.Unmarshal(regResp.Body.Bytes(), &regResponse)
+	token := regResponse["user"].(map[string]interface{})["token"].(string)
+
+	asserts.Equal(`{"tags":[]}`, makeRequest(router, "GET", "/api/tags/", nil, "").Body.String())
+
+	articleData := map[string]interface{}{
+		"article": map[string]interface{}{
+			"title":       "Cached Title",
+			"description": "Cached description",
+			"body":        "Cached body",
+			"tagList":     []string{"caching"},
+		},
+	}
+	createResp := makeRequest(router, "POST", "/api/articles/", articleData, token)
+	asserts.Equal(http.StatusCreated, createResp.Code)
+	asserts.Equal(`{"tags":["caching"]}`, makeRequest(router, "GET", "/api/tags/", nil, "").Body.String(),
+		"creating an article should drop the cached tags")
+
+	// read it once so the article and the profile are cached
+	asserts.Equal(http.StatusOK, makeRequest(router, "GET", "/api/articles/cached-title", nil, "").Code)
+	asserts.Equal(http.StatusOK, makeRequest(router, "GET", "/api/profiles/cacheauthor", nil, token).Code)
+
+	updateData := map[string]interface{}{"article": map[string]interface{}{"description": "Fresh description"}}
+	asserts.Equal(http.StatusOK, makeRequest(router, "PUT", "/api/articles/cached-title", updateData, token).Code)
+	var response map[string]interface{}
+	json.Unmarshal(makeRequest(router, "GET", "/api/articles/cached-title", nil, "").Body.Bytes(), &response)
+	asserts.Equal("Fresh description", response["article"].(map[string]interface{})["description"])
+
+	userData := map[string]interface{}{"user": map[string]interface{}{"bio": "Fresh bio"}}
+	asserts.Equal(http.StatusOK, makeRequest(router, "PUT", "/api/user/", userData, token).Code)
+	json.Unmarshal(makeRequest(router, "GET", "/api/profiles/cacheauthor", nil, token).Body.Bytes(), &response)
+	asserts.Equal("Fresh bio", response["profile"].(map[string]interface{})["bio"])
+	json.Unmarshal(makeRequest(router, "GET", "/api/articles/cached-title", nil, "").Body.Bytes(), &response)
+	asserts.Equal("Fresh bio", response["article"].(map[string]interface{})["author"].(map[string]interface{})["bio"],
+		"a profile change should drop the cached articles of its author")
+
+	asserts.Equal(http.StatusOK, makeRequest(router, "DELETE", "/api/articles/cached-title", nil, token).Code)
+	asserts.Equal(http.StatusNotFound, makeRequest(router, "GET", "/api/articles/cached-title", nil, "").Code)
+}
+
+func TestUploadedImagesAsAvatarAndInArticles(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDatabase()
+	defer teardownTestDatabase()
+
+	router := setupRouter()
+	uploader := &uploads.Uploader{Store: common.NewLocalBlobStore(t.TempDir()), MaxSize: 1 << 20}
+	uploads.UploadsAnonymousRegister(router.Group("/api/uploads"), uploader)
+	uploads.UploadsRegister(router.Group("/api/uploads", users.AuthMiddleware(true)), uploader)
+
+	registerData := map[string]interface{}{
+		"user": map[string]interface{}{
+			"username": "uploadauthor",
+			"email":    "upload@example.com",
+			"password": "password123",
+		},
+	}
+	regResp := makeRequest(router, "POST", "/api/users/", registerData, "")
+	var regResponse map[string]interface{}
+	json.Unmarshal(regResp.Body.Bytes(), &regResponse)
+	token := regResponse["user"].(map[string]interface{})["token"].(string)
+
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewGray(image.Rect(0, 0, 300, 300)))
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("kind", uploads.KindAvatar)
+	part, _ := form.CreateFormFile("file", "me.png")
+	part.Write(picture.Bytes())
+	form.Close()
+	req, _ := http.NewRequest("POST", "http://realworld.example/api/uploads/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(http.StatusCreated, w.Code, w.Body.String())
+	var uploadResponse struct{ Upload uploads.UploadResponse }
+	json.Unmarshal(w.Body.Bytes(), &uploadResponse)
+	asserts.True(strings.HasPrefix(uploadResponse.Upload.URL, "http://realworld.example/api/uploads/avatars/"))
+
+	// the URLs pass the url validation of image
+	userData := map[string]interface{}{"user": map[string]interface{}{"image": uploadResponse.Upload.ThumbnailURL}}
+	w = makeRequest(router, "PUT", "/api/user/", userData, token)
+	asserts.Equal(http.StatusOK, w.Code, w.Body.String())
+	asserts.Contains(w.Body.String(), uploadResponse.Upload.ThumbnailURL)
+
+	articleData := map[string]interface{}{
+		"article": map[string]interface{}{
+			"title": "With a Picture",
+			"body":  "Look: ![me](" + uploadResponse.Upload.URL + ")",
+		},
+	}
+	asserts.Equal(http.StatusCreated, makeRequest(router, "POST", "/api/articles/", articleData, token).Code)
+	var response map[string]interface{}
+	json.Unmarshal(makeRequest(router, "GET", "/api/articles/with-a-picture?render=html", nil, "").Body.Bytes(), &response)
+	asserts.Contains(response["article"].(map[string]interface{})["bodyHtml"], `<img src="`+uploadResponse.Upload.URL+`" alt="me">`)
+}
+
+func TestActivityNotifiesAuthors(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDatabase()
+	defer teardownTestDatabase()
+
+	router := setupRouter()
+	register := func(username string) string {
+		registerData := map[string]interface{}{
+			"user": map[string]interface{}{
+				"username": username,
+				"email":    username + "@example.com",
+				"password": "password123",
+			},
+		}
+		var response map[string]interface{}
+		json.Unmarshal(makeRequest(router, "POST", "/api/users/", registerData, "").Body.Bytes(), &response)
+		return response["user"].(map[string]interface{})["token"].(string)
+	}
+	author, reader := register("activityauthor"), register("activityreader")
+	inbox := func(token string) []interface{} {
+		var response map[string]interface{}
+		json.Unmarshal(makeRequest(router, "GET", "/api/notifications/", nil, token).Body.Bytes(), &response)
+		return response["notifications"].([]interface{})
+	}
+
+	articleData := map[string]interface{}{
+		"article": map[string]interface{}{"title": "Activity Title", "description": "Description", "body": "Body"},
+	}
+	asserts.Equal(http.StatusCreated, makeRequest(router, "POST", "/api/articles/", articleData, author).Code)
+	makeRequest(router, "POST", "/api/profiles/activityauthor/follow", nil, reader)
+	makeRequest(router, "POST", "/api/profiles/activityauthor/follow", nil, reader)
+	makeRequest(router, "POST", "/api/articles/activity-title/favorite", nil, reader)
+	commentData := map[string]interface{}{"comment": map[string]interface{}{"body": "Nice"}}
+	var commentResponse map[string]interface{}
+	json.Unmarshal(makeRequest(router, "POST", "/api/articles/activity-title/comments", commentData, reader).Body.Bytes(), &commentResponse)
+	replyData := map[string]interface{}{"comment": map[string]interface{}{
+		"body": "Thanks", "parentId": commentResponse["comment"].(map[string]interface{})["id"],
+	}}
+	asserts.Equal(http.StatusCreated, makeRequest(router, "POST", "/api/articles/activity-title/comments", replyData, author).Code)
+	events.NewDispatcher(common.GetDB()).DispatchDue()
+
+	var messages []string
+	for _, notification := range inbox(author) {
+		messages = append(messages, notification.(map[string]interface{})["message"].(string))
+	}
+	asserts.ElementsMatch([]string{
+		"activityreader followed you",
+		`activityreader favorited your article "Activity Title"`,
+		`activityreader commented on your article "Activity Title"`,
+	}, messages, "following twice is one follow, own replies are not notified")
+	readerInbox := inbox(reader)
+	asserts.Len(readerInbox, 1)
+	asserts.Equal(`activityauthor replied to your comment on "Activity Title"`, readerInbox[0].(map[string]interface{})["message"])
+}
+
+func TestRateLimitPerUserBehindOneIP(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDatabase()
+	defer teardownTestDatabase()
+
+	alice := users.UserModel{Username: "limitalice", Email: "limitalice@example.com", PasswordHash: "x"}
+	bob := users.UserModel{Username: "limitbob", Email: "limitbob@example.com", PasswordHash: "x"}
+	common.GetDB().Create(&alice)
+	common.GetDB().Create(&bob)
+
+	store := common.NewMemoryRateLimitStore()
+	router := gin.New()
+	router.Use(common.ErrorHandler())
+	v1 := apiGroup(router, func(policy string) gin.HandlerFunc {
+		return common.RateLimit(store, common.RateLimitPolicy{Name: policy, Burst: 1, Period: time.Hour})
+	})
+	articles.TagsAnonymousRegister(v1.Group("/tags"))
+
+	// every request comes from the same RemoteAddr, as behind a NAT or a proxy
+	aliceToken, bobToken := common.GenToken(alice.ID), common.GenToken(bob.ID)
+	asserts.Equal(http.StatusOK, makeRequest(router, "GET", "/api/tags/", nil, aliceToken).Code)
+	asserts.Equal(http.StatusTooManyRequests, makeRequest(router, "GET", "/api/tags/", nil, aliceToken).Code)
+	asserts.Equal(http.StatusOK, makeRequest(router, "GET", "/api/tags/", nil, bobToken).Code, "Each user should have a bucket of their own")
+	asserts.Equal(http.StatusOK, makeRequest(router, "GET", "/api/tags/", nil, "").Code, "Anonymous requests should use the bucket of the IP")
+	asserts.Equal(http.StatusTooManyRequests, makeRequest(router, "GET", "/api/tags/", nil, "").Code)
+}
+
+func TestRateLimitIgnoresUntrustedForwardedFor(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDatabase()
+	defer teardownTestDatabase()
+
+	request := func(router *gin.Engine, forwardedFor string) int {
+		req, _ := http.NewRequest("GET", "/api/tags/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	engine := func(trustedProxies []string) *gin.Engine {
+		router, err := newEngine(trustedProxies)
+		asserts.NoError(err)
+		store := common.NewMemoryRateLimitStore()
+		v1 := apiGroup(router, func(policy string) gin.HandlerFunc {
+			return common.RateLimit(store, common.RateLimitPolicy{Name: policy, Burst: 1, Period: time.Hour})
+		})
+		articles.TagsAnonymousRegister(v1.Group("/tags"))
+		return router
+	}
+
+	router := engine(nil)
+	asserts.Equal(http.StatusOK, request(router, "203.0.113.1"))
+	asserts.Equal(http.StatusTooManyRequests, request(router, "203.0.113.2"), "A spoofed X-Forwarded-For should share the bucket of the caller")
+
+	router = engine([]string{"192.0.2.1"})
+	asserts.Equal(http.StatusOK, request(router, "203.0.113.1"))
+	asserts.Equal(http.StatusOK, request(router, "203.0.113.2"), "Behind a trusted proxy every client should have a bucket of their own")
+	asserts.Equal(http.StatusTooManyRequests, request(router, "203.0.113.2"))
+}
@@ -0,0 +1,247 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+)
+
+// Where a job is at. A job that succeeds is deleted, there is no status for it.
+const (
+	JobQueued  = "queued"  // waiting for RunAt, which is in the future for delayed jobs and retries
+	JobRunning = "running" // claimed by a worker until LockedUntil
+	JobDead    = "dead"    // failed MaxAttempts times or for good, kept until an admin retries it
+)
+
+// A unit of work to run outside of the request that asked for it. Payload is the JSON of the
+// payload of its Type.
+type JobModel struct {
+	gorm.Model
+	Type        string     `gorm:"size:64;not null;index:idx_job_due"`
+	Payload     string     `gorm:"type:text;not null"`
+	Status      string     `gorm:"size:16;not null;index:idx_job_due"`
+	RunAt       time.Time  `gorm:"not null;index:idx_job_due"`
+	Attempts    int        `gorm:"not null;default:0"`
+	MaxAttempts int        `gorm:"not null"`
+	LockedUntil *time.Time // a running job still running past it was abandoned by its worker
+	LastError   string     `gorm:"size:2048"`
+}
+
+// How the jobs of a type are run. The zero value of a field takes the one of DefaultOptions.
+type Options struct {
+	MaxAttempts int           // runs before the job is dead, 1 for no retry
+	Backoff     time.Duration // wait after the first failure, doubled after each of the next
+	MaxBackoff  time.Duration // the longest wait between two runs
+	Timeout     time.Duration // the context of a run is cancelled after it
+	Concurrency int           // jobs of the type a worker runs at once
+}
+
+var DefaultOptions = Options{
+	MaxAttempts: 5,
+	Backoff:     30 * time.Second,
+	MaxBackoff:  6 * time.Hour,
+	Timeout:     time.Minute,
+	Concurrency: 4,
+}
+
+// The wait before the next run of a job whose attempt-th run failed.
+func (o Options) RetryDelay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := o.Backoff
+	for i := 1; i < attempt && delay < o.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if o.MaxBackoff > 0 && delay > o.MaxBackoff {
+		delay = o.MaxBackoff
+	}
+	return delay
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = DefaultOptions.MaxAttempts
+	}
+	if o.Backoff == 0 {
+		o.Backoff = DefaultOptions.Backoff
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = DefaultOptions.MaxBackoff
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultOptions.Timeout
+	}
+	if o.Concurrency == 0 {
+		o.Concurrency = DefaultOptions.Concurrency
+	}
+	return o
+}
+
+// A kind of job, whose payload is a T. Define one per kind as a package variable, and enqueue it
+// in the transaction of the change it follows from, so it runs if and only if that commits:
+//
+//	var sendWelcome = jobs.Define("users.welcome", jobs.Options{MaxAttempts: 3}, func(ctx context.Context, p welcome) error {...})
+//	err := sendWelcome.EnqueueTx(tx, welcome{UserID: u.ID})
+type Type[T any] struct {
+	Name    string
+	Options Options
+	handle  func(ctx context.Context, payload T) error
+}
+
+// What the worker needs of a Type, whatever its payload.
+type definition interface {
+	options() Options
+	run(ctx context.Context, payload string) error
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]definition{}
+)
+
+// Define the type of job name, handled by handle. Defining a name twice panics.
+func Define[T any](name string, options Options, handle func(ctx context.Context, payload T) error) *Type[T] {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("jobs: " + name + " is defined twice")
+	}
+	t := &Type[T]{Name: name, Options: options.withDefaults(), handle: handle}
+	registry[name] = t
+	return t
+}
+
+func (t *Type[T]) options() Options {
+	return t.Options
+}
+
+func (t *Type[T]) run(ctx context.Context, payload string) error {
+	var p T
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		return Permanent(fmt.Errorf("cannot decode payload: %w", err))
+	}
+	return t.handle(ctx, p)
+}
+
+// Queue a job to run as soon as a worker is free.
+func (t *Type[T]) EnqueueTx(tx *gorm.DB, payload T) (JobModel, error) {
+	return t.ScheduleTx(tx, payload, time.Now())
+}
+
+// Queue a job to run at runAt, or as soon as possible after.
+func (t *Type[T]) ScheduleTx(tx *gorm.DB, payload T, runAt time.Time) (JobModel, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return JobModel{}, err
+	}
+	job := JobModel{
+		Type:        t.Name,
+		Payload:     string(data),
+		Status:      JobQueued,
+		RunAt:       runAt,
+		MaxAttempts: t.Options.MaxAttempts,
+	}
+	if err := tx.Create(&job).Error; err != nil {
+		return job, err
+	}
+	common.AfterCommit(tx, Wake)
+	return job, nil
+}
+
+// Returned by a handler, err kills the job at once: running it again would fail the same way.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func isPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+// The job a handler is running, see CurrentJob.
+type Info struct {
+	ID          uint
+	Attempt     int // 1 on the first run
+	MaxAttempts int
+	RetryDelay  time.Duration // before the next run, if this one fails and is not the last
+}
+
+// Whether the job is dead if this run fails.
+func (i Info) LastAttempt() bool {
+	return i.Attempt >= i.MaxAttempts
+}
+
+type infoKey struct{}
+
+// The job run with ctx, the zero Info outside of a job.
+func CurrentJob(ctx context.Context) Info {
+	info, _ := ctx.Value(infoKey{}).(Info)
+	return info
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&JobModel{})
+}
+
+// A page of the jobs with status, of jobType unless it is empty, oldest first, and how many there are in all.
+func findJobsTx(db *gorm.DB, status, jobType, limit, offset string) ([]JobModel, int, error) {
+	offsetInt, err := strconv.Atoi(offset)
+	if err != nil {
+		offsetInt = 0
+	}
+	limitInt, err := strconv.Atoi(limit)
+	if err != nil {
+		limitInt = 20
+	}
+	query := db.Model(&JobModel{}).Where("status = ?", status)
+	if jobType != "" {
+		query = query.Where("type = ?", jobType)
+	}
+	var count int
+	if err := query.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	var jobs []JobModel
+	err = query.Order("id").Offset(offsetInt).Limit(limitInt).Find(&jobs).Error
+	return jobs, count, err
+}
+
+// Returned by retryTx for a job that is not dead.
+var ErrNotDead = errors.New("is not dead")
+
+// Queue a dead job again, with all its attempts.
+func retryTx(tx *gorm.DB, id string) (JobModel, error) {
+	var job JobModel
+	jobID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return job, gorm.ErrRecordNotFound
+	}
+	if err := tx.First(&job, jobID).Error; err != nil {
+		return job, err
+	}
+	if job.Status != JobDead {
+		return job, ErrNotDead
+	}
+	err = tx.Model(&job).Updates(map[string]interface{}{"status": JobQueued, "run_at": time.Now(), "attempts": 0}).Error
+	if err != nil {
+		return job, err
+	}
+	common.AfterCommit(tx, Wake)
+	return job, nil
+}
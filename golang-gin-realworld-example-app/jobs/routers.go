@@ -0,0 +1,70 @@
+package jobs
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// Admins only: the queue tells about everyone.
+func JobsRegister(router *gin.RouterGroup) {
+	router.Use(requireAdmin)
+	router.GET("/", JobList)
+	router.POST("/:id/retry", JobRetry)
+}
+
+func requireAdmin(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if myUserModel.Role != users.RoleAdmin {
+		common.AbortWithError(c, common.NewForbiddenError("jobs", errors.New("are only shown to admins")))
+		return
+	}
+	c.Next()
+}
+
+// The dead jobs, or those of ?status=queued|running, of ?type= if given, paged with ?limit= and ?offset=.
+func JobList(c *gin.Context) {
+	status := c.DefaultQuery("status", JobDead)
+	switch status {
+	case JobQueued, JobRunning, JobDead:
+	default:
+		common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "status",
+			errors.New("must be queued, running or dead")))
+		return
+	}
+	jobModels, count, err := findJobsTx(common.GetRequestDB(c), status, c.Query("type"), c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := JobsSerializer{c, jobModels}
+	c.JSON(http.StatusOK, gin.H{"jobs": serializer.Response(), "jobsCount": count})
+}
+
+// Queue a dead job again, once the cause of its failures is fixed.
+func JobRetry(c *gin.Context) {
+	var jobModel JobModel
+	err := common.Transaction(func(tx *gorm.DB) error {
+		var err error
+		jobModel, err = retryTx(tx, c.Param("id"))
+		return err
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		common.AbortWithError(c, common.NewNotFoundError("job", errors.New("Invalid id")))
+		return
+	}
+	if errors.Is(err, ErrNotDead) {
+		common.AbortWithError(c, common.NewAppError(http.StatusConflict, common.ErrorCodeConflict, "job", err))
+		return
+	}
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := JobSerializer{c, jobModel}
+	c.JSON(http.StatusAccepted, gin.H{"job": serializer.Response()})
+}
@@ -0,0 +1,58 @@
+package jobs
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JobResponse struct {
+	ID          uint            `json:"id"`
+	Type        string          `json:"type"`
+	Status      string          `json:"status"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	RunAt       string          `json:"runAt"`
+	LastError   *string         `json:"lastError"`
+	CreatedAt   string          `json:"createdAt"`
+	UpdatedAt   string          `json:"updatedAt"`
+}
+
+type JobSerializer struct {
+	C *gin.Context
+	JobModel
+}
+
+func (s *JobSerializer) Response() JobResponse {
+	response := JobResponse{
+		ID:          s.ID,
+		Type:        s.Type,
+		Status:      s.Status,
+		Payload:     json.RawMessage(s.Payload),
+		Attempts:    s.Attempts,
+		MaxAttempts: s.MaxAttempts,
+		RunAt:       s.RunAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		CreatedAt:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		UpdatedAt:   s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+	if s.LastError != "" {
+		lastError := s.LastError
+		response.LastError = &lastError
+	}
+	return response
+}
+
+type JobsSerializer struct {
+	C    *gin.Context
+	Jobs []JobModel
+}
+
+func (s *JobsSerializer) Response() []JobResponse {
+	response := []JobResponse{}
+	for _, job := range s.Jobs {
+		serializer := JobSerializer{s.C, job}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
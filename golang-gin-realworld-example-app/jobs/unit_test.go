@@ -0,0 +1,256 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	AutoMigrate()
+}
+
+func teardownTestDB() {
+	common.TestDBFree(test_db)
+}
+
+type testPayload struct {
+	Name string `json:"name"`
+	Fail int    `json:"fail"` // runs failing before one succeeds
+}
+
+var (
+	testMu   sync.Mutex
+	testRuns = map[string][]Info{}
+	release  = make(chan struct{})
+)
+
+func ran(name string) []Info {
+	testMu.Lock()
+	defer testMu.Unlock()
+	return testRuns[name]
+}
+
+var flakyJob = Define("test.flaky", Options{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Concurrency: 8},
+	func(ctx context.Context, p testPayload) error {
+		testMu.Lock()
+		testRuns[p.Name] = append(testRuns[p.Name], CurrentJob(ctx))
+		runs := len(testRuns[p.Name])
+		testMu.Unlock()
+		switch {
+		case p.Fail < 0:
+			return Permanent(errors.New("cannot ever work"))
+		case p.Name == "panics":
+			panic("boom")
+		case runs <= p.Fail:
+			return fmt.Errorf("failure %d", runs)
+		}
+		return nil
+	})
+
+var slowJob = Define("test.slow", Options{Concurrency: 2}, func(ctx context.Context, p testPayload) error {
+	<-release
+	return nil
+})
+
+func enqueue(asserts *assert.Assertions, payload testPayload) JobModel {
+	var job JobModel
+	asserts.NoError(common.Transaction(func(tx *gorm.DB) error {
+		var err error
+		job, err = flakyJob.EnqueueTx(tx, payload)
+		return err
+	}))
+	return job
+}
+
+func run(worker *Worker) int {
+	time.Sleep(2 * time.Millisecond) // past the backoff of the failed runs
+	started := worker.RunDue()
+	worker.Wait()
+	return started
+}
+
+func TestWorker(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+	worker := NewWorker(test_db)
+	testMu.Lock()
+	testRuns = map[string][]Info{}
+	testMu.Unlock()
+
+	works := enqueue(asserts, testPayload{Name: "works"})
+	retried := enqueue(asserts, testPayload{Name: "retried", Fail: 2})
+	dead := enqueue(asserts, testPayload{Name: "dead", Fail: 5})
+	permanent := enqueue(asserts, testPayload{Name: "permanent", Fail: -1})
+	enqueue(asserts, testPayload{Name: "panics"})
+	common.Transaction(func(tx *gorm.DB) error {
+		flakyJob.EnqueueTx(tx, testPayload{Name: "rolled back"})
+		return errors.New("rollback")
+	})
+	var later JobModel
+	common.Transaction(func(tx *gorm.DB) error {
+		var err error
+		later, err = flakyJob.ScheduleTx(tx, testPayload{Name: "later"}, time.Now().Add(time.Hour))
+		return err
+	})
+
+	asserts.Equal(5, run(worker), "neither the rolled back nor the scheduled job")
+	asserts.Len(ran("works"), 1)
+	asserts.Equal(Info{ID: works.ID, Attempt: 1, MaxAttempts: 3, RetryDelay: time.Millisecond}, ran("works")[0])
+	asserts.Empty(ran("rolled back"))
+	asserts.Equal(3, run(worker), "the failed ones again, not the permanent failure")
+	asserts.Equal(3, run(worker))
+	asserts.Equal(0, run(worker))
+	asserts.Len(ran("retried"), 3)
+	asserts.Equal(3, ran("retried")[2].Attempt)
+	asserts.True(ran("retried")[2].LastAttempt())
+	asserts.Len(ran("dead"), 3)
+	asserts.Len(ran("permanent"), 1)
+	asserts.Len(ran("later"), 0)
+
+	var jobs []JobModel
+	test_db.Order("id").Find(&jobs)
+	asserts.Len(jobs, 4, "jobs that succeed are deleted")
+	asserts.Equal(JobDead, jobs[0].Status)
+	asserts.Equal(dead.ID, jobs[0].ID)
+	asserts.Equal("failure 3", jobs[0].LastError)
+	asserts.Equal(permanent.ID, jobs[1].ID)
+	asserts.Equal(1, jobs[1].Attempts)
+	asserts.Equal("panic: boom", jobs[2].LastError)
+	asserts.Equal(later.ID, jobs[3].ID)
+	asserts.Equal(JobQueued, jobs[3].Status)
+	asserts.NotEqual(retried.ID, jobs[0].ID)
+
+	// a job left running by a worker that died is run again once its lock has expired
+	test_db.Model(&later).UpdateColumns(map[string]interface{}{"status": JobRunning, "attempts": 1, "locked_until": time.Now().Add(-time.Second)})
+	asserts.Equal(1, run(worker))
+	asserts.Len(ran("later"), 1)
+	asserts.Equal(2, ran("later")[0].Attempt)
+}
+
+func TestWorkerConcurrency(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+	worker := NewWorker(test_db)
+	for i := 0; i < 3; i++ {
+		common.Transaction(func(tx *gorm.DB) error {
+			_, err := slowJob.EnqueueTx(tx, testPayload{})
+			return err
+		})
+	}
+	asserts.Equal(2, worker.RunDue())
+	asserts.Equal(0, worker.RunDue(), "both slots are taken")
+	release <- struct{}{}
+	release <- struct{}{}
+	worker.Wait()
+	asserts.Equal(1, worker.RunDue())
+	release <- struct{}{}
+	worker.Wait()
+
+	// a run that outlived its lock leaves the job to the worker that claimed it again
+	var job JobModel
+	asserts.NoError(common.Transaction(func(tx *gorm.DB) error {
+		var err error
+		job, err = slowJob.EnqueueTx(tx, testPayload{})
+		return err
+	}))
+	asserts.Equal(1, worker.RunDue())
+	test_db.Model(&job).UpdateColumn("attempts", 2)
+	release <- struct{}{}
+	worker.Wait()
+	asserts.NoError(test_db.First(&job, job.ID).Error, "not deleted by the stale run")
+	asserts.Equal(JobRunning, job.Status)
+	asserts.Equal(2, job.Attempts)
+	test_db.Unscoped().Delete(&job)
+
+	// Run returns once the running jobs are done
+	common.Transaction(func(tx *gorm.DB) error {
+		_, err := slowJob.EnqueueTx(tx, testPayload{})
+		return err
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(stopped)
+	}()
+	release <- struct{}{} // the job is running
+	cancel()
+	<-stopped
+	var count int
+	test_db.Model(&JobModel{}).Count(&count)
+	asserts.Equal(0, count)
+}
+
+func TestJobRoutes(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(common.ErrorHandler())
+	JobsRegister(r.Group("/api/jobs", users.AuthMiddleware(true)))
+
+	admin := users.UserModel{Username: "jobadmin", Email: "jobadmin@example.com", PasswordHash: "x", Role: users.RoleAdmin}
+	test_db.Create(&admin)
+	user := users.UserModel{Username: "jobuser", Email: "jobuser@example.com", PasswordHash: "x"}
+	test_db.Create(&user)
+	as := func(userModel users.UserModel, method, path string) (int, gin.H) {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(""))
+		req.Header.Set("Authorization", "Token "+common.GenToken(userModel.ID))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var response gin.H
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	job := enqueue(asserts, testPayload{Name: "routes", Fail: -1})
+	queued := enqueue(asserts, testPayload{Name: "queued"})
+	test_db.Model(&job).UpdateColumns(map[string]interface{}{"status": JobDead, "attempts": 1, "last_error": "cannot ever work"})
+
+	code, _ := as(user, "GET", "/api/jobs/")
+	asserts.Equal(http.StatusForbidden, code)
+	code, response := as(admin, "GET", "/api/jobs/")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(float64(1), response["jobsCount"], "the dead jobs by default")
+	listed := response["jobs"].([]interface{})[0].(map[string]interface{})
+	asserts.Equal("test.flaky", listed["type"])
+	asserts.Equal("cannot ever work", listed["lastError"])
+	asserts.Equal(map[string]interface{}{"name": "routes", "fail": float64(-1)}, listed["payload"])
+	code, response = as(admin, "GET", "/api/jobs/?status=queued&type=test.flaky")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(float64(1), response["jobsCount"])
+	code, _ = as(admin, "GET", "/api/jobs/?status=done")
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+
+	code, response = as(admin, "POST", fmt.Sprintf("/api/jobs/%d/retry", job.ID))
+	asserts.Equal(http.StatusAccepted, code)
+	asserts.Equal(JobQueued, response["job"].(map[string]interface{})["status"])
+	asserts.Equal(float64(0), response["job"].(map[string]interface{})["attempts"])
+	code, _ = as(admin, "POST", fmt.Sprintf("/api/jobs/%d/retry", queued.ID))
+	asserts.Equal(http.StatusConflict, code)
+	code, _ = as(admin, "POST", "/api/jobs/999/retry")
+	asserts.Equal(http.StatusNotFound, code)
+	code, _ = as(user, "POST", fmt.Sprintf("/api/jobs/%d/retry", job.ID))
+	asserts.Equal(http.StatusForbidden, code)
+}
@@ -0,0 +1,194 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+)
+
+// Worker runs the due jobs of every defined type, at most Options.Concurrency of each at once.
+// Jobs are claimed before they run, so any number of workers, in serve or in their own
+// processes, can share the database. A worker dying in the middle of a job leaves it to be run
+// again once its Timeout has passed.
+//
+//	worker := jobs.NewWorker(db)
+//	go worker.Run(ctx)
+type Worker struct {
+	DB           *gorm.DB
+	PollInterval time.Duration
+
+	mu      sync.Mutex
+	running map[string]int
+	wg      sync.WaitGroup
+}
+
+func NewWorker(db *gorm.DB) *Worker {
+	return &Worker{DB: db, PollInterval: time.Second, running: map[string]int{}}
+}
+
+// Jobs enqueued by this process, and jobs finishing, wake its workers up rather than waiting for the next poll.
+var wake = make(chan struct{}, 1)
+
+func Wake() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run due jobs every PollInterval, and whenever Wake is called, until ctx is done. The jobs running
+// then are left to finish, within their Timeout, before Run returns.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		w.RunDue()
+		select {
+		case <-ctx.Done():
+			w.Wait()
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// Wait for the jobs started by RunDue.
+func (w *Worker) Wait() {
+	w.wg.Wait()
+}
+
+// Start the jobs that are due, as many as the concurrency of their types allows, and return how
+// many were started.
+func (w *Worker) RunDue() int {
+	registryMu.RLock()
+	types := make(map[string]definition, len(registry))
+	for name, d := range registry {
+		types[name] = d
+	}
+	registryMu.RUnlock()
+
+	started := 0
+	for name, d := range types {
+		options := d.options()
+		w.mu.Lock()
+		free := options.Concurrency - w.running[name]
+		w.mu.Unlock()
+		if free <= 0 {
+			continue
+		}
+		now := time.Now()
+		var due []JobModel
+		err := w.DB.Where("type = ? AND ((status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?))",
+			name, JobQueued, now, JobRunning, now).Order("run_at, id").Limit(free).Find(&due).Error
+		if err != nil {
+			common.Logger.Error("jobs: cannot read the queue", "type", name, "error", err)
+			continue
+		}
+		for _, job := range due {
+			if !w.claim(&job, options) {
+				continue
+			}
+			w.mu.Lock()
+			w.running[name]++
+			w.mu.Unlock()
+			w.wg.Add(1)
+			go w.execute(job, d)
+			started++
+		}
+	}
+	return started
+}
+
+// Count the run and lock the job for its Timeout, unless another worker did first.
+func (w *Worker) claim(job *JobModel, options Options) bool {
+	lockedUntil := time.Now().Add(options.Timeout)
+	result := w.DB.Model(&JobModel{}).
+		Where("id = ? AND status = ? AND attempts = ?", job.ID, job.Status, job.Attempts).
+		UpdateColumns(map[string]interface{}{"status": JobRunning, "attempts": job.Attempts + 1, "locked_until": lockedUntil})
+	if result.Error != nil {
+		common.Logger.Error("jobs: cannot claim job", "job", job.ID, "error", result.Error)
+		return false
+	}
+	job.Attempts++
+	return result.RowsAffected == 1
+}
+
+func (w *Worker) execute(job JobModel, d definition) {
+	options := d.options()
+	defer func() {
+		w.mu.Lock()
+		w.running[job.Type]--
+		w.mu.Unlock()
+		w.wg.Done()
+		// a slot is free
+		Wake()
+	}()
+
+	var err error
+	if job.Attempts > job.MaxAttempts {
+		// claimed again after a worker gave up on its last run
+		err = fmt.Errorf("abandoned after %s", options.Timeout)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+		ctx = context.WithValue(ctx, infoKey{}, Info{
+			ID:          job.ID,
+			Attempt:     job.Attempts,
+			MaxAttempts: job.MaxAttempts,
+			RetryDelay:  options.RetryDelay(job.Attempts),
+		})
+		err = runHandler(ctx, d, job.Payload)
+		cancel()
+	}
+	w.finish(job, options, err)
+}
+
+// Run the handler, turning a panic into an error of the job.
+func runHandler(ctx context.Context, d definition, payload string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return d.run(ctx, payload)
+}
+
+// Delete the job if it succeeded, queue it again if it can be retried, bury it otherwise. Only
+// while the job is still this run's: once its lock expired another worker may have claimed it.
+func (w *Worker) finish(job JobModel, options Options, err error) {
+	ours := w.DB.Where("attempts = ? AND status = ?", job.Attempts, JobRunning)
+	var result *gorm.DB
+	switch {
+	case err == nil:
+		common.JobsProcessedTotal.WithLabelValues(job.Type, "success").Inc()
+		result = ours.Unscoped().Delete(&job)
+	case isPermanent(err) || job.Attempts >= job.MaxAttempts:
+		common.JobsProcessedTotal.WithLabelValues(job.Type, "dead").Inc()
+		common.Logger.Warn("jobs: job is dead", "job", job.ID, "type", job.Type, "attempts", job.Attempts, "error", err)
+		result = ours.Model(&job).Updates(map[string]interface{}{
+			"status": JobDead, "locked_until": nil, "last_error": truncate(err.Error()),
+		})
+	default:
+		common.JobsProcessedTotal.WithLabelValues(job.Type, "retry").Inc()
+		result = ours.Model(&job).Updates(map[string]interface{}{
+			"status": JobQueued, "locked_until": nil, "last_error": truncate(err.Error()),
+			"run_at": time.Now().Add(options.RetryDelay(job.Attempts)),
+		})
+	}
+	if result.Error != nil {
+		common.Logger.Error("jobs: cannot save job", "job", job.ID, "error", result.Error)
+	} else if result.RowsAffected == 0 {
+		common.Logger.Warn("jobs: job was claimed again before its run finished", "job", job.ID, "type", job.Type, "attempts", job.Attempts)
+	}
+}
+
+func truncate(message string) string {
+	if len(message) > 2048 {
+		return message[:2048]
+	}
+	return message
+}
@@ -0,0 +1,181 @@
+package notifications
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+	"realworld-backend/events"
+)
+
+// What a notification is about, its Kind.
+const (
+	KindFavorite = "favorite" // someone favorited the recipient's article
+	KindComment  = "comment"  // someone commented on the recipient's article
+	KindReply    = "reply"    // someone replied to the recipient's comment
+	KindFollow   = "follow"   // someone followed the recipient
+)
+
+// A notification tells its recipient about one or more activities of the same kind, see
+// notifyTx. ArticleID is 0 for follows.
+type NotificationModel struct {
+	gorm.Model
+	RecipientID uint   `gorm:"index;not null"`
+	Kind        string `gorm:"size:32;not null"`
+	ArticleID   uint   `gorm:"not null;default:0"`
+	CommentID   uint   `gorm:"not null;default:0"` // the latest comment or reply
+	LastActorID uint   `gorm:"not null"`
+	ActorsCount int    `gorm:"not null;default:1"`
+	ReadAt      *time.Time
+}
+
+// The users who did what a notification is about, once each however often they did it.
+type NotificationActorModel struct {
+	ID             uint `gorm:"primary_key"`
+	NotificationID uint `gorm:"unique_index:idx_notification_actor;not null"`
+	ActorID        uint `gorm:"unique_index:idx_notification_actor;not null"`
+}
+
+// An unread notification of the same kind, about the same article, absorbs the activities that
+// follow it for this long: a burst of favorites becomes "12 people favorited your article".
+const CoalesceWindow = 24 * time.Hour
+
+func init() {
+	events.Subscribe("notifications", handleEvent)
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&NotificationModel{})
+	db.AutoMigrate(&NotificationActorModel{})
+}
+
+// What an actor did that concerns the recipient. ArticleID and CommentID are 0 when they do not apply.
+type activity struct {
+	Kind        string
+	ActorID     uint
+	RecipientID uint
+	ArticleID   uint
+	CommentID   uint
+}
+
+// Notify authors of favorites and comments, the authors of comments of replies and users of
+// their new followers. The other events notify nobody.
+func handleEvent(tx *gorm.DB, envelope events.Envelope) error {
+	switch event := envelope.Event.(type) {
+	case events.ArticleFavorited:
+		return notifyTx(tx, activity{KindFavorite, event.UserID, event.AuthorID, event.ArticleID, 0})
+	case events.CommentCreated:
+		if event.ParentID != 0 {
+			return notifyTx(tx, activity{KindReply, event.AuthorID, event.ParentAuthorID, event.ArticleID, event.CommentID})
+		}
+		return notifyTx(tx, activity{KindComment, event.AuthorID, event.ArticleAuthorID, event.ArticleID, event.CommentID})
+	case events.UserFollowed:
+		return notifyTx(tx, activity{KindFollow, event.FollowerID, event.UserID, 0, 0})
+	}
+	return nil
+}
+
+// Notify the recipient of activity, folding it into a recent unread notification when there is one.
+// Nobody is notified of their own activity.
+func notifyTx(tx *gorm.DB, activity activity) error {
+	if activity.RecipientID == activity.ActorID {
+		return nil
+	}
+	var notification NotificationModel
+	err := tx.Where("recipient_id = ? AND kind = ? AND article_id = ? AND read_at IS NULL AND updated_at > ?",
+		activity.RecipientID, activity.Kind, activity.ArticleID, time.Now().Add(-CoalesceWindow)).
+		Order("id desc").First(&notification).Error
+	if gorm.IsRecordNotFoundError(err) {
+		notification = NotificationModel{
+			RecipientID: activity.RecipientID,
+			Kind:        activity.Kind,
+			ArticleID:   activity.ArticleID,
+			CommentID:   activity.CommentID,
+			LastActorID: activity.ActorID,
+			ActorsCount: 1,
+		}
+		if err := tx.Create(&notification).Error; err != nil {
+			return err
+		}
+		common.AfterCommit(tx, func() { publish(notification.ID) })
+		return tx.Create(&NotificationActorModel{NotificationID: notification.ID, ActorID: activity.ActorID}).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	actor := NotificationActorModel{NotificationID: notification.ID, ActorID: activity.ActorID}
+	err = tx.Where(actor).First(&NotificationActorModel{}).Error
+	newActor := gorm.IsRecordNotFoundError(err)
+	if err != nil && !newActor {
+		return err
+	}
+	if newActor {
+		if err := tx.Create(&actor).Error; err != nil {
+			return err
+		}
+	}
+	changes := map[string]interface{}{"last_actor_id": activity.ActorID, "comment_id": activity.CommentID}
+	if newActor {
+		changes["actors_count"] = gorm.Expr("actors_count + 1")
+	}
+	common.AfterCommit(tx, func() { publish(notification.ID) })
+	// Updates bumps updated_at, which moves the notification back to the top of the list
+	return tx.Model(&notification).Updates(changes).Error
+}
+
+// A page of the notifications of recipient, most recently active first, and how many there are in all.
+func findNotificationsTx(db *gorm.DB, recipientID uint, unreadOnly bool, limit, offset string) ([]NotificationModel, int, error) {
+	offsetInt, err := strconv.Atoi(offset)
+	if err != nil {
+		offsetInt = 0
+	}
+	limitInt, err := strconv.Atoi(limit)
+	if err != nil {
+		limitInt = 20
+	}
+	query := db.Model(&NotificationModel{}).Where("recipient_id = ?", recipientID)
+	if unreadOnly {
+		query = query.Where("read_at IS NULL")
+	}
+	var count int
+	if err := query.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	var models []NotificationModel
+	err = query.Order("updated_at desc, id desc").Offset(offsetInt).Limit(limitInt).Find(&models).Error
+	return models, count, err
+}
+
+func unreadCountTx(db *gorm.DB, recipientID uint) (int, error) {
+	var count int
+	err := db.Model(&NotificationModel{}).Where("recipient_id = ? AND read_at IS NULL", recipientID).Count(&count).Error
+	return count, err
+}
+
+// Mark one notification of recipient as read, gorm.ErrRecordNotFound when recipient has no such notification.
+func markReadTx(tx *gorm.DB, recipientID, id uint) (NotificationModel, error) {
+	var notification NotificationModel
+	if err := tx.Where("id = ? AND recipient_id = ?", id, recipientID).First(&notification).Error; err != nil {
+		return notification, err
+	}
+	if notification.ReadAt != nil {
+		return notification, nil
+	}
+	now := time.Now()
+	// UpdateColumn, reading does not make the notification more recent
+	err := tx.Model(&notification).UpdateColumn("read_at", now).Error
+	notification.ReadAt = &now
+	return notification, err
+}
+
+// Mark every notification of recipient as read and return how many were unread.
+func markAllReadTx(tx *gorm.DB, recipientID uint) (int64, error) {
+	result := tx.Model(&NotificationModel{}).Where("recipient_id = ? AND read_at IS NULL", recipientID).
+		UpdateColumn("read_at", time.Now())
+	return result.RowsAffected, result.Error
+}
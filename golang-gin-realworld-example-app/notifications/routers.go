@@ -0,0 +1,75 @@
+package notifications
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+func NotificationsRegister(router *gin.RouterGroup) {
+	router.GET("/", NotificationList)
+	router.POST("/read", NotificationReadAll)
+	router.POST("/:id/read", NotificationRead)
+}
+
+// The notifications of the caller, ?unread=true for the unread ones only, paged with ?limit= and ?offset=.
+func NotificationList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	db := common.GetRequestDB(c)
+	notificationModels, count, err := findNotificationsTx(db, myUserModel.ID, c.Query("unread") == "true", c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	unread, err := unreadCountTx(db, myUserModel.ID)
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := NotificationsSerializer{c, notificationModels}
+	c.JSON(http.StatusOK, gin.H{"notifications": serializer.Response(), "notificationsCount": count, "unreadCount": unread})
+}
+
+func NotificationRead(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		common.AbortWithError(c, common.NewNotFoundError("notification", errors.New("Invalid id")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	var notificationModel NotificationModel
+	err = common.Transaction(func(tx *gorm.DB) error {
+		notificationModel, err = markReadTx(tx, myUserModel.ID, uint(id))
+		return err
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		common.AbortWithError(c, common.NewNotFoundError("notification", errors.New("Invalid id")))
+		return
+	}
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := NotificationsSerializer{c, []NotificationModel{notificationModel}}
+	c.JSON(http.StatusOK, gin.H{"notification": serializer.Response()[0]})
+}
+
+func NotificationReadAll(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	var marked int64
+	err := common.Transaction(func(tx *gorm.DB) error {
+		var err error
+		marked, err = markAllReadTx(tx, myUserModel.ID)
+		return err
+	})
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"marked": marked, "unreadCount": 0})
+}
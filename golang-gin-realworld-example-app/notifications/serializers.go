@@ -0,0 +1,132 @@
+package notifications
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+type NotificationsSerializer struct {
+	C             *gin.Context
+	Notifications []NotificationModel
+}
+
+type NotificationArticleResponse struct {
+	Slug  string `json:"slug"`
+	Title string `json:"title"`
+}
+
+type NotificationResponse struct {
+	ID          uint                         `json:"id"`
+	Kind        string                       `json:"kind"`
+	Message     string                       `json:"message"`
+	Actor       *users.ProfileResponse       `json:"actor"`
+	ActorsCount int                          `json:"actorsCount"`
+	Article     *NotificationArticleResponse `json:"article"`
+	CommentID   *uint                        `json:"commentId"`
+	Read        bool                         `json:"read"`
+	CreatedAt   string                       `json:"createdAt"`
+	UpdatedAt   string                       `json:"updatedAt"`
+}
+
+// The latest actors and the articles of all the notifications are read at once.
+func (s *NotificationsSerializer) Response() []NotificationResponse {
+	db := common.GetRequestDB(s.C)
+	var actorIDs, articleIDs []uint
+	for _, notification := range s.Notifications {
+		actorIDs = append(actorIDs, notification.LastActorID)
+		if notification.ArticleID != 0 {
+			articleIDs = append(articleIDs, notification.ArticleID)
+		}
+	}
+	var actorModels []users.UserModel
+	if len(actorIDs) > 0 {
+		db.Where("id IN (?)", actorIDs).Find(&actorModels)
+	}
+	profilesSerializer := users.ProfilesSerializer{C: s.C, Users: actorModels}
+	actors := map[uint]users.ProfileResponse{}
+	for _, profile := range profilesSerializer.Response() {
+		actors[profile.ID] = profile
+	}
+	var articleModels []articles.ArticleModel
+	if len(articleIDs) > 0 {
+		db.Select("id, slug, title").Where("id IN (?)", articleIDs).Find(&articleModels)
+	}
+	articleResponses := map[uint]NotificationArticleResponse{}
+	for _, article := range articleModels {
+		articleResponses[article.ID] = NotificationArticleResponse{Slug: article.Slug, Title: article.Title}
+	}
+
+	response := []NotificationResponse{}
+	for _, notification := range s.Notifications {
+		item := NotificationResponse{
+			ID:          notification.ID,
+			Kind:        notification.Kind,
+			ActorsCount: notification.ActorsCount,
+			Read:        notification.ReadAt != nil,
+			CreatedAt:   notification.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			UpdatedAt:   notification.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		}
+		// a deleted user or article leaves them null
+		if actor, ok := actors[notification.LastActorID]; ok {
+			item.Actor = &actor
+		}
+		if article, ok := articleResponses[notification.ArticleID]; ok {
+			item.Article = &article
+		}
+		if notification.CommentID != 0 {
+			commentID := notification.CommentID
+			item.CommentID = &commentID
+		}
+		item.Message = message(item)
+		response = append(response, item)
+	}
+	return response
+}
+
+// Send the notification, as GET /api/notifications lists it, to the streams of its recipient.
+func publish(id uint) {
+	db := common.GetDB()
+	var notification NotificationModel
+	var recipient users.UserModel
+	if err := db.First(&notification, id).Error; err != nil {
+		common.Logger.Error("notifications: cannot publish", "id", id, "error", err)
+		return
+	}
+	db.First(&recipient, notification.RecipientID)
+	unread, _ := unreadCountTx(db, recipient.ID)
+	// the serializer reads the caller from a context, outside of a request it is the recipient
+	c := &gin.Context{}
+	c.Set("my_user_model", recipient)
+	serializer := NotificationsSerializer{c, []NotificationModel{notification}}
+	common.GetHub().Publish(common.TopicNotifications(recipient.ID), "notification",
+		gin.H{"notification": serializer.Response()[0], "unreadCount": unread})
+}
+
+// "alice favorited your article "Title"", or "12 people favorited your article "Title"".
+func message(notification NotificationResponse) string {
+	who := "Someone"
+	if notification.ActorsCount > 1 {
+		who = fmt.Sprintf("%d people", notification.ActorsCount)
+	} else if notification.Actor != nil {
+		who = notification.Actor.Username
+	}
+	article := "an article"
+	if notification.Article != nil {
+		article = fmt.Sprintf("%q", notification.Article.Title)
+	}
+	switch notification.Kind {
+	case KindFavorite:
+		return fmt.Sprintf("%s favorited your article %s", who, article)
+	case KindComment:
+		return fmt.Sprintf("%s commented on your article %s", who, article)
+	case KindReply:
+		return fmt.Sprintf("%s replied to your comment on %s", who, article)
+	case KindFollow:
+		return fmt.Sprintf("%s followed you", who)
+	}
+	return who + " did something"
+}
@@ -0,0 +1,155 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/events"
+	"realworld-backend/users"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	events.AutoMigrate()
+	AutoMigrate()
+}
+
+func teardownTestDB() {
+	common.TestDBFree(test_db)
+}
+
+func createTestUser(username string) users.UserModel {
+	userModel := users.UserModel{Username: username, Email: username + "@example.com", PasswordHash: "x"}
+	test_db.Create(&userModel)
+	return userModel
+}
+
+// Publish event and dispatch it, notifying as the dispatcher of a worker would.
+func record(asserts *assert.Assertions, event events.Event) {
+	asserts.NoError(common.Transaction(func(tx *gorm.DB) error {
+		return events.PublishTx(tx, event)
+	}))
+	asserts.Equal(1, events.NewDispatcher(test_db).DispatchDue())
+}
+
+func TestNotificationsCoalesce(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	author := createTestUser("notified")
+	favorite := func(actor users.UserModel, articleID uint) {
+		record(asserts, events.ArticleFavorited{ArticleID: articleID, AuthorID: author.ID, UserID: actor.ID})
+	}
+	var fans []users.UserModel
+	for i := 0; i < 12; i++ {
+		fans = append(fans, createTestUser(fmt.Sprintf("fan%d", i)))
+		favorite(fans[i], 1)
+	}
+	favorite(fans[0], 1)
+	favorite(author, 1)
+	favorite(fans[0], 2)
+
+	var notifications []NotificationModel
+	test_db.Order("id").Find(&notifications)
+	asserts.Len(notifications, 2, "favorites of one article coalesce, own favorites are not notified")
+	asserts.Equal(12, notifications[0].ActorsCount, "a fan favoriting again is counted once")
+	asserts.Equal(fans[0].ID, notifications[0].LastActorID)
+	asserts.Equal(1, notifications[1].ActorsCount)
+
+	// read or old notifications take no more activity
+	test_db.Model(&notifications[0]).UpdateColumn("read_at", time.Now())
+	test_db.Model(&notifications[1]).UpdateColumn("updated_at", time.Now().Add(-CoalesceWindow-time.Minute))
+	favorite(fans[1], 1)
+	favorite(fans[1], 2)
+	var count int
+	test_db.Model(&NotificationModel{}).Count(&count)
+	asserts.Equal(4, count)
+}
+
+func TestNotificationRoutes(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	me := createTestUser("inbox")
+	other := createTestUser("otherinbox")
+	alice := createTestUser("alice")
+	bob := createTestUser("bob")
+	articleModel := articles.ArticleModel{Slug: "inbox-article", Title: "Inbox Article"}
+	test_db.Create(&articleModel)
+	record(asserts, events.UserFollowed{UserID: me.ID, FollowerID: alice.ID})
+	record(asserts, events.CommentCreated{CommentID: 7, ArticleID: articleModel.ID, ArticleAuthorID: me.ID, AuthorID: alice.ID})
+	record(asserts, events.CommentCreated{CommentID: 8, ArticleID: articleModel.ID, ArticleAuthorID: me.ID, AuthorID: bob.ID})
+	record(asserts, events.UserFollowed{UserID: other.ID, FollowerID: alice.ID})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(common.ErrorHandler())
+	var user users.UserModel
+	NotificationsRegister(router.Group("/api/notifications", func(c *gin.Context) {
+		c.Set("my_user_model", user)
+	}))
+	type list struct {
+		Notifications      []NotificationResponse
+		NotificationsCount int
+		UnreadCount        int
+	}
+	request := func(as users.UserModel, method, path string, response interface{}) int {
+		user = as
+		req, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		json.Unmarshal(w.Body.Bytes(), response)
+		return w.Code
+	}
+
+	var inbox list
+	asserts.Equal(http.StatusOK, request(me, "GET", "/api/notifications/", &inbox))
+	asserts.Equal(2, inbox.NotificationsCount)
+	asserts.Equal(2, inbox.UnreadCount)
+	latest := inbox.Notifications[0]
+	asserts.Equal(KindComment, latest.Kind, "the most recently active first")
+	asserts.Equal(`2 people commented on your article "Inbox Article"`, latest.Message)
+	asserts.Equal("bob", latest.Actor.Username)
+	asserts.Equal("inbox-article", latest.Article.Slug)
+	asserts.Equal(uint(8), *latest.CommentID)
+	asserts.Equal("alice followed you", inbox.Notifications[1].Message)
+	asserts.Nil(inbox.Notifications[1].Article)
+
+	asserts.Equal(http.StatusOK, request(me, "GET", "/api/notifications/?limit=1&offset=1", &inbox))
+	asserts.Len(inbox.Notifications, 1)
+	asserts.Equal(KindFollow, inbox.Notifications[0].Kind)
+
+	var read struct{ Notification NotificationResponse }
+	path := fmt.Sprintf("/api/notifications/%d/read", latest.ID)
+	asserts.Equal(http.StatusNotFound, request(other, "POST", path, &read), "only the recipient can read it")
+	asserts.Equal(http.StatusOK, request(me, "POST", path, &read))
+	asserts.True(read.Notification.Read)
+	asserts.Equal(http.StatusOK, request(me, "GET", "/api/notifications/?unread=true", &inbox))
+	asserts.Equal(1, inbox.NotificationsCount)
+	asserts.Equal(1, inbox.UnreadCount)
+	asserts.Equal(KindFollow, inbox.Notifications[0].Kind)
+
+	var marked struct{ Marked int }
+	asserts.Equal(http.StatusOK, request(me, "POST", "/api/notifications/read", &marked))
+	asserts.Equal(1, marked.Marked)
+	request(me, "GET", "/api/notifications/", &inbox)
+	asserts.Equal(2, inbox.NotificationsCount)
+	asserts.Equal(0, inbox.UnreadCount)
+	request(other, "GET", "/api/notifications/", &inbox)
+	asserts.Equal(1, inbox.UnreadCount, "marking all read only touches the caller's notifications")
+}
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// A comment line is sent this often when there is nothing else to send, so proxies keep the
+// connection open and clients notice a dead one.
+var HeartbeatInterval = 15 * time.Second
+
+// How long clients wait before reconnecting, sent as the retry field.
+const RetryInterval = 3 * time.Second
+
+// How many articles one stream can follow the comments of.
+const MaxArticles = 50
+
+// Register on a group behind AuthMiddleware(true). Browsers cannot set headers on an EventSource,
+// so the token can also be passed as ?access_token=, see users.MyAuth2Extractor.
+func StreamRegister(router *gin.RouterGroup) {
+	router.GET("", StreamEvents)
+}
+
+// Server-Sent Events: the notifications of the caller, the new articles of the users they follow
+// and the new comments of the articles listed in ?articles=slug1,slug2. A client reconnecting with
+// Last-Event-ID gets what it missed, or a "reset" event when that is no longer known and it should reload.
+func StreamEvents(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	topics := []string{common.TopicNotifications(myUserModel.ID)}
+	// the users followed when connecting, reconnecting picks up later follows
+	for _, followed := range myUserModel.GetFollowingsTx(common.GetRequestDB(c)) {
+		topics = append(topics, common.TopicFeed(followed.ID))
+	}
+	if list := c.Query("articles"); list != "" {
+		slugs := strings.Split(list, ",")
+		if len(slugs) > MaxArticles {
+			common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "articles",
+				fmt.Errorf("can list at most %d articles", MaxArticles)))
+			return
+		}
+		for _, slug := range slugs {
+			articleModel, err := articles.FindOneArticle(&articles.ArticleModel{Slug: slug})
+			if err != nil {
+				common.AbortWithError(c, common.NewNotFoundError("articles", errors.New("Invalid slug "+slug)))
+				return
+			}
+			topics = append(topics, common.TopicArticleComments(articleModel.ID))
+		}
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	hub := common.GetHub()
+	sub, missed, resumed := hub.Subscribe(topics, lastEventID)
+	defer hub.Unsubscribe(sub)
+
+	// the write timeout of the server is meant for ordinary responses, not for this one
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	fmt.Fprintf(w, "retry: %d\n\n", RetryInterval.Milliseconds())
+	if !resumed {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				// dropped for falling behind, or shutting down: the client reconnects
+				return
+			}
+			writeEvent(w, event)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		w.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event common.HubEvent) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
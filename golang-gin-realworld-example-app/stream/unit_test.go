@@ -0,0 +1,187 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/events"
+	"realworld-backend/notifications"
+	"realworld-backend/users"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	events.AutoMigrate()
+	notifications.AutoMigrate()
+}
+
+func teardownTestDB() {
+	common.TestDBFree(test_db)
+}
+
+func setupRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(common.ErrorHandler())
+	v1 := r.Group("/api", users.AuthMiddleware(true))
+	StreamRegister(v1.Group("/stream"))
+	articles.ArticlesRegister(v1.Group("/articles"))
+	return r
+}
+
+func createTestUser(username string) users.UserModel {
+	userModel := users.UserModel{Username: username, Email: username + "@example.com", PasswordHash: "x"}
+	test_db.Create(&userModel)
+	return userModel
+}
+
+// One block of the stream: its fields, or "comment" for a comment line.
+type sseBlock map[string]string
+
+type sseClient struct {
+	cancel func()
+	lines  chan string
+	status int
+}
+
+func connect(t *testing.T, server *httptest.Server, path, lastEventID string) *sseClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+path, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &sseClient{cancel: cancel, lines: make(chan string), status: resp.StatusCode}
+	go func() {
+		defer resp.Body.Close()
+		defer close(client.lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			client.lines <- scanner.Text()
+		}
+	}()
+	return client
+}
+
+func (client *sseClient) next(t *testing.T) sseBlock {
+	block := sseBlock{}
+	for {
+		select {
+		case line, ok := <-client.lines:
+			if !ok {
+				return block
+			}
+			if line == "" {
+				if len(block) > 0 {
+					return block
+				}
+				continue
+			}
+			field, value, _ := strings.Cut(line, ":")
+			if field == "" {
+				field = "comment"
+			}
+			block[field] = strings.TrimPrefix(value, " ")
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event in time")
+			return nil
+		}
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+	common.AppHub = common.NewHub(common.DefaultHubHistory)
+	defer func() { common.AppHub = common.NewHub(common.DefaultHubHistory) }()
+
+	me := createTestUser("streamreader")
+	author := createTestUser("streamauthor")
+	test_db.Create(&users.FollowModel{FollowingID: author.ID, FollowedByID: me.ID})
+	authorArticle := articles.ArticleModel{Slug: "streamed", Title: "Streamed", Author: articles.GetArticleUserModel(author)}
+	test_db.Create(&authorArticle)
+	myArticle := articles.ArticleModel{Slug: "mine", Title: "Mine", Author: articles.GetArticleUserModel(me)}
+	test_db.Create(&myArticle)
+
+	router := setupRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+	token := common.GenToken(me.ID)
+	as := func(user users.UserModel, method, path, body string) int {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Token "+common.GenToken(user.ID))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	asserts.Equal(http.StatusUnauthorized, connect(t, server, "/api/stream", "").status)
+	asserts.Equal(http.StatusNotFound, connect(t, server, "/api/stream?articles=nope&access_token="+token, "").status)
+
+	client := connect(t, server, "/api/stream?articles=streamed&access_token="+token, "")
+	asserts.Equal(http.StatusOK, client.status)
+	asserts.Equal("3000", client.next(t)["retry"])
+
+	asserts.Equal(http.StatusCreated, as(author, "POST", "/api/articles/streamed/comments", `{"comment":{"body":"Live"}}`))
+	comment := client.next(t)
+	asserts.Equal("comment", comment["event"])
+	asserts.Contains(comment["data"], `"body":"Live"`)
+	asserts.NotEmpty(comment["id"])
+
+	asserts.Equal(http.StatusCreated, as(author, "POST", "/api/articles/", `{"article":{"title":"Fresh Post","body":"Body"}}`))
+	article := client.next(t)
+	asserts.Equal("article", article["event"], "new articles of followed users")
+	asserts.Contains(article["data"], `"slug":"fresh-post"`)
+	asserts.Contains(article["data"], `"author":{"username":"streamauthor"`)
+	asserts.NotContains(article["data"], `"favorited"`, "nothing seen from the author")
+	asserts.NotContains(article["data"], `"following"`)
+
+	asserts.Equal(http.StatusOK, as(author, "POST", "/api/articles/mine/favorite", ""))
+	events.NewDispatcher(test_db).DispatchDue()
+	notification := client.next(t)
+	asserts.Equal("notification", notification["event"])
+	asserts.Contains(notification["data"], `streamauthor favorited your article \"Mine\"`)
+	asserts.Contains(notification["data"], `"unreadCount":1`)
+	client.cancel()
+
+	// resuming replays what came after the last event received
+	client = connect(t, server, "/api/stream?articles=streamed&access_token="+token, comment["id"])
+	client.next(t)
+	asserts.Equal(article["id"], client.next(t)["id"])
+	asserts.Equal(notification["id"], client.next(t)["id"])
+	client.cancel()
+
+	client = connect(t, server, "/api/stream?access_token="+token, "0-0")
+	client.next(t)
+	asserts.Equal("reset", client.next(t)["event"], "an unknown id asks the client to reload")
+	client.cancel()
+
+	HeartbeatInterval = 20 * time.Millisecond
+	defer func() { HeartbeatInterval = 15 * time.Second }()
+	client = connect(t, server, "/api/stream?access_token="+token, "")
+	client.next(t)
+	asserts.Equal("heartbeat", client.next(t)["comment"])
+	common.GetHub().Close()
+	for range client.lines {
+	}
+	client.cancel()
+}
@@ -0,0 +1,78 @@
+package uploads
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// The types accepted, recognized from the first bytes of the file and never from what the
+// client claims, with the extension their key gets.
+var allowedTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// Avatars must be decoded to make the thumbnail, which the standard library does for these.
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// The side of avatar thumbnails, in pixels.
+const ThumbnailSize = 256
+
+// Images with more pixels are refused before they are decoded: a small file can
+// claim a huge canvas and exhaust the memory.
+const MaxImagePixels = 40000000
+
+var errImageTooLarge = errors.New("image has too many pixels")
+
+// The type of data as sniffed by http.DetectContentType, without parameters.
+func sniffContentType(data []byte) string {
+	contentType, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	return contentType
+}
+
+// A ThumbnailSize square PNG of the center of the image.
+func makeThumbnail(data []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > MaxImagePixels {
+		return nil, errImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	crop := image.Rect(x, y, x+side, y+side)
+
+	dst := image.NewRGBA(image.Rect(0, 0, ThumbnailSize, ThumbnailSize))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	var thumbnail bytes.Buffer
+	if err := png.Encode(&thumbnail, dst); err != nil {
+		return nil, err
+	}
+	return thumbnail.Bytes(), nil
+}
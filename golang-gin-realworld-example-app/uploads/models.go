@@ -0,0 +1,39 @@
+package uploads
+
+import (
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// What an upload is for: an avatar gets a square thumbnail, an attachment is kept as is.
+const (
+	KindAvatar     = "avatar"
+	KindAttachment = "attachment"
+)
+
+// The record of a stored file. The blob itself lives in the BlobStore under Key, the thumbnail
+// of an avatar under ThumbnailKey.
+type UploadModel struct {
+	gorm.Model
+	Key          string `gorm:"unique_index;size:255;not null"`
+	ThumbnailKey string `gorm:"size:255"`
+	Kind         string `gorm:"size:32;not null"`
+	ContentType  string `gorm:"size:100;not null"`
+	Size         int64  `gorm:"not null"`
+	Filename     string `gorm:"size:255"`
+	Owner        users.UserModel
+	OwnerID      uint `gorm:"index"`
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&UploadModel{})
+}
+
+func saveOneTx(tx *gorm.DB, data interface{}) error {
+	err := tx.Save(data).Error
+	return err
+}
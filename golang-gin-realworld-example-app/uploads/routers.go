@@ -0,0 +1,216 @@
+package uploads
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// Uploader stores the files posted to UploadCreate in Store and serves them back.
+// Files are served by UploadRetrieve unless PublicURL is set, e.g. to the bucket or a CDN in front of it.
+//
+//	uploader := &uploads.Uploader{Store: common.NewLocalBlobStore("./data/uploads"), MaxSize: 5 << 20}
+type Uploader struct {
+	Store     common.BlobStore
+	MaxSize   int64
+	PublicURL string
+}
+
+// The multipart envelope around the file: boundaries, headers and the other fields.
+const multipartOverhead = 64 << 10
+
+func UploadsRegister(router *gin.RouterGroup, uploader *Uploader) {
+	router.POST("/", uploader.UploadCreate)
+}
+
+func UploadsAnonymousRegister(router *gin.RouterGroup, uploader *Uploader) {
+	router.GET("/*key", uploader.UploadRetrieve)
+}
+
+// The absolute URL of a stored key, usable as a user image and in article Markdown.
+func (u *Uploader) url(c *gin.Context, key string) string {
+	if u.PublicURL != "" {
+		return u.PublicURL + "/" + key
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	// served under the path files are posted to, see UploadsAnonymousRegister
+	base := strings.TrimSuffix(strings.TrimSuffix(c.FullPath(), "*key"), "/")
+	return scheme + "://" + c.Request.Host + base + "/" + key
+}
+
+// "avatars/2024/05/<32 random hex digits>.png": random so keys cannot be guessed and never collide.
+func newKey(kind, ext string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return kind + "s/" + time.Now().UTC().Format("2006/01") + "/" + hex.EncodeToString(random) + ext, nil
+}
+
+// The name the client gave the file, without its directories and cut to fit the column.
+func filename(name string) string {
+	name = filepath.Base(name)
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+func (u *Uploader) tooLargeError() *common.AppError {
+	return common.NewAppError(http.StatusRequestEntityTooLarge, common.ErrorCodePayloadTooLarge, "file",
+		fmt.Errorf("must be at most %d bytes", u.MaxSize))
+}
+
+// POST a multipart form with the file in "file" and its use in "kind", avatar or attachment
+// (the default). The type is sniffed from the content; avatars also get a square thumbnail.
+func (u *Uploader) UploadCreate(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, u.MaxSize+multipartOverhead)
+	fileHeader, err := c.FormFile("file")
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		common.AbortWithError(c, u.tooLargeError())
+		return
+	}
+	if err != nil {
+		common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "file",
+			errors.New("is required, as the \"file\" field of a multipart form")))
+		return
+	}
+	kind := c.DefaultPostForm("kind", KindAttachment)
+	if kind != KindAvatar && kind != KindAttachment {
+		common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "kind",
+			fmt.Errorf("must be %s or %s", KindAvatar, KindAttachment)))
+		return
+	}
+	if fileHeader.Size > u.MaxSize {
+		common.AbortWithError(c, u.tooLargeError())
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		common.AbortWithError(c, err)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, u.MaxSize+1))
+	if err != nil {
+		common.AbortWithError(c, err)
+		return
+	}
+	if int64(len(data)) > u.MaxSize {
+		common.AbortWithError(c, u.tooLargeError())
+		return
+	}
+	if len(data) == 0 {
+		common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "file",
+			errors.New("is empty")))
+		return
+	}
+
+	contentType := sniffContentType(data)
+	ext, ok := allowedTypes[contentType]
+	if !ok || kind == KindAvatar && !avatarTypes[contentType] {
+		common.AbortWithError(c, common.NewAppError(http.StatusUnsupportedMediaType, common.ErrorCodeUnsupportedMedia, "file",
+			fmt.Errorf("of type %s is not accepted as %s", contentType, kind)))
+		return
+	}
+
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	uploadModel := UploadModel{
+		Kind:        kind,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Filename:    filename(fileHeader.Filename),
+		OwnerID:     myUserModel.ID,
+	}
+	if uploadModel.Key, err = newKey(kind, ext); err != nil {
+		common.AbortWithError(c, err)
+		return
+	}
+
+	var thumbnail []byte
+	if kind == KindAvatar {
+		thumbnail, err = makeThumbnail(data)
+		if err != nil {
+			common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "file",
+				fmt.Errorf("is not a usable image: %v", err)))
+			return
+		}
+		uploadModel.ThumbnailKey = strings.TrimSuffix(uploadModel.Key, ext) + "_thumb.png"
+	}
+
+	ctx := c.Request.Context()
+	if err := u.Store.Put(ctx, uploadModel.Key, data, contentType); err != nil {
+		common.AbortWithError(c, err)
+		return
+	}
+	if thumbnail != nil {
+		if err := u.Store.Put(ctx, uploadModel.ThumbnailKey, thumbnail, "image/png"); err != nil {
+			u.Store.Delete(ctx, uploadModel.Key)
+			common.AbortWithError(c, err)
+			return
+		}
+	}
+	err = common.Transaction(func(tx *gorm.DB) error {
+		return saveOneTx(tx, &uploadModel)
+	})
+	if err != nil {
+		// without its record nobody can find the blob again
+		u.Store.Delete(ctx, uploadModel.Key)
+		if thumbnail != nil {
+			u.Store.Delete(ctx, uploadModel.ThumbnailKey)
+		}
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	common.LoggerFrom(c).Info("upload stored", "key", uploadModel.Key, "kind", kind, "content_type", contentType, "size", uploadModel.Size)
+	serializer := UploadSerializer{c, u, uploadModel}
+	c.JSON(http.StatusCreated, gin.H{"upload": serializer.Response()})
+}
+
+// Serve a stored file. Keys are never reused, so it may be cached for good.
+func (u *Uploader) UploadRetrieve(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !common.ValidBlobKey(key) {
+		common.AbortWithError(c, common.NewNotFoundError("upload", errors.New("Invalid key")))
+		return
+	}
+	body, info, err := u.Store.Get(c.Request.Context(), key)
+	if errors.Is(err, common.ErrBlobNotFound) {
+		common.AbortWithError(c, common.NewNotFoundError("upload", errors.New("Invalid key")))
+		return
+	}
+	if err != nil {
+		common.AbortWithError(c, err)
+		return
+	}
+	defer body.Close()
+	c.Header("Content-Type", info.ContentType)
+	if info.Size >= 0 {
+		c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	// only the types we sniffed are stored, a browser must not guess another one
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, body); err != nil {
+		common.LoggerFrom(c).Warn("upload: serving interrupted", "key", key, "error", err)
+	}
+}
@@ -0,0 +1,34 @@
+package uploads
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+type UploadSerializer struct {
+	C        *gin.Context
+	Uploader *Uploader
+	UploadModel
+}
+
+type UploadResponse struct {
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	Kind         string `json:"kind"`
+	ContentType  string `json:"contentType"`
+	Size         int64  `json:"size"`
+	Filename     string `json:"filename"`
+}
+
+func (s *UploadSerializer) Response() UploadResponse {
+	response := UploadResponse{
+		URL:         s.Uploader.url(s.C, s.Key),
+		Kind:        s.Kind,
+		ContentType: s.ContentType,
+		Size:        s.Size,
+		Filename:    s.Filename,
+	}
+	if s.ThumbnailKey != "" {
+		response.ThumbnailURL = s.Uploader.url(s.C, s.ThumbnailKey)
+	}
+	return response
+}
@@ -0,0 +1,153 @@
+package uploads
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	AutoMigrate()
+}
+
+func teardownTestDB() {
+	common.TestDBFree(test_db)
+}
+
+func setupRouter(uploader *Uploader) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(common.ErrorHandler())
+	userModel := users.UserModel{ID: 1, Username: "uploader"}
+	group := r.Group("/api/uploads", func(c *gin.Context) {
+		c.Set("my_user_model", userModel)
+	})
+	UploadsAnonymousRegister(group, uploader)
+	UploadsRegister(group, uploader)
+	return r
+}
+
+func testPNG(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func postFile(router *gin.Engine, kind, name string, data []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if kind != "" {
+		form.WriteField("kind", kind)
+	}
+	if data != nil {
+		part, _ := form.CreateFormFile("file", name)
+		part.Write(data)
+	}
+	form.Close()
+	req, _ := http.NewRequest("POST", "http://example.com/api/uploads/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	// problem responses carry the error code
+	req.Header.Set("Accept", common.ProblemJSONContentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadAvatar(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	router := setupRouter(&Uploader{Store: common.NewLocalBlobStore(t.TempDir()), MaxSize: 1 << 20})
+	w := postFile(router, KindAvatar, "../../me.png", testPNG(600, 400))
+	asserts.Equal(http.StatusCreated, w.Code, w.Body.String())
+
+	var response struct{ Upload UploadResponse }
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal("image/png", response.Upload.ContentType)
+	asserts.Equal("me.png", response.Upload.Filename)
+	asserts.Regexp(`^http://example.com/api/uploads/avatars/\d{4}/\d{2}/[0-9a-f]{32}\.png$`, response.Upload.URL)
+	asserts.Equal(strings.TrimSuffix(response.Upload.URL, ".png")+"_thumb.png", response.Upload.ThumbnailURL)
+
+	var uploadModel UploadModel
+	asserts.NoError(test_db.Where(UploadModel{OwnerID: 1}).First(&uploadModel).Error)
+	asserts.Equal(KindAvatar, uploadModel.Kind)
+
+	req, _ := http.NewRequest("GET", strings.TrimPrefix(response.Upload.ThumbnailURL, "http://example.com"), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("image/png", w.Header().Get("Content-Type"))
+	asserts.Equal("nosniff", w.Header().Get("X-Content-Type-Options"))
+	thumbnail, err := png.Decode(w.Body)
+	asserts.NoError(err)
+	asserts.Equal(image.Rect(0, 0, ThumbnailSize, ThumbnailSize), thumbnail.Bounds())
+
+	for _, path := range []string{"/api/uploads/avatars/2024/01/missing.png", "/api/uploads/../gorm_test.db", "/api/uploads/%2e%2e/x.png"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		asserts.Equal(http.StatusNotFound, w.Code, path)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+
+	router := setupRouter(&Uploader{Store: common.NewLocalBlobStore(t.TempDir()), MaxSize: 1024})
+	pdf := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\n")
+
+	w := postFile(router, "", "doc.pdf", pdf)
+	asserts.Equal(http.StatusCreated, w.Code, "a pdf attachment should be accepted")
+
+	cases := []struct {
+		kind, name string
+		data       []byte
+		status     int
+		code       common.ErrorCode
+	}{
+		{KindAttachment, "big.png", append(testPNG(4, 4), make([]byte, 2048)...), http.StatusRequestEntityTooLarge, common.ErrorCodePayloadTooLarge},
+		{KindAttachment, "huge.png", append(testPNG(4, 4), make([]byte, 200<<10)...), http.StatusRequestEntityTooLarge, common.ErrorCodePayloadTooLarge},
+		{KindAttachment, "page.png", []byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType, common.ErrorCodeUnsupportedMedia},
+		{KindAvatar, "doc.png", pdf, http.StatusUnsupportedMediaType, common.ErrorCodeUnsupportedMedia},
+		{"banner", "a.png", testPNG(4, 4), http.StatusUnprocessableEntity, common.ErrorCodeValidation},
+		{KindAttachment, "", nil, http.StatusUnprocessableEntity, common.ErrorCodeValidation},
+		{KindAvatar, "broken.png", testPNG(4, 4)[:60], http.StatusUnprocessableEntity, common.ErrorCodeValidation},
+	}
+	for _, tc := range cases {
+		w := postFile(router, tc.kind, tc.name, tc.data)
+		asserts.Equal(tc.status, w.Code, tc.name)
+		var response struct{ Code common.ErrorCode }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		asserts.Equal(tc.code, response.Code, tc.name)
+	}
+
+	var count int
+	test_db.Model(&UploadModel{}).Count(&count)
+	asserts.Equal(1, count, "refused files should not be recorded")
+}
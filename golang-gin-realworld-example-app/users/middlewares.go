@@ -5,7 +5,6 @@ import (
 	"github.com/golang-jwt/jwt/v4/request"
 	"realworld-backend/common"
 	"github.com/gin-gonic/gin"
-	"net/http"
 	"strings"
 )
 
@@ -21,8 +20,8 @@ func stripBearerPrefixFromTokenString(tok string) (string, error) {
 // Extract  token from Authorization header
 // Uses PostExtractionFilter to strip "TOKEN " prefix from header
 var AuthorizationHeaderExtractor = &request.PostExtractionFilter{
-	request.HeaderExtractor{"Authorization"},
-	stripBearerPrefixFromTokenString,
+	Extractor: request.HeaderExtractor{"Authorization"},
+	Filter:    stripBearerPrefixFromTokenString,
 }
 
 // Extractor for OAuth2 access tokens.  Looks in 'Authorization'
@@ -36,11 +35,11 @@ var MyAuth2Extractor = &request.MultiExtractor{
 func UpdateContextUserModel(c *gin.Context, my_user_id uint) {
 	var myUserModel UserModel
 	if my_user_id != 0 {
-		db := common.GetDB()
-		db.First(&myUserModel, my_user_id)
+		common.GetRequestDB(c).First(&myUserModel, my_user_id)
 	}
 	c.Set("my_user_id", my_user_id)
 	c.Set("my_user_model", myUserModel)
+	common.SetLoggerUserID(c, my_user_id)
 }
 
 // You can custom middlewares yourself as the doc: https://github.com/gin-gonic/gin#custom-middleware
@@ -54,7 +53,7 @@ func AuthMiddleware(auto401 bool) gin.HandlerFunc {
 		})
 		if err != nil {
 			if auto401 {
-				c.AbortWithError(http.StatusUnauthorized, err)
+				common.AbortWithError(c, common.NewUnauthorizedError("auth", err))
 			}
 			return
 		}
@@ -2,7 +2,10 @@ package users
 
 import (
 	"errors"
+	"fmt"
 	"realworld-backend/common"
+	"realworld-backend/events"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"golang.org/x/crypto/bcrypt"
@@ -20,6 +23,29 @@ type UserModel struct {
 	Bio          string  `gorm:"column:bio;size:1024"`
 	Image        *string `gorm:"column:image"`
 	PasswordHash string  `gorm:"column:password;not null"`
+	Role         string  `gorm:"column:role;size:32;not null;default:'user'"`
+}
+
+// Roles a user can have, everyone registers as RoleUser and only the command line promotes.
+//
+//	go run . user promote --user jake --role moderator
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+func IsValidRole(role string) bool {
+	switch role {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// Moderators and admins may look into what other users wrote, e.g. the edit history of comments.
+func (u UserModel) IsModerator() bool {
+	return u.Role == RoleModerator || u.Role == RoleAdmin
 }
 
 // A hack way to save ManyToMany relationship,
@@ -65,6 +91,28 @@ func (u *UserModel) SetPassword(password string) error {
 	return nil
 }
 
+// Replace the password, held to the same length rules as registration, and save it.
+//
+//	err := userModel.ResetPassword("newpassword")
+func (u *UserModel) ResetPassword(password string) error {
+	if len(password) < 8 || len(password) > 255 {
+		return errors.New("password must be 8 to 255 characters long")
+	}
+	if err := u.SetPassword(password); err != nil {
+		return err
+	}
+	return u.Update(UserModel{PasswordHash: u.PasswordHash})
+}
+
+// Give the user one of RoleUser, RoleModerator or RoleAdmin and save it.
+func (u *UserModel) SetRole(role string) error {
+	if !IsValidRole(role) {
+		return fmt.Errorf("unknown role %q, use %s, %s or %s", role, RoleUser, RoleModerator, RoleAdmin)
+	}
+	u.Role = role
+	return u.Update(UserModel{Role: role})
+}
+
 // setPassword is kept for backward compatibility (calls SetPassword)
 func (u *UserModel) setPassword(password string) error {
 	return u.SetPassword(password)
@@ -83,18 +131,89 @@ func (u *UserModel) checkPassword(password string) error {
 //
 //	userModel, err := FindOneUser(&UserModel{Username: "username0"})
 func FindOneUser(condition interface{}) (UserModel, error) {
-	db := common.GetDB()
+	return findOneUserTx(common.GetDB(), condition)
+}
+
+// Same as FindOneUser but queries through db, e.g. common.GetRequestDB(c) to trace it.
+func findOneUserTx(db *gorm.DB, condition interface{}) (UserModel, error) {
 	var model UserModel
 	err := db.Where(condition).First(&model).Error
 	return model, err
 }
 
+// How long a profile stays in common.GetCache(), UserUpdate drops it right away.
+const ProfileCacheTTL = time.Minute
+
+func profileCacheKey(username string) string {
+	return "profile:" + username
+}
+
+// The user behind a profile, through the cache. following is left out: it depends on the caller.
+func findProfileTx(db *gorm.DB, username string) (UserModel, error) {
+	cache := common.GetCache()
+	if cached, ok := cache.Get(profileCacheKey(username)); ok {
+		return cached.(UserModel), nil
+	}
+	model, err := findOneUserTx(db, &UserModel{Username: username})
+	if err == nil {
+		cache.Set(profileCacheKey(username), model, ProfileCacheTTL)
+	}
+	return model, err
+}
+
+// Drop the cached profiles of these usernames after a committed change. Cached articles embed
+// their author's profile, so they are dropped as well.
+func InvalidateProfileCache(usernames ...string) {
+	cache := common.GetCache()
+	for _, username := range usernames {
+		cache.Delete(profileCacheKey(username))
+	}
+	cache.DeletePrefix("article:")
+}
+
+// Look a user up by username or, failing that, by email, as operators know either.
+//
+//	userModel, err := FindUserByLogin("jake")
+func FindUserByLogin(login string) (UserModel, error) {
+	userModel, err := FindOneUser(&UserModel{Username: login})
+	if gorm.IsRecordNotFoundError(err) {
+		userModel, err = FindOneUser(&UserModel{Email: login})
+	}
+	return userModel, err
+}
+
+// Create a user outside of a request, with the same validation as the registration endpoint.
+// A validation failure is returned as validator.ValidationErrors.
+//
+//	userModel, err := CreateUser("jake", "jake@jake.jake", "jakejake", RoleUser)
+func CreateUser(username, email, password, role string) (UserModel, error) {
+	if !IsValidRole(role) {
+		return UserModel{}, fmt.Errorf("unknown role %q, use %s, %s or %s", role, RoleUser, RoleModerator, RoleAdmin)
+	}
+	userModelValidator := NewUserModelValidator()
+	userModelValidator.User.Username = username
+	userModelValidator.User.Email = email
+	userModelValidator.User.Password = password
+	if err := userModelValidator.Validate(); err != nil {
+		return UserModel{}, err
+	}
+	userModel := userModelValidator.userModel
+	userModel.Role = role
+	err := common.Transaction(func(tx *gorm.DB) error {
+		return saveOneTx(tx, &userModel)
+	})
+	return userModel, err
+}
+
 // You could input an UserModel which will be saved in database returning with error info
 //
 //	if err := SaveOne(&userModel); err != nil { ... }
 func SaveOne(data interface{}) error {
-	db := common.GetDB()
-	err := db.Save(data).Error
+	return saveOneTx(common.GetDB(), data)
+}
+
+func saveOneTx(tx *gorm.DB, data interface{}) error {
+	err := tx.Save(data).Error
 	return err
 }
 
@@ -102,8 +221,16 @@ func SaveOne(data interface{}) error {
 //
 //	err := db.Model(userModel).Update(UserModel{Username: "wangzitian0"}).Error
 func (model *UserModel) Update(data interface{}) error {
-	db := common.GetDB()
-	err := db.Model(model).Update(data).Error
+	username := model.Username
+	err := model.updateTx(common.GetDB(), data)
+	if err == nil {
+		InvalidateProfileCache(username, model.Username)
+	}
+	return err
+}
+
+func (model *UserModel) updateTx(tx *gorm.DB, data interface{}) error {
+	err := tx.Model(model).Update(data).Error
 	return err
 }
 
@@ -111,20 +238,36 @@ func (model *UserModel) Update(data interface{}) error {
 //
 //	err = userModel1.following(userModel2)
 func (u UserModel) following(v UserModel) error {
-	db := common.GetDB()
-	var follow FollowModel
-	err := db.FirstOrCreate(&follow, &FollowModel{
+	return u.followingTx(common.GetDB(), v)
+}
+
+// Same as following but runs on the given transaction.
+//
+//	err := common.Transaction(func(tx *gorm.DB) error { return userModel1.followingTx(tx, userModel2) })
+func (u UserModel) followingTx(tx *gorm.DB, v UserModel) error {
+	follow := FollowModel{
 		FollowingID:  v.ID,
 		FollowedByID: u.ID,
-	}).Error
-	return err
+	}
+	err := tx.Where(follow).First(&FollowModel{}).Error
+	if !gorm.IsRecordNotFoundError(err) {
+		// already following, or the error
+		return err
+	}
+	if err := tx.Create(&follow).Error; err != nil {
+		return err
+	}
+	return events.PublishTx(tx, events.UserFollowed{UserID: v.ID, FollowerID: u.ID})
 }
 
 // You could check whether  userModel1 following userModel2
 //
 //	followingBool = myUserModel.isFollowing(self.UserModel)
 func (u UserModel) isFollowing(v UserModel) bool {
-	db := common.GetDB()
+	return u.isFollowingTx(common.GetDB(), v)
+}
+
+func (u UserModel) isFollowingTx(db *gorm.DB, v UserModel) bool {
 	var follow FollowModel
 	db.Where(FollowModel{
 		FollowingID:  v.ID,
@@ -133,23 +276,58 @@ func (u UserModel) isFollowing(v UserModel) bool {
 	return follow.ID != 0
 }
 
+// The ids of those of vs that u follows, in one query.
+func (u UserModel) followingSetTx(db *gorm.DB, vs []UserModel) map[uint]bool {
+	following := map[uint]bool{}
+	if u.ID == 0 || len(vs) == 0 {
+		return following
+	}
+	ids := make([]uint, len(vs))
+	for i, v := range vs {
+		ids[i] = v.ID
+	}
+	var follows []FollowModel
+	db.Where("followed_by_id = ? AND following_id IN (?)", u.ID, ids).Find(&follows)
+	for _, follow := range follows {
+		following[follow.FollowingID] = true
+	}
+	return following
+}
+
+// Same as isFollowing for other packages, through db.
+func (u UserModel) IsFollowingTx(db *gorm.DB, v UserModel) bool {
+	return u.isFollowingTx(db, v)
+}
+
 // You could delete a following relationship as userModel1 following userModel2
 //
 //	err = userModel1.unFollowing(userModel2)
 func (u UserModel) unFollowing(v UserModel) error {
-	db := common.GetDB()
-	err := db.Where(FollowModel{
+	return u.unFollowingTx(common.GetDB(), v)
+}
+
+// Same as unFollowing but runs on the given transaction.
+func (u UserModel) unFollowingTx(tx *gorm.DB, v UserModel) error {
+	result := tx.Where(FollowModel{
 		FollowingID:  v.ID,
 		FollowedByID: u.ID,
-	}).Delete(FollowModel{}).Error
-	return err
+	}).Delete(FollowModel{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		// not following, or the error
+		return result.Error
+	}
+	return events.PublishTx(tx, events.UserUnfollowed{UserID: v.ID, FollowerID: u.ID})
 }
 
 // You could get a following list of userModel
 //
 //	followings := userModel.GetFollowings()
 func (u UserModel) GetFollowings() []UserModel {
-	db := common.GetDB()
+	return u.GetFollowingsTx(common.GetDB())
+}
+
+// Same as GetFollowings but queries through db, the articles feed passes its request handle.
+func (u UserModel) GetFollowingsTx(db *gorm.DB) []UserModel {
 	tx := db.Begin()
 	var follows []FollowModel
 	var followings []UserModel
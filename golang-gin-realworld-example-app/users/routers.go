@@ -4,7 +4,9 @@ import (
 	"errors"
 	"realworld-backend/common"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"net/http"
+	"time"
 )
 
 func UsersRegister(router *gin.RouterGroup) {
@@ -25,26 +27,29 @@ func ProfileRegister(router *gin.RouterGroup) {
 
 func ProfileRetrieve(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, err := findProfileTx(common.GetRequestDB(c), username)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		common.AbortWithError(c, common.NewNotFoundError("profile", errors.New("Invalid username")))
 		return
 	}
 	profileSerializer := ProfileSerializer{c, userModel}
-	c.JSON(http.StatusOK, gin.H{"profile": profileSerializer.Response()})
+	// users have no UpdatedAt, the ETag is the only validator
+	common.CacheableJSON(c, http.StatusOK, gin.H{"profile": profileSerializer.Response()}, time.Time{})
 }
 
 func ProfileFollow(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, err := findOneUserTx(common.GetRequestDB(c), &UserModel{Username: username})
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		common.AbortWithError(c, common.NewNotFoundError("profile", errors.New("Invalid username")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(UserModel)
-	err = myUserModel.following(userModel)
+	err = common.Transaction(func(tx *gorm.DB) error {
+		return myUserModel.followingTx(tx, userModel)
+	})
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
 	serializer := ProfileSerializer{c, userModel}
@@ -53,16 +58,18 @@ func ProfileFollow(c *gin.Context) {
 
 func ProfileUnfollow(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, err := findOneUserTx(common.GetRequestDB(c), &UserModel{Username: username})
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		common.AbortWithError(c, common.NewNotFoundError("profile", errors.New("Invalid username")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(UserModel)
 
-	err = myUserModel.unFollowing(userModel)
+	err = common.Transaction(func(tx *gorm.DB) error {
+		return myUserModel.unFollowingTx(tx, userModel)
+	})
 	if err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
 	serializer := ProfileSerializer{c, userModel}
@@ -72,14 +79,18 @@ func ProfileUnfollow(c *gin.Context) {
 func UsersRegistration(c *gin.Context) {
 	userModelValidator := NewUserModelValidator()
 	if err := userModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		common.AbortWithError(c, common.NewBindError(err))
 		return
 	}
 
-	if err := SaveOne(&userModelValidator.userModel); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	err := common.Transaction(func(tx *gorm.DB) error {
+		return saveOneTx(tx, &userModelValidator.userModel)
+	})
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
+	common.UserRegistrationsTotal.Inc()
 	c.Set("my_user_model", userModelValidator.userModel)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusCreated, gin.H{"user": serializer.Response()})
@@ -88,20 +99,23 @@ func UsersRegistration(c *gin.Context) {
 func UsersLogin(c *gin.Context) {
 	loginValidator := NewLoginValidator()
 	if err := loginValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		common.AbortWithError(c, common.NewBindError(err))
 		return
 	}
-	userModel, err := FindOneUser(&UserModel{Email: loginValidator.userModel.Email})
+	userModel, err := findOneUserTx(common.GetRequestDB(c), &UserModel{Email: loginValidator.userModel.Email})
 
 	if err != nil {
-		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
+		common.UserLoginsTotal.WithLabelValues("failure").Inc()
+		common.AbortWithError(c, common.NewAppError(http.StatusForbidden, common.ErrorCodeInvalidCredentials, "login", errors.New("Not Registered email or invalid password")))
 		return
 	}
 
 	if userModel.checkPassword(loginValidator.User.Password) != nil {
-		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
+		common.UserLoginsTotal.WithLabelValues("failure").Inc()
+		common.AbortWithError(c, common.NewAppError(http.StatusForbidden, common.ErrorCodeInvalidCredentials, "login", errors.New("Not Registered email or invalid password")))
 		return
 	}
+	common.UserLoginsTotal.WithLabelValues("success").Inc()
 	UpdateContextUserModel(c, userModel.ID)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
@@ -116,15 +130,19 @@ func UserUpdate(c *gin.Context) {
 	myUserModel := c.MustGet("my_user_model").(UserModel)
 	userModelValidator := NewUserModelValidatorFillWith(myUserModel)
 	if err := userModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		common.AbortWithError(c, common.NewBindError(err))
 		return
 	}
 
 	userModelValidator.userModel.ID = myUserModel.ID
-	if err := myUserModel.Update(userModelValidator.userModel); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	err := common.Transaction(func(tx *gorm.DB) error {
+		return myUserModel.updateTx(tx, userModelValidator.userModel)
+	})
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
 		return
 	}
+	InvalidateProfileCache(myUserModel.Username, userModelValidator.userModel.Username)
 	UpdateContextUserModel(c, myUserModel.ID)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
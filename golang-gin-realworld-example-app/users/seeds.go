@@ -0,0 +1,48 @@
+package users
+
+import (
+	"realworld-backend/common"
+)
+
+// Create count users with made up names, all sharing password, through SaveOne.
+// The password is hashed once: bcrypt is slow on purpose and the hash is the same for everyone anyway.
+//
+//	userModels, err := SeedUsers(common.NewFaker(42), 20, "password")
+func SeedUsers(faker *common.Faker, count int, password string) ([]UserModel, error) {
+	var hashed UserModel
+	if err := hashed.SetPassword(password); err != nil {
+		return nil, err
+	}
+	userModels := make([]UserModel, 0, count)
+	for i := 1; i <= count; i++ {
+		username := faker.Username(i)
+		userModel := UserModel{
+			Username:     username,
+			Email:        username + "@example.com",
+			Bio:          faker.Sentence(),
+			PasswordHash: hashed.PasswordHash,
+		}
+		if err := SaveOne(&userModel); err != nil {
+			return userModels, err
+		}
+		userModels = append(userModels, userModel)
+	}
+	return userModels, nil
+}
+
+// Make every user follow up to max others through following, and return how many follows were made.
+func SeedFollows(faker *common.Faker, userModels []UserModel, max int) (int, error) {
+	count := 0
+	for _, userModel := range userModels {
+		for _, i := range faker.Sample(len(userModels), faker.Between(0, max)) {
+			if userModels[i].ID == userModel.ID {
+				continue
+			}
+			if err := userModel.following(userModels[i]); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
@@ -28,11 +28,33 @@ func (self *ProfileSerializer) Response() ProfileResponse {
 		Username:  self.Username,
 		Bio:       self.Bio,
 		Image:     self.Image,
-		Following: myUserModel.isFollowing(self.UserModel),
+		Following: myUserModel.isFollowingTx(common.GetRequestDB(self.C), self.UserModel),
 	}
 	return profile
 }
 
+type ProfilesSerializer struct {
+	C     *gin.Context
+	Users []UserModel
+}
+
+// Same as ProfileSerializer for each user, but following is read with one query for the whole list.
+func (self *ProfilesSerializer) Response() []ProfileResponse {
+	myUserModel := self.C.MustGet("my_user_model").(UserModel)
+	following := myUserModel.followingSetTx(common.GetRequestDB(self.C), self.Users)
+	response := []ProfileResponse{}
+	for _, userModel := range self.Users {
+		response = append(response, ProfileResponse{
+			ID:        userModel.ID,
+			Username:  userModel.Username,
+			Bio:       userModel.Bio,
+			Image:     userModel.Image,
+			Following: following[userModel.ID],
+		})
+	}
+	return response
+}
+
 type UserSerializer struct {
 	c *gin.Context
 }
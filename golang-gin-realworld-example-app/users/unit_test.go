@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/jinzhu/gorm"
 	"realworld-backend/common"
+	"realworld-backend/events"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"net/http/httptest"
@@ -96,6 +97,7 @@ func resetDBWithMock() {
 	common.TestDBFree(test_db)
 	test_db = common.TestDBInit()
 	AutoMigrate()
+	events.AutoMigrate()
 	userModelMocker(3)
 }
 
@@ -133,9 +135,9 @@ var unauthRequestTests = []struct {
 		"/users/",
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
-		http.StatusUnprocessableEntity,
-		`{"errors":{"database":"UNIQUE constraint failed: user_models.email"}}`,
-		"duplicated data and should return StatusUnprocessableEntity",
+		http.StatusConflict,
+		`{"errors":{"email":"has already been taken"}}`,
+		"duplicated data and should return StatusConflict",
 	},
 	{
 		func(req *http.Request) {},
@@ -143,7 +145,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"username": "u","email": "wzt@gg.cn","password": "jakejxke"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"Username":"{min: 4}"}}`,
+		`{"errors":{"username":"must be at least 4 characters in length"}}`,
 		"too short username should return error",
 	},
 	{
@@ -152,7 +154,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "j"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"Password":"{min: 8}"}}`,
+		`{"errors":{"password":"must be at least 8 characters in length"}}`,
 		"too short password should return error",
 	},
 	{
@@ -161,7 +163,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wztgg.cn","password": "jakejxke"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"Email":"{key: email}"}}`,
+		`{"errors":{"email":"must be a valid email address"}}`,
 		"email invalid should return error",
 	},
 
@@ -201,7 +203,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"email": "user1@linkedin.com","password": "passw"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"Password":"{min: 8}"}}`,
+		`{"errors":{"password":"must be at least 8 characters in length"}}`,
 		"password too short should return error info",
 	},
 	{
@@ -210,7 +212,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"email": "user1@linkedin.com","password": "passw"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"Password":"{min: 8}"}}`,
+		`{"errors":{"password":"must be at least 8 characters in length"}}`,
 		"password too short should return error info",
 	},
 
@@ -326,7 +328,7 @@ var unauthRequestTests = []struct {
 		"PUT",
 		`{"user":{"password": "pas"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"Password":"{min: 8}"}}`,
+		`{"errors":{"password":"must be at least 8 characters in length"}}`,
 		"current user profile should not be changed with error user info",
 	},
 
@@ -343,6 +345,29 @@ var unauthRequestTests = []struct {
 		`{"user":{"username":"user3","email":"user3@linkedin.com","bio":"bio3","image":"http://image/3.jpg","token":"([a-zA-Z0-9-_.]+)"}}`,
 		"test user update with only password - should use existing user info",
 	},
+	{
+		func(req *http.Request) {
+			test_db.Model(&UserModel{}).Where("id = ?", 3).UpdateColumn("username", "user.3")
+			HeaderTokenMock(req, 3)
+		},
+		"/user/",
+		"PUT",
+		`{"user":{"bio": "legacy"}}`,
+		http.StatusOK,
+		`{"user":{"username":"user.3","email":"user3@linkedin.com","bio":"legacy","image":"http://image/3.jpg","token":"([a-zA-Z0-9-_.]+)"}}`,
+		"a username taken before the username rule can be kept",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 3)
+		},
+		"/user/",
+		"PUT",
+		`{"user":{"username": "user.33"}}`,
+		http.StatusUnprocessableEntity,
+		`{"errors":{"username":"can only contain letters and digits, optionally joined by a single '-' or '_'"}}`,
+		"but not chosen anew",
+	},
 	{
 		func(req *http.Request) {
 			HeaderTokenMock(req, 0)
@@ -350,8 +375,8 @@ var unauthRequestTests = []struct {
 		"/user/",
 		"PUT",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
-		http.StatusUnprocessableEntity,
-		`{"errors":{"database":"UNIQUE constraint failed: user_models.email"}}`,
+		http.StatusConflict,
+		`{"errors":{"email":"has already been taken"}}`,
 		"cheat validator and test database connecting error for user update",
 	},
 	{
@@ -484,6 +509,7 @@ func TestWithoutAuth(t *testing.T) {
 func TestMain(m *testing.M) {
 	test_db = common.TestDBInit()
 	AutoMigrate()
+	events.AutoMigrate()
 	exitVal := m.Run()
 	common.TestDBFree(test_db)
 	os.Exit(exitVal)
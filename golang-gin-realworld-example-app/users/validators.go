@@ -3,6 +3,7 @@ package users
 import (
 	"realworld-backend/common"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 // *ModelValidator containing two parts:
@@ -11,13 +12,15 @@ import (
 // Then, you can just call model.save() after the data is ready in DataModel.
 type UserModelValidator struct {
 	User struct {
-		Username string `form:"username" json:"username" binding:"required,alphanum,min=4,max=255"`
+		Username string `form:"username" json:"username" binding:"required,username,min=4,max=255"`
 		Email    string `form:"email" json:"email" binding:"required,email"`
 		Password string `form:"password" json:"password" binding:"required,min=8,max=255"`
 		Bio      string `form:"bio" json:"bio" binding:"max=1024"`
 		Image    string `form:"image" json:"image" binding:"omitempty,url"`
 	} `json:"user"`
 	userModel UserModel `json:"-"`
+	// the username before the update, kept even if it breaks the username rule
+	storedUsername string
 }
 
 // There are some difference when you create or update a model, you need to fill the DataModel before
@@ -28,6 +31,20 @@ func (self *UserModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	self.fill()
+	return nil
+}
+
+// Same checks as Bind for a validator filled by hand, e.g. from command line flags.
+func (self *UserModelValidator) Validate() error {
+	if err := binding.Validator.ValidateStruct(self); err != nil {
+		return err
+	}
+	self.fill()
+	return nil
+}
+
+func (self *UserModelValidator) fill() {
 	self.userModel.Username = self.User.Username
 	self.userModel.Email = self.User.Email
 	self.userModel.Bio = self.User.Bio
@@ -38,7 +55,10 @@ func (self *UserModelValidator) Bind(c *gin.Context) error {
 	if self.User.Image != "" {
 		self.userModel.Image = &self.User.Image
 	}
-	return nil
+}
+
+func (self *UserModelValidator) StoredUsername() string {
+	return self.storedUsername
 }
 
 // You can put the default value of a Validator here
@@ -54,6 +74,7 @@ func NewUserModelValidatorFillWith(userModel UserModel) UserModelValidator {
 	userModelValidator.User.Email = userModel.Email
 	userModelValidator.User.Bio = userModel.Bio
 	userModelValidator.User.Password = common.NBRandomPassword
+	userModelValidator.storedUsername = userModel.Username
 
 	if userModel.Image != nil {
 		userModelValidator.User.Image = *userModel.Image
@@ -0,0 +1,165 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+	"realworld-backend/jobs"
+)
+
+// Deliveries are jobs of the queue, each run is an attempt: 30s after the first failed one, then
+// 1m, 2m... 32m before the last one, a little over an hour in all.
+var deliverJob = jobs.Define("webhooks.deliver", jobs.Options{
+	MaxAttempts: 8,
+	Backoff:     30 * time.Second,
+	Timeout:     30 * time.Second,
+	Concurrency: 8,
+}, deliver)
+
+type deliverPayload struct {
+	DeliveryID uint `json:"deliveryId"`
+}
+
+// The client deliveries are sent with, serve and the worker set it from WEBHOOKS_ALLOW_PRIVATE.
+var Client = NewClient(false)
+
+// What the log keeps of the answers of endpoints.
+const maxLoggedBody = 1024
+
+// Send a delivery once. An error has the job run it again, until its last attempt fails it.
+func deliver(ctx context.Context, payload deliverPayload) error {
+	db := common.GetDB()
+	var delivery WebhookDeliveryModel
+	if err := db.First(&delivery, payload.DeliveryID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return jobs.Permanent(err)
+		}
+		return err
+	}
+	var webhook WebhookModel
+	err := db.First(&webhook, delivery.WebhookID).Error
+	if err == nil && webhook.Disabled {
+		err = errors.New("webhook is disabled")
+	}
+	if err != nil {
+		// deleted or disabled since the delivery was queued, nothing to retry
+		finish(delivery, WebhookAttemptModel{Error: truncate(err.Error())}, DeliveryFailed, nil)
+		return nil
+	}
+
+	start := time.Now()
+	attempt := WebhookAttemptModel{CreatedAt: start}
+	attempt.ResponseCode, attempt.ResponseBody, err = send(ctx, webhook, delivery)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err == nil && (attempt.ResponseCode < 200 || attempt.ResponseCode > 299) {
+		err = fmt.Errorf("endpoint answered %d", attempt.ResponseCode)
+	}
+	if err == nil {
+		common.WebhookDeliveriesTotal.WithLabelValues("success").Inc()
+		finish(delivery, attempt, DeliverySucceeded, nil)
+		return nil
+	}
+	attempt.Error = truncate(err.Error())
+	job := jobs.CurrentJob(ctx)
+	if job.LastAttempt() {
+		common.WebhookDeliveriesTotal.WithLabelValues("failure").Inc()
+		finish(delivery, attempt, DeliveryFailed, nil)
+		return err
+	}
+	common.WebhookDeliveriesTotal.WithLabelValues("retry").Inc()
+	next := time.Now().Add(job.RetryDelay)
+	finish(delivery, attempt, DeliveryPending, &next)
+	return err
+}
+
+// Log the attempt and move the delivery on to status, to be tried again at next if it is pending.
+func finish(delivery WebhookDeliveryModel, attempt WebhookAttemptModel, status string, next *time.Time) {
+	attempt.DeliveryID = delivery.ID
+	changes := map[string]interface{}{
+		"status":          status,
+		"attempts":        gorm.Expr("attempts + 1"),
+		"response_code":   attempt.ResponseCode,
+		"next_attempt_at": next,
+	}
+	if status == DeliverySucceeded {
+		changes["delivered_at"] = time.Now()
+	}
+	err := common.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+		return tx.Model(&delivery).Updates(changes).Error
+	})
+	if err != nil {
+		common.Logger.Error("webhooks: cannot save delivery", "delivery", delivery.ID, "error", err)
+	}
+}
+
+// POST the payload, signed, and return the status and the start of the body of the answer.
+func send(ctx context.Context, webhook WebhookModel, delivery WebhookDeliveryModel) (int, string, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "realworld-webhooks")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", Sign(webhook.Secret, timestamp, body))
+	resp, err := Client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedBody))
+	return resp.StatusCode, string(answer), nil
+}
+
+func truncate(message string) string {
+	if len(message) > maxLoggedBody {
+		return message[:maxLoggedBody]
+	}
+	return message
+}
+
+// The client deliveries are sent with. It does not follow redirects and, unless allowPrivate,
+// refuses to connect to loopback, private and link-local addresses, so a webhook cannot be used
+// to reach the services next to us. Development setups pass allowPrivate to call localhost.
+func NewClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		// checked on the address actually dialled, after DNS resolution
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+				return fmt.Errorf("webhooks: refusing to connect to %s", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 5 * time.Second},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
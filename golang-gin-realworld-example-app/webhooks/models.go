@@ -0,0 +1,292 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+	"realworld-backend/events"
+	"realworld-backend/users"
+)
+
+// The events a webhook can subscribe to.
+const (
+	EventArticlePublished = "article.published"
+	EventArticleUpdated   = "article.updated"
+	EventArticleDeleted   = "article.deleted"
+	EventCommentCreated   = "comment.created"
+	EventUserFollowed     = "user.followed"
+)
+
+// What a domain event is about: the user whose webhooks get it, and the ids its data is read from.
+// ActorID is the follower of a user.followed.
+type subject struct {
+	UserID    uint
+	ActorID   uint
+	ArticleID uint
+	CommentID uint
+}
+
+// The webhook event sent for a domain event, ok is false for the events that are not sent.
+func webhookEvent(event events.Event) (name string, about subject, ok bool) {
+	switch event := event.(type) {
+	case events.ArticleCreated:
+		return EventArticlePublished, subject{UserID: event.AuthorID, ArticleID: event.ArticleID}, true
+	case events.ArticleUpdated:
+		return EventArticleUpdated, subject{UserID: event.AuthorID, ArticleID: event.ArticleID}, true
+	case events.ArticleDeleted:
+		return EventArticleDeleted, subject{UserID: event.AuthorID, ArticleID: event.ArticleID}, true
+	case events.CommentCreated:
+		// a reply is about the article too, the author of the parent comment is not told
+		return EventCommentCreated, subject{UserID: event.ArticleAuthorID, ArticleID: event.ArticleID, CommentID: event.CommentID}, true
+	case events.UserFollowed:
+		return EventUserFollowed, subject{UserID: event.UserID, ActorID: event.FollowerID}, true
+	}
+	return "", subject{}, false
+}
+
+// An endpoint called with the events it subscribes to. The webhooks of admins are Global and get
+// the events of the whole site while their owner is still an admin, those of other users the
+// events about them: their articles, the comments on their articles and their new followers.
+type WebhookModel struct {
+	gorm.Model
+	OwnerID  uint   `gorm:"index;not null"`
+	URL      string `gorm:"size:2048;not null"`
+	Secret   string `gorm:"size:64;not null"`
+	Events   string `gorm:"size:255;not null"` // ",article.published,comment.created,", see setEvents
+	Global   bool   `gorm:"not null;default:false"`
+	Disabled bool   `gorm:"not null;default:false"`
+}
+
+// What became of a delivery.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed" // MaxAttempts failed attempts, or the webhook is gone
+)
+
+// One event for one webhook, sent by a job and kept afterwards as the delivery log. Payload is
+// the body as sent, a redelivery sends it again as it was.
+type WebhookDeliveryModel struct {
+	gorm.Model
+	WebhookID     uint       `gorm:"index;not null"`
+	Event         string     `gorm:"size:32;not null"`
+	Payload       string     `gorm:"type:text;not null"`
+	Status        string     `gorm:"size:16;not null"`
+	Attempts      int        `gorm:"not null;default:0"`
+	NextAttemptAt *time.Time // of a pending delivery, nil once delivered or given up
+	ResponseCode  int        // of the last attempt, 0 when it got no response
+	DeliveredAt   *time.Time
+	RedeliveryOf  *uint // the delivery this one sends again
+}
+
+// A request made for a delivery, and how the endpoint answered.
+type WebhookAttemptModel struct {
+	ID           uint `gorm:"primary_key"`
+	DeliveryID   uint `gorm:"index;not null"`
+	CreatedAt    time.Time
+	ResponseCode int
+	ResponseBody string `gorm:"size:1024"` // the start of it
+	Error        string `gorm:"size:1024"`
+	DurationMs   int64
+}
+
+func init() {
+	events.Subscribe("webhooks", enqueueTx)
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&WebhookModel{})
+	db.AutoMigrate(&WebhookDeliveryModel{})
+	db.AutoMigrate(&WebhookAttemptModel{})
+}
+
+func (webhook *WebhookModel) setEvents(events []string) {
+	webhook.Events = "," + strings.Join(events, ",") + ","
+}
+
+func (webhook WebhookModel) events() []string {
+	return strings.Split(strings.Trim(webhook.Events, ","), ",")
+}
+
+// 32 random bytes in hex, the key deliveries are signed with.
+func newSecret() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// The X-Webhook-Signature of a delivery: "sha256=" and the hex HMAC-SHA256, keyed with the secret
+// of the webhook, of the X-Webhook-Timestamp, a dot and the body. Receivers compute the same,
+// compare in constant time and may refuse old timestamps to stop replays.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// The body of every delivery, ID is the same for all the deliveries of an event.
+type eventPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt string      `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// Queue a delivery of the domain event for each webhook subscribed to it, in the transaction
+// that marks the event handled: each webhook gets one delivery per event.
+func enqueueTx(tx *gorm.DB, envelope events.Envelope) error {
+	event, about, ok := webhookEvent(envelope.Event)
+	if !ok {
+		return nil
+	}
+	var webhooks []WebhookModel
+	// Global only while the owner is still an admin, a demoted admin keeps the events about them
+	err := tx.Select("webhook_models.*").
+		Joins("JOIN user_models ON user_models.id = webhook_models.owner_id").
+		Where("webhook_models.disabled = ? AND webhook_models.events LIKE ?", false, "%,"+event+",%").
+		Where("(webhook_models.global = ? AND user_models.role = ?) OR webhook_models.owner_id = ?", true, users.RoleAdmin, about.UserID).
+		Find(&webhooks).Error
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	data, err := eventDataTx(tx, event, about)
+	if gorm.IsRecordNotFoundError(err) {
+		// gone for good since, there is nothing left to tell
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(eventPayload{
+		ID:        hex.EncodeToString(id),
+		Event:     event,
+		CreatedAt: envelope.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, webhook := range webhooks {
+		delivery := WebhookDeliveryModel{
+			WebhookID:     webhook.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        DeliveryPending,
+			NextAttemptAt: &now,
+		}
+		if err := tx.Create(&delivery).Error; err != nil {
+			return err
+		}
+		if _, err := deliverJob.EnqueueTx(tx, deliverPayload{DeliveryID: delivery.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find a webhook of owner, gorm.ErrRecordNotFound when owner has no such webhook.
+func findWebhookTx(db *gorm.DB, ownerID uint, id string) (WebhookModel, error) {
+	var webhook WebhookModel
+	webhookID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return webhook, gorm.ErrRecordNotFound
+	}
+	err = db.Where("id = ? AND owner_id = ?", webhookID, ownerID).First(&webhook).Error
+	return webhook, err
+}
+
+func findWebhooksTx(db *gorm.DB, ownerID uint) ([]WebhookModel, error) {
+	var webhooks []WebhookModel
+	err := db.Where("owner_id = ?", ownerID).Order("id").Find(&webhooks).Error
+	return webhooks, err
+}
+
+// A page of the deliveries of the webhook, newest first, and how many there are in all.
+// status filters them when not empty.
+func (webhook WebhookModel) deliveriesTx(db *gorm.DB, status, limit, offset string) ([]WebhookDeliveryModel, int, error) {
+	offsetInt, err := strconv.Atoi(offset)
+	if err != nil {
+		offsetInt = 0
+	}
+	limitInt, err := strconv.Atoi(limit)
+	if err != nil {
+		limitInt = 20
+	}
+	query := db.Model(&WebhookDeliveryModel{}).Where("webhook_id = ?", webhook.ID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var count int
+	if err := query.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	var deliveries []WebhookDeliveryModel
+	err = query.Order("id desc").Offset(offsetInt).Limit(limitInt).Find(&deliveries).Error
+	return deliveries, count, err
+}
+
+// The attempts of deliveries, by delivery, oldest first.
+func attemptsTx(db *gorm.DB, deliveries []WebhookDeliveryModel) (map[uint][]WebhookAttemptModel, error) {
+	attempts := map[uint][]WebhookAttemptModel{}
+	if len(deliveries) == 0 {
+		return attempts, nil
+	}
+	var ids []uint
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.ID)
+	}
+	var models []WebhookAttemptModel
+	if err := db.Where("delivery_id IN (?)", ids).Order("id").Find(&models).Error; err != nil {
+		return nil, err
+	}
+	for _, attempt := range models {
+		attempts[attempt.DeliveryID] = append(attempts[attempt.DeliveryID], attempt)
+	}
+	return attempts, nil
+}
+
+// Queue the payload of a delivery again, as a new delivery of the same webhook.
+func (webhook WebhookModel) redeliverTx(tx *gorm.DB, deliveryID string) (WebhookDeliveryModel, error) {
+	var original WebhookDeliveryModel
+	id, err := strconv.ParseUint(deliveryID, 10, 32)
+	if err != nil {
+		return original, gorm.ErrRecordNotFound
+	}
+	if err := tx.Where("id = ? AND webhook_id = ?", id, webhook.ID).First(&original).Error; err != nil {
+		return original, err
+	}
+	now := time.Now()
+	delivery := WebhookDeliveryModel{
+		WebhookID:     webhook.ID,
+		Event:         original.Event,
+		Payload:       original.Payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &now,
+		RedeliveryOf:  &original.ID,
+	}
+	if err := tx.Create(&delivery).Error; err != nil {
+		return delivery, err
+	}
+	_, err = deliverJob.EnqueueTx(tx, deliverPayload{DeliveryID: delivery.ID})
+	return delivery, err
+}
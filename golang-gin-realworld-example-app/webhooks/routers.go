@@ -0,0 +1,180 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+func WebhooksRegister(router *gin.RouterGroup) {
+	router.GET("/", WebhookList)
+	router.POST("/", WebhookCreate)
+	router.GET("/:id", WebhookRetrieve)
+	router.PUT("/:id", WebhookUpdate)
+	router.DELETE("/:id", WebhookDelete)
+	router.GET("/:id/deliveries", WebhookDeliveryList)
+	router.POST("/:id/deliveries/:delivery/redeliver", WebhookRedeliver)
+}
+
+// The webhook of the caller named in the path, or a 404: the webhooks of others are not told apart
+// from missing ones.
+func findWebhook(c *gin.Context) (WebhookModel, bool) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	webhookModel, err := findWebhookTx(common.GetRequestDB(c), myUserModel.ID, c.Param("id"))
+	if gorm.IsRecordNotFoundError(err) {
+		common.AbortWithError(c, common.NewNotFoundError("webhook", errors.New("Invalid id")))
+		return webhookModel, false
+	}
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return webhookModel, false
+	}
+	return webhookModel, true
+}
+
+func WebhookList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	webhookModels, err := findWebhooksTx(common.GetRequestDB(c), myUserModel.ID)
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := WebhooksSerializer{c, webhookModels}
+	c.JSON(http.StatusOK, gin.H{"webhooks": serializer.Response(), "webhooksCount": len(webhookModels)})
+}
+
+// The secret deliveries are signed with is only in this response.
+func WebhookCreate(c *gin.Context) {
+	webhookModelValidator := NewWebhookModelValidator()
+	if err := webhookModelValidator.Bind(c); err != nil {
+		common.AbortWithError(c, common.NewBindError(err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	webhookModel := &webhookModelValidator.webhookModel
+	webhookModel.OwnerID = myUserModel.ID
+	webhookModel.Global = myUserModel.Role == users.RoleAdmin
+	secret, err := newSecret()
+	if err != nil {
+		common.AbortWithError(c, err)
+		return
+	}
+	webhookModel.Secret = secret
+	if err := common.GetRequestDB(c).Create(webhookModel).Error; err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := WebhookSerializer{c, *webhookModel}
+	response := serializer.Response()
+	response.Secret = webhookModel.Secret
+	c.JSON(http.StatusCreated, gin.H{"webhook": response})
+}
+
+func WebhookRetrieve(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	serializer := WebhookSerializer{c, webhookModel}
+	c.JSON(http.StatusOK, gin.H{"webhook": serializer.Response()})
+}
+
+// Change the url, the events or "active"; what the request leaves out stays as it was.
+func WebhookUpdate(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	webhookModelValidator := NewWebhookModelValidatorFillWith(webhookModel)
+	if err := webhookModelValidator.Bind(c); err != nil {
+		common.AbortWithError(c, common.NewBindError(err))
+		return
+	}
+	changes := webhookModelValidator.webhookModel
+	// a map, Updates would skip Disabled when it becomes false
+	err := common.GetRequestDB(c).Model(&webhookModel).Updates(map[string]interface{}{
+		"url":      changes.URL,
+		"events":   changes.Events,
+		"disabled": changes.Disabled,
+	}).Error
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := WebhookSerializer{c, webhookModel}
+	c.JSON(http.StatusOK, gin.H{"webhook": serializer.Response()})
+}
+
+// The deliveries still pending fail when the dispatcher gets to them.
+func WebhookDelete(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	if err := common.GetRequestDB(c).Delete(&webhookModel).Error; err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": "Delete success"})
+}
+
+// The delivery log, newest first, ?status=pending|succeeded|failed, paged with ?limit= and ?offset=.
+func WebhookDeliveryList(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	status := c.Query("status")
+	switch status {
+	case "", DeliveryPending, DeliverySucceeded, DeliveryFailed:
+	default:
+		common.AbortWithError(c, common.NewAppError(http.StatusUnprocessableEntity, common.ErrorCodeValidation, "status",
+			errors.New("must be pending, succeeded or failed")))
+		return
+	}
+	deliveryModels, count, err := webhookModel.deliveriesTx(common.GetRequestDB(c), status, c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := DeliveriesSerializer{c, deliveryModels}
+	response, err := serializer.Response()
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": response, "deliveriesCount": count})
+}
+
+// Send the payload of a delivery again, whatever became of it, as a new delivery.
+func WebhookRedeliver(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	var deliveryModel WebhookDeliveryModel
+	err := common.Transaction(func(tx *gorm.DB) error {
+		var err error
+		deliveryModel, err = webhookModel.redeliverTx(tx, c.Param("delivery"))
+		return err
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		common.AbortWithError(c, common.NewNotFoundError("delivery", errors.New("Invalid id")))
+		return
+	}
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	serializer := DeliveriesSerializer{c, []WebhookDeliveryModel{deliveryModel}}
+	response, err := serializer.Response()
+	if err != nil {
+		common.AbortWithError(c, common.NewDatabaseError(err))
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"delivery": response[0]})
+}
@@ -0,0 +1,205 @@
+package webhooks
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// What deliveries tell about users, articles and comments: the data of the event, not of a
+// response to someone, so there is no "following" or "favorited".
+type UserPayload struct {
+	Username string `json:"username"`
+}
+
+type ArticlePayload struct {
+	Slug        string      `json:"slug"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Body        string      `json:"body,omitempty"`
+	Tags        []string    `json:"tagList"`
+	Author      UserPayload `json:"author"`
+	CreatedAt   string      `json:"createdAt"`
+	UpdatedAt   string      `json:"updatedAt"`
+}
+
+type CommentPayload struct {
+	ID        uint        `json:"id"`
+	Body      string      `json:"body"`
+	ParentID  *uint       `json:"parentId"`
+	Author    UserPayload `json:"author"`
+	CreatedAt string      `json:"createdAt"`
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.999Z")
+}
+
+// The "data" of event, read when the domain event is dispatched. A deleted article or comment is
+// still read, an article.deleted tells what was deleted:
+//
+//	article.*        {"article": {...}}
+//	comment.created  {"article": {...}, "comment": {...}}, the article without its body
+//	user.followed    {"user": {...}, "follower": {...}}
+func eventDataTx(tx *gorm.DB, event string, about subject) (gin.H, error) {
+	if event == EventUserFollowed {
+		var user, follower users.UserModel
+		if err := tx.First(&user, about.UserID).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.First(&follower, about.ActorID).Error; err != nil {
+			return nil, err
+		}
+		return gin.H{"user": UserPayload{user.Username}, "follower": UserPayload{follower.Username}}, nil
+	}
+
+	var articleModel articles.ArticleModel
+	if err := tx.Unscoped().Preload("Tags").Preload("Author.UserModel").First(&articleModel, about.ArticleID).Error; err != nil {
+		return nil, err
+	}
+	article := ArticlePayload{
+		Slug:        articleModel.Slug,
+		Title:       articleModel.Title,
+		Description: articleModel.Description,
+		Body:        articleModel.Body,
+		Tags:        []string{},
+		Author:      UserPayload{articleModel.Author.UserModel.Username},
+		CreatedAt:   formatTime(articleModel.CreatedAt),
+		UpdatedAt:   formatTime(articleModel.UpdatedAt),
+	}
+	for _, tag := range articleModel.Tags {
+		article.Tags = append(article.Tags, tag.Tag)
+	}
+	if event != EventCommentCreated {
+		return gin.H{"article": article}, nil
+	}
+
+	var commentModel articles.CommentModel
+	if err := tx.Unscoped().Preload("Author.UserModel").First(&commentModel, about.CommentID).Error; err != nil {
+		return nil, err
+	}
+	article.Body = ""
+	return gin.H{"article": article, "comment": CommentPayload{
+		ID:        commentModel.ID,
+		Body:      commentModel.Body,
+		ParentID:  commentModel.ParentID,
+		Author:    UserPayload{commentModel.Author.UserModel.Username},
+		CreatedAt: formatTime(commentModel.CreatedAt),
+	}}, nil
+}
+
+type WebhookSerializer struct {
+	C *gin.Context
+	WebhookModel
+}
+
+type WebhookResponse struct {
+	ID        uint     `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Active    bool     `json:"active"`
+	Global    bool     `json:"global"`
+	Secret    string   `json:"secret,omitempty"` // only when created
+	CreatedAt string   `json:"createdAt"`
+	UpdatedAt string   `json:"updatedAt"`
+}
+
+func (s *WebhookSerializer) Response() WebhookResponse {
+	return WebhookResponse{
+		ID:        s.ID,
+		URL:       s.URL,
+		Events:    s.events(),
+		Active:    !s.Disabled,
+		Global:    s.Global,
+		CreatedAt: formatTime(s.CreatedAt),
+		UpdatedAt: formatTime(s.UpdatedAt),
+	}
+}
+
+type WebhooksSerializer struct {
+	C        *gin.Context
+	Webhooks []WebhookModel
+}
+
+func (s *WebhooksSerializer) Response() []WebhookResponse {
+	response := []WebhookResponse{}
+	for _, webhook := range s.Webhooks {
+		serializer := WebhookSerializer{s.C, webhook}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type AttemptResponse struct {
+	ResponseCode int     `json:"responseCode"`
+	ResponseBody string  `json:"responseBody"`
+	Error        *string `json:"error"`
+	DurationMs   int64   `json:"durationMs"`
+	CreatedAt    string  `json:"createdAt"`
+}
+
+type DeliveryResponse struct {
+	ID            uint              `json:"id"`
+	Event         string            `json:"event"`
+	Status        string            `json:"status"`
+	Attempts      []AttemptResponse `json:"attempts"`
+	ResponseCode  int               `json:"responseCode"`
+	NextAttemptAt *string           `json:"nextAttemptAt"`
+	DeliveredAt   *string           `json:"deliveredAt"`
+	RedeliveryOf  *uint             `json:"redeliveryOf"`
+	Payload       string            `json:"payload"`
+	CreatedAt     string            `json:"createdAt"`
+}
+
+// Deliveries with their attempts, read at once.
+type DeliveriesSerializer struct {
+	C          *gin.Context
+	Deliveries []WebhookDeliveryModel
+}
+
+func (s *DeliveriesSerializer) Response() ([]DeliveryResponse, error) {
+	attempts, err := attemptsTx(common.GetRequestDB(s.C), s.Deliveries)
+	if err != nil {
+		return nil, err
+	}
+	response := []DeliveryResponse{}
+	for _, delivery := range s.Deliveries {
+		item := DeliveryResponse{
+			ID:           delivery.ID,
+			Event:        delivery.Event,
+			Status:       delivery.Status,
+			Attempts:     []AttemptResponse{},
+			ResponseCode: delivery.ResponseCode,
+			RedeliveryOf: delivery.RedeliveryOf,
+			Payload:      delivery.Payload,
+			CreatedAt:    formatTime(delivery.CreatedAt),
+		}
+		if delivery.NextAttemptAt != nil && delivery.Status == DeliveryPending {
+			next := formatTime(*delivery.NextAttemptAt)
+			item.NextAttemptAt = &next
+		}
+		if delivery.DeliveredAt != nil {
+			delivered := formatTime(*delivery.DeliveredAt)
+			item.DeliveredAt = &delivered
+		}
+		for _, attempt := range attempts[delivery.ID] {
+			attemptResponse := AttemptResponse{
+				ResponseCode: attempt.ResponseCode,
+				ResponseBody: attempt.ResponseBody,
+				DurationMs:   attempt.DurationMs,
+				CreatedAt:    formatTime(attempt.CreatedAt),
+			}
+			if attempt.Error != "" {
+				message := attempt.Error
+				attemptResponse.Error = &message
+			}
+			item.Attempts = append(item.Attempts, attemptResponse)
+		}
+		response = append(response, item)
+	}
+	return response, nil
+}
@@ -0,0 +1,263 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/events"
+	"realworld-backend/jobs"
+	"realworld-backend/users"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	jobs.AutoMigrate()
+	events.AutoMigrate()
+	AutoMigrate()
+}
+
+func teardownTestDB() {
+	common.TestDBFree(test_db)
+}
+
+func setupRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(common.ErrorHandler())
+	v1 := r.Group("/api", users.AuthMiddleware(true))
+	articles.ArticlesRegister(v1.Group("/articles"))
+	users.ProfileRegister(v1.Group("/profiles"))
+	WebhooksRegister(v1.Group("/webhooks"))
+	return r
+}
+
+func createTestUser(username, role string) users.UserModel {
+	userModel := users.UserModel{Username: username, Email: username + "@example.com", PasswordHash: "x", Role: role}
+	test_db.Create(&userModel)
+	return userModel
+}
+
+// An endpoint keeping the deliveries it gets, answering with status.
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	w.WriteHeader(r.status)
+	fmt.Fprint(w, "thanks")
+}
+
+// The events received so far, checking every signature on the way.
+func (r *receiver) events(t *testing.T, secrets ...string) []eventPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []eventPayload
+	for i, req := range r.requests {
+		valid := false
+		for _, secret := range secrets {
+			valid = valid || Sign(secret, req.Header.Get("X-Webhook-Timestamp"), r.bodies[i]) == req.Header.Get("X-Webhook-Signature")
+		}
+		assert.True(t, valid, "signed with the secret of the webhook")
+		var event eventPayload
+		assert.NoError(t, json.Unmarshal(r.bodies[i], &event))
+		assert.Equal(t, event.Event, req.Header.Get("X-Webhook-Event"))
+		events = append(events, event)
+	}
+	r.requests, r.bodies = nil, nil
+	return events
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	asserts := assert.New(t)
+	setupTestDB()
+	defer teardownTestDB()
+	defer func(backoff time.Duration) { deliverJob.Options.Backoff = backoff }(deliverJob.Options.Backoff)
+	deliverJob.Options.Backoff = 0
+
+	endpoint := &receiver{status: http.StatusOK}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	defer func(client *http.Client) { Client = client }(Client)
+	Client = server.Client()
+	dispatcher := events.NewDispatcher(test_db)
+	worker := jobs.NewWorker(test_db)
+	deliverDue := func() int {
+		dispatcher.DispatchDue()
+		started := worker.RunDue()
+		worker.Wait()
+		return started
+	}
+	router := setupRouter()
+	as := func(user users.UserModel, method, path, body string) (int, gin.H) {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Token "+common.GenToken(user.ID))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response gin.H
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	owner := createTestUser("hookowner", users.RoleUser)
+	admin := createTestUser("hookadmin", users.RoleAdmin)
+	other := createTestUser("hookother", users.RoleUser)
+
+	code, _ := as(owner, "POST", "/api/webhooks/", `{"webhook":{"url":"ftp://example.com","events":["article.published"]}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	code, _ = as(owner, "POST", "/api/webhooks/", `{"webhook":{"url":"https://example.com","events":["article.favorited"]}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+
+	code, response := as(owner, "POST", "/api/webhooks/", `{"webhook":{"url":"`+server.URL+`","events":["article.published","comment.created"]}}`)
+	asserts.Equal(http.StatusCreated, code)
+	ownerHook := response["webhook"].(map[string]interface{})
+	asserts.Equal(false, ownerHook["global"])
+	asserts.Len(ownerHook["secret"], 64)
+	ownerHookPath := fmt.Sprintf("/api/webhooks/%v", ownerHook["id"])
+	code, response = as(admin, "POST", "/api/webhooks/", `{"webhook":{"url":"`+server.URL+`","events":["article.published","article.updated","article.deleted","comment.created","user.followed"]}}`)
+	asserts.Equal(http.StatusCreated, code)
+	adminHook := response["webhook"].(map[string]interface{})
+	asserts.Equal(true, adminHook["global"])
+	secrets := []string{ownerHook["secret"].(string), adminHook["secret"].(string)}
+
+	code, response = as(owner, "GET", ownerHookPath, "")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Nil(response["webhook"].(map[string]interface{})["secret"], "the secret is only shown once")
+	code, _ = as(other, "GET", ownerHookPath, "")
+	asserts.Equal(http.StatusNotFound, code)
+
+	// the webhooks of users only get the events about them
+	code, _ = as(owner, "POST", "/api/articles/", `{"article":{"title":"Hooked Article","body":"Body","tagList":["go"]}}`)
+	asserts.Equal(http.StatusCreated, code)
+	code, _ = as(other, "POST", "/api/articles/", `{"article":{"title":"Other Article","body":"Body"}}`)
+	asserts.Equal(http.StatusCreated, code)
+	asserts.Equal(3, deliverDue())
+	events := endpoint.events(t, secrets...)
+	asserts.Len(events, 3)
+	byID := map[string][]eventPayload{}
+	for _, event := range events {
+		asserts.Equal(EventArticlePublished, event.Event)
+		byID[event.ID] = append(byID[event.ID], event)
+	}
+	asserts.Len(byID, 2, "the event about the owner is delivered to both webhooks")
+	for _, same := range byID {
+		article := same[0].Data.(map[string]interface{})["article"].(map[string]interface{})
+		if len(same) == 2 {
+			asserts.Equal("hooked-article", article["slug"])
+			asserts.Equal("hookowner", article["author"].(map[string]interface{})["username"])
+			asserts.Equal([]interface{}{"go"}, article["tagList"])
+		} else {
+			asserts.Equal("other-article", article["slug"])
+		}
+	}
+	asserts.Equal(0, deliverDue(), "delivered once")
+
+	// the webhook of a demoted admin is no longer global
+	asserts.NoError(admin.SetRole(users.RoleUser))
+	code, _ = as(other, "POST", "/api/articles/", `{"article":{"title":"Unseen Article","body":"Body"}}`)
+	asserts.Equal(http.StatusCreated, code)
+	asserts.Equal(0, deliverDue())
+	asserts.NoError(admin.SetRole(users.RoleAdmin))
+
+	code, _ = as(other, "POST", "/api/articles/hooked-article/comments", `{"comment":{"body":"Nice"}}`)
+	asserts.Equal(http.StatusCreated, code)
+	code, _ = as(other, "POST", "/api/profiles/hookowner/follow", "")
+	asserts.Equal(http.StatusOK, code)
+	code, _ = as(owner, "PUT", "/api/articles/hooked-article", `{"article":{"title":"Hooked Article","body":"Edited"}}`)
+	asserts.Equal(http.StatusOK, code)
+	code, _ = as(owner, "DELETE", "/api/articles/hooked-article", "")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(5, deliverDue())
+	kinds := map[string]int{}
+	for _, event := range endpoint.events(t, secrets...) {
+		kinds[event.Event]++
+		switch event.Event {
+		case EventCommentCreated:
+			data := event.Data.(map[string]interface{})
+			asserts.Equal("Nice", data["comment"].(map[string]interface{})["body"])
+			asserts.Equal("hooked-article", data["article"].(map[string]interface{})["slug"])
+		case EventUserFollowed:
+			data := event.Data.(map[string]interface{})
+			asserts.Equal("hookother", data["follower"].(map[string]interface{})["username"])
+		case EventArticleDeleted:
+			asserts.Equal("Edited", event.Data.(map[string]interface{})["article"].(map[string]interface{})["body"])
+		}
+	}
+	asserts.Equal(map[string]int{EventCommentCreated: 2, EventUserFollowed: 1, EventArticleUpdated: 1, EventArticleDeleted: 1}, kinds)
+
+	// failing endpoints are retried until MaxAttempts
+	code, _ = as(admin, "PUT", fmt.Sprintf("/api/webhooks/%v", adminHook["id"]), `{"webhook":{"active":false}}`)
+	asserts.Equal(http.StatusOK, code)
+	endpoint.status = http.StatusInternalServerError
+	code, _ = as(owner, "POST", "/api/articles/", `{"article":{"title":"Failing Article","body":"Body"}}`)
+	asserts.Equal(http.StatusCreated, code)
+	for i := 0; i < deliverJob.Options.MaxAttempts+1; i++ {
+		deliverDue()
+	}
+	asserts.Len(endpoint.events(t, secrets...), deliverJob.Options.MaxAttempts, "the disabled webhook gets nothing")
+	var deadJob jobs.JobModel
+	asserts.NoError(test_db.Where("status = ?", jobs.JobDead).First(&deadJob).Error, "the job of the delivery is dead too")
+	asserts.Equal("endpoint answered 500", deadJob.LastError)
+
+	code, response = as(owner, "GET", ownerHookPath+"/deliveries?status=failed", "")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(float64(1), response["deliveriesCount"])
+	failed := response["deliveries"].([]interface{})[0].(map[string]interface{})
+	asserts.Equal(float64(500), failed["responseCode"])
+	asserts.Len(failed["attempts"], deliverJob.Options.MaxAttempts)
+	asserts.Equal("thanks", failed["attempts"].([]interface{})[0].(map[string]interface{})["responseBody"])
+	code, response = as(owner, "GET", ownerHookPath+"/deliveries", "")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(float64(3), response["deliveriesCount"])
+
+	endpoint.status = http.StatusOK
+	code, response = as(owner, "POST", fmt.Sprintf("%s/deliveries/%v/redeliver", ownerHookPath, failed["id"]), "")
+	asserts.Equal(http.StatusAccepted, code)
+	asserts.Equal("pending", response["delivery"].(map[string]interface{})["status"])
+	asserts.Equal(1, deliverDue())
+	events = endpoint.events(t, secrets...)
+	asserts.Len(events, 1)
+	asserts.Contains(failed["payload"], events[0].ID, "the same event again")
+	code, _ = as(other, "POST", fmt.Sprintf("%s/deliveries/%v/redeliver", ownerHookPath, failed["id"]), "")
+	asserts.Equal(http.StatusNotFound, code)
+
+	// the default client does not call local addresses
+	code, _ = as(owner, "POST", "/api/articles/", `{"article":{"title":"Private Article","body":"Body"}}`)
+	asserts.Equal(http.StatusCreated, code)
+	Client = NewClient(false)
+	deliverDue()
+	asserts.Empty(endpoint.events(t))
+	var attempt WebhookAttemptModel
+	test_db.Order("id desc").First(&attempt)
+	asserts.Contains(attempt.Error, "refusing to connect")
+
+	code, _ = as(owner, "DELETE", ownerHookPath, "")
+	asserts.Equal(http.StatusOK, code)
+	code, response = as(owner, "GET", "/api/webhooks/", "")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(float64(0), response["webhooksCount"])
+}
@@ -0,0 +1,40 @@
+package webhooks
+
+import (
+	"github.com/gin-gonic/gin"
+	"realworld-backend/common"
+)
+
+type WebhookModelValidator struct {
+	Webhook struct {
+		URL    string   `form:"url" json:"url" binding:"required,http_url,max=2048"`
+		Events []string `form:"events" json:"events" binding:"required,min=1,dive,oneof=article.published article.updated article.deleted comment.created user.followed"`
+		Active *bool    `form:"active" json:"active"`
+	} `json:"webhook"`
+	webhookModel WebhookModel `json:"-"`
+}
+
+func NewWebhookModelValidator() WebhookModelValidator {
+	return WebhookModelValidator{}
+}
+
+// For an update, what the request leaves out stays as it was.
+func NewWebhookModelValidatorFillWith(webhookModel WebhookModel) WebhookModelValidator {
+	webhookModelValidator := NewWebhookModelValidator()
+	webhookModelValidator.Webhook.URL = webhookModel.URL
+	webhookModelValidator.Webhook.Events = webhookModel.events()
+	active := !webhookModel.Disabled
+	webhookModelValidator.Webhook.Active = &active
+	return webhookModelValidator
+}
+
+func (s *WebhookModelValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+	s.webhookModel.URL = s.Webhook.URL
+	s.webhookModel.setEvents(s.Webhook.Events)
+	s.webhookModel.Disabled = s.Webhook.Active != nil && !*s.Webhook.Active
+	return nil
+}